@@ -0,0 +1,79 @@
+// Command pegast generates Go node types for the rules of a peg
+// grammar, with a function converting parse trees into them and a
+// visitor interface. Label the parts of a rule, as in
+// 'sum <- left:term (op:('+' / '-') right:term)*', to name the fields
+// of its type.
+//
+// It reads the grammar from the file given, resolving imports
+// relative to its directory, or from standard input, and writes the
+// code to standard output or to the file named by -o.
+//
+//	pegast [-pkg name] [-o file] [grammar.peg]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+var (
+	pkg    = flag.String("pkg", "ast", "package name of the generated code")
+	output = flag.String("o", "", "write the code to this file instead of standard output")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pegast [flags] [grammar.peg]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	name, in, imp := "<standard input>", io.Reader(os.Stdin), peg.Importer(peg.DirImporter("."))
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		name = flag.Arg(0)
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in, imp = f, peg.DirImporter(filepath.Dir(name))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := generate(name, in, imp, *pkg)
+	if err == nil && *output != "" {
+		err = ioutil.WriteFile(*output, src, 0644)
+	} else if err == nil {
+		_, err = os.Stdout.Write(src)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// generate returns the code for the grammar read from in.
+func generate(name string, in io.Reader, imp peg.Importer, pkg string) ([]byte, error) {
+	g, err := peg.ParseGrammar(in, peg.WithImporter(imp))
+	if gerr, ok := err.(*peg.GrammarError); ok && gerr.File == "" {
+		return nil, fmt.Errorf("%s:%s", name, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	src, err := peg.GenerateAST(g, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return src, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+func TestGenerate(t *testing.T) {
+	imp := peg.MapImporter{"common.peg": "word <- ~'[a-z]+'"}
+	src, err := generate("list.peg", strings.NewReader("import \"common.peg\" as c\nlist <- first:c.word (',' rest:c.word)*\n"), imp, "lists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []string{"package lists\n", "\tFirst *CWord\n", "\tRest  []*CWord\n", "func Convert(tree *peg.ParseTree) (*List, error) {\n"} {
+		if !strings.Contains(string(src), exp) {
+			t.Errorf("no %q in:\n%s", exp, src)
+		}
+	}
+
+	if _, err := generate("bad.peg", strings.NewReader("a <- b"), imp, "x"); err == nil || err.Error() != "bad.peg:1:6: undefined rule b" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := generate("clash.peg", strings.NewReader("node <- 'x'"), imp, "x"); err == nil || err.Error() != "clash.peg: rule node: Node is a name of the generated code" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
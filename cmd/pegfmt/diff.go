@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+func splitLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// edit is one line of a diff: ' ' for lines in both inputs, '-'
+// for lines only in a and '+' for lines only in b.
+type edit struct {
+	op   byte
+	line string
+}
+
+// lineDiff computes a shortest edit script from a to b using the
+// longest common subsequence of their lines.
+func lineDiff(a, b []string) []edit {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+	return edits
+}
+
+// writeDiff writes the differences between a and b in unified
+// format.
+func writeDiff(w io.Writer, a, b []string) {
+	edits := lineDiff(a, b)
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// Extend the hunk while changes are close enough together
+		// for their context to overlap.
+		lo := start - context
+		if lo < 0 {
+			lo = 0
+		}
+		hi := start
+		for k := start; k < len(edits) && k <= hi+2*context; k++ {
+			if edits[k].op != ' ' {
+				hi = k
+			}
+		}
+		hi += context + 1
+		if hi > len(edits) {
+			hi = len(edits)
+		}
+
+		aStart, bStart := 1, 1
+		for _, e := range edits[:lo] {
+			if e.op != '+' {
+				aStart++
+			}
+			if e.op != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, e := range edits[lo:hi] {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, e := range edits[lo:hi] {
+			line := e.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+			fmt.Fprintf(w, "%c%s", e.op, line)
+		}
+		start = hi
+	}
+}
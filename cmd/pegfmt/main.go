@@ -0,0 +1,100 @@
+// Command pegfmt formats peg grammars.
+//
+// Without paths it formats standard input to standard output. Given
+// files or directories, it formats every .peg file found.
+//
+//	pegfmt [-w] [-l] [-d] [path ...]
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+var (
+	write = flag.Bool("w", false, "write result to the source file instead of standard output")
+	list  = flag.Bool("l", false, "list files whose formatting differs")
+	diff  = flag.Bool("d", false, "display diffs instead of rewriting files")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pegfmt [flags] [path ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	status := 0
+	if flag.NArg() == 0 {
+		if err := processFile("<standard input>", os.Stdin, os.Stdout, false); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+		os.Exit(status)
+	}
+
+	for _, root := range flag.Args() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || (path != root && filepath.Ext(path) != ".peg") {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return processFile(path, f, os.Stdout, true)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// processFile formats the grammar read from in, reporting according
+// to the flags. File results may be written back in place.
+func processFile(name string, in io.Reader, out io.Writer, isFile bool) error {
+	src, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	res, err := peg.Format(src)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	if bytes.Equal(src, res) {
+		if !*list && !*write && !*diff {
+			_, err = out.Write(res)
+		}
+		return err
+	}
+	if *list {
+		fmt.Fprintln(out, name)
+	}
+	if *write && isFile {
+		if err := ioutil.WriteFile(name, res, 0644); err != nil {
+			return err
+		}
+	}
+	if *diff {
+		fmt.Fprintf(out, "--- %s\n+++ %s (formatted)\n", name, name)
+		writeDiff(out, splitLines(src), splitLines(res))
+	}
+	if !*list && !*write && !*diff {
+		_, err = out.Write(res)
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	a := splitLines([]byte("a\nb\nc\nd\n"))
+	b := splitLines([]byte("a\nc\nx\nd\n"))
+	var ops []byte
+	for _, e := range lineDiff(a, b) {
+		ops = append(ops, e.op)
+	}
+	if string(ops) != " - + " {
+		t.Errorf("incorrect edit script: %q", ops)
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	var buf bytes.Buffer
+	writeDiff(&buf, splitLines([]byte("a<-'x'\nb <- 'y'\n")), splitLines([]byte("a <- 'x'\nb <- 'y'\n")))
+	exp := "@@ -1,2 +1,2 @@\n-a<-'x'\n+a <- 'x'\n b <- 'y'\n"
+	if buf.String() != exp {
+		t.Errorf("incorrect diff:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+}
+
+func TestProcessFile(t *testing.T) {
+	var buf bytes.Buffer
+	if err := processFile("test.peg", strings.NewReader("a<-'x'\nbb <- 'y'"), &buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "a  <- 'x'\nbb <- 'y'\n"; buf.String() != exp {
+		t.Errorf("incorrect output:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+
+	if err := processFile("bad.peg", strings.NewReader("a <- 'x"), &buf, false); err == nil {
+		t.Error("expected error for malformed grammar")
+	}
+}
@@ -0,0 +1,89 @@
+// Command peglint reports likely mistakes in peg grammars: duplicate
+// definitions, undefined and unreachable rules, and alternatives that
+// can never match.
+//
+// Without paths it checks standard input. Given files or directories,
+// it checks every .peg file found, resolving imports relative to the
+// directory of each file. Each warning starts with the file, line and
+// column of the problem. The exit status is 1 if any warnings or
+// errors were reported.
+//
+//	peglint [path ...]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: peglint [path ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	status := 0
+	report := func(err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	if flag.NArg() == 0 {
+		n, err := lintFile("<standard input>", os.Stdin, peg.DirImporter("."), os.Stdout)
+		report(err)
+		if n > 0 {
+			status = 1
+		}
+		os.Exit(status)
+	}
+
+	for _, root := range flag.Args() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || (path != root && filepath.Ext(path) != ".peg") {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			n, err := lintFile(path, f, peg.DirImporter(filepath.Dir(path)), os.Stdout)
+			if n > 0 {
+				status = 1
+			}
+			report(err)
+			return nil
+		})
+		report(err)
+	}
+	os.Exit(status)
+}
+
+// lintFile writes the warnings for the grammar read from in to out,
+// returning how many there were.
+func lintFile(name string, in io.Reader, imp peg.Importer, out io.Writer) (int, error) {
+	warnings, err := peg.LintGrammar(in, peg.WithImporter(imp))
+	if gerr, ok := err.(*peg.GrammarError); ok && gerr.File == "" {
+		return 0, fmt.Errorf("%s:%s", name, err)
+	} else if err != nil {
+		return 0, fmt.Errorf("%s: %s", name, err)
+	}
+	for _, w := range warnings {
+		if w.File == "" {
+			fmt.Fprintf(out, "%s:%s (%s)\n", name, w, w.Kind)
+		} else {
+			fmt.Fprintf(out, "%s (%s)\n", w, w.Kind)
+		}
+	}
+	return len(warnings), nil
+}
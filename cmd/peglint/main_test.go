@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+func TestLintFile(t *testing.T) {
+	imp := peg.MapImporter{"common.peg": "digit <- ~'[0-9]'\nletter <- ~'[a-z]'"}
+	var buf bytes.Buffer
+	n, err := lintFile("test.peg", strings.NewReader("import \"common.peg\" as c\nnum <- c.digit+ / 'x'\n"), imp, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "common.peg:2:1: rule c.letter: not reachable from start rule num (unreachable)\n"
+	if n != 1 || buf.String() != exp {
+		t.Errorf("got %d warnings:\n%s\nexp:\n%s", n, buf.String(), exp)
+	}
+
+	buf.Reset()
+	n, err = lintFile("undef.peg", strings.NewReader("a <- b"), imp, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = "undef.peg:1:6: rule a: undefined rule b (undefined)\n"
+	if n != 1 || buf.String() != exp {
+		t.Errorf("got %d warnings:\n%s\nexp:\n%s", n, buf.String(), exp)
+	}
+
+	if _, err := lintFile("bad.peg", strings.NewReader("%start b\na <- 'a'"), imp, &buf); err == nil || err.Error() != "bad.peg:1:1: start rule b is not defined" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
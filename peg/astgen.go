@@ -0,0 +1,645 @@
+package peg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"strings"
+	"unicode"
+)
+
+// GenerateAST returns the source of a Go package named pkg with a
+// node type for each rule of g, a Convert function turning the
+// ParseTrees of Compile(g) into nodes, and a Visitor for the nodes.
+//
+// A rule that refers to a single rule is an alias of that rule's
+// type, and one that chooses between rule references is an
+// interface implemented by the types of the rules it chooses from.
+// A rule referring to no rule and using no labels is a token, a
+// struct holding the text it matched. Any other rule is a struct
+// with a field for each label and for each rule referred to outside
+// a label, in the order they first appear. A label on an expression
+// referring to rules names the nodes of those rules, and a label on
+// any other expression the terminals it matches, as Tokens. A field
+// is a slice if what it names may occur more than once, and a Node if
+// it names several rules. Rules building no trees, and the skip rule,
+// have no type.
+//
+// Names are turned into Go names by capitalizing the words they are
+// made of, so 'if_stmt' becomes IfStmt. Names that clash, in Go or
+// with the names of the generated code, are errors, as are labels
+// naming both terminals and rules.
+func GenerateAST(g *Grammar, pkg string) ([]byte, error) {
+	m, err := NewFieldMatcher(g)
+	if err != nil {
+		return nil, err
+	}
+	a := &astGen{m: m, rules: make(map[string]*astRule)}
+	if err := a.plan(g); err != nil {
+		return nil, err
+	}
+	a.write(pkg)
+	src, err := format.Source(a.buf.Bytes())
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("formatting generated code: %s", err))
+	}
+	return src, nil
+}
+
+type astKind int
+
+const (
+	astStruct astKind = iota
+	astToken
+	astUnion
+	astAlias
+)
+
+// astRule is the node type planned for a rule.
+type astRule struct {
+	rule   *Rule
+	goName string
+	kind   astKind
+	target string      // the rule an alias stands for
+	alts   []string    // the rules a union chooses between
+	fields []*astField // the fields of a struct
+	unions []*astRule  // the unions the type is a member of
+}
+
+// astField is a field of a struct node type.
+type astField struct {
+	key    string // the key of its trees in FieldMatcher.Match
+	goName string
+	rules  []string // the rules it names, if any
+	token  bool     // whether it names terminals
+	many   bool
+}
+
+type astGen struct {
+	m     *FieldMatcher
+	order []*astRule
+	rules map[string]*astRule
+	start *astRule
+	token bool // whether any field is a Token
+	multi bool // whether any struct has more than one field
+	buf   bytes.Buffer
+}
+
+// astReserved are the names of the generated code that node types
+// could clash with.
+var astReserved = map[string]bool{"Node": true, "Visitor": true, "Token": true, "Walk": true, "Convert": true}
+
+// astMethods are the methods of every node type, which fields
+// cannot be named after.
+var astMethods = map[string]bool{"Tree": true, "Children": true, "Accept": true}
+
+// plan works out the node type of each rule.
+func (a *astGen) plan(g *Grammar) error {
+	c := a.m.c
+	names := make(map[string]string)
+	for i, r := range c.rules {
+		if r.Name == g.Skip || len(a.m.types[i]) == 0 {
+			continue
+		}
+		ar := &astRule{rule: r, goName: goName(r.Name)}
+		switch {
+		case ar.goName == "":
+			return errors.New(fmt.Sprintf("rule %s has no Go name", r.Name))
+		case astReserved[ar.goName]:
+			return errors.New(fmt.Sprintf("rule %s: %s is a name of the generated code", r.Name, ar.goName))
+		case names[ar.goName] != "":
+			return errors.New(fmt.Sprintf("rules %s and %s are both %s in Go", names[ar.goName], r.Name, ar.goName))
+		}
+		names[ar.goName] = r.Name
+		a.rules[r.Name] = ar
+		a.order = append(a.order, ar)
+	}
+
+	for _, ar := range a.order {
+		switch e := ar.rule.Expr.(type) {
+		case *Ref:
+			if a.rules[e.Name] != nil {
+				ar.kind, ar.target = astAlias, e.Name
+				continue
+			}
+		case *Choice:
+			ar.kind, ar.alts = astUnion, nil
+			for _, alt := range e.Alternatives {
+				if ref, ok := alt.(*Ref); ok && a.rules[ref.Name] != nil {
+					ar.alts = append(ar.alts, ref.Name)
+				} else {
+					ar.kind, ar.alts = astStruct, nil
+					break
+				}
+			}
+			if ar.kind == astUnion {
+				continue
+			}
+		}
+		if err := a.planFields(ar); err != nil {
+			return err
+		}
+		if len(ar.fields) == 0 && !hasLabel(ar.rule.Expr) {
+			ar.kind = astToken
+		}
+	}
+
+	for _, ar := range a.order {
+		if ar.kind == astUnion {
+			for _, member := range a.members(ar, nil) {
+				member.unions = append(member.unions, ar)
+			}
+		}
+	}
+
+	start := g.Start
+	if start == "" {
+		start = c.rules[0].Name
+	}
+	if a.start = a.rules[start]; a.start == nil {
+		return errors.New(fmt.Sprintf("start rule %s builds no trees", start))
+	}
+	return nil
+}
+
+// planFields works out the fields of a struct.
+func (a *astGen) planFields(ar *astRule) error {
+	byKey := make(map[string]*astField)
+	// add records the field named key, which names rule, or terminals
+	// if rule is "".
+	add := func(key, rule string) {
+		f := byKey[key]
+		if f == nil {
+			f = &astField{key: key, goName: goName(key)}
+			byKey[key] = f
+			ar.fields = append(ar.fields, f)
+		}
+		if rule == "" {
+			f.token = true
+		} else if !containsString(f.rules, rule) {
+			f.rules = append(f.rules, rule)
+		}
+	}
+	// walk adds the fields of e and returns how many times each may
+	// occur in a match of e, counting 2 for more than one.
+	var walk func(e Expr, label string) map[string]int
+	walk = func(e Expr, label string) map[string]int {
+		counts := make(map[string]int)
+		switch e := e.(type) {
+		case *Sequence:
+			for _, part := range e.Exprs {
+				for key, n := range walk(part, label) {
+					counts[key] += n
+				}
+			}
+		case *Choice:
+			for _, alt := range e.Alternatives {
+				for key, n := range walk(alt, label) {
+					if n > counts[key] {
+						counts[key] = n
+					}
+				}
+			}
+		case *Repetition:
+			for key, n := range walk(e.Expr, label) {
+				if e.Kind != Optional {
+					n = 2
+				}
+				counts[key] = n
+			}
+		case *Label:
+			if a.m.refersToRules(e.Expr) {
+				return walk(e.Expr, e.Name)
+			}
+			if n := terminals(e.Expr); n > 0 {
+				add(e.Name, "")
+				counts[e.Name] = n
+			}
+		case *Ref:
+			if a.rules[e.Name] == nil {
+				break
+			}
+			key := label
+			if key == "" {
+				key = e.Name
+			}
+			add(key, e.Name)
+			counts[key] = 1
+		}
+		return counts
+	}
+	for key, n := range walk(ar.rule.Expr, "") {
+		byKey[key].many = n > 1
+	}
+	if len(ar.fields) > 1 {
+		a.multi = true
+	}
+
+	names := make(map[string]string)
+	for _, f := range ar.fields {
+		switch {
+		case f.goName == "":
+			return errors.New(fmt.Sprintf("rule %s: field %s has no Go name", ar.rule.Name, f.key))
+		case astMethods[f.goName]:
+			return errors.New(fmt.Sprintf("rule %s: field %s clashes with the method %s; label it", ar.rule.Name, f.key, f.goName))
+		case names[f.goName] != "":
+			return errors.New(fmt.Sprintf("rule %s: fields %s and %s are both %s in Go", ar.rule.Name, names[f.goName], f.key, f.goName))
+		case f.token && len(f.rules) > 0:
+			return errors.New(fmt.Sprintf("rule %s: label %s names both terminals and rules", ar.rule.Name, f.key))
+		}
+		names[f.goName] = f.key
+		if f.token {
+			a.token = true
+		}
+	}
+	return nil
+}
+
+// terminals returns how many leaves e may build: 0, 1, or 2 for more
+// than one.
+func terminals(e Expr) int {
+	n := 0
+	switch e := e.(type) {
+	case *Sequence:
+		for _, part := range e.Exprs {
+			n += terminals(part)
+		}
+	case *Choice:
+		for _, alt := range e.Alternatives {
+			if t := terminals(alt); t > n {
+				n = t
+			}
+		}
+	case *Repetition:
+		n = terminals(e.Expr)
+		if e.Kind != Optional && n > 0 {
+			n = 2
+		}
+	case *Label:
+		n = terminals(e.Expr)
+	case *Literal, *Regexp:
+		n = 1
+	}
+	if n > 2 {
+		n = 2
+	}
+	return n
+}
+
+func hasLabel(e Expr) bool {
+	found := false
+	walkExpr(e, func(e Expr) {
+		if _, ok := e.(*Label); ok {
+			found = true
+		}
+	})
+	return found
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve follows aliases from the rule called name.
+func (a *astGen) resolve(name string) *astRule {
+	ar := a.rules[name]
+	for seen := 0; ar.kind == astAlias && seen < len(a.order); seen++ {
+		ar = a.rules[ar.target]
+	}
+	return ar
+}
+
+// members returns the struct and token types of the rules a union
+// chooses between, directly or through other unions.
+func (a *astGen) members(union *astRule, seen map[*astRule]bool) []*astRule {
+	if seen == nil {
+		seen = make(map[*astRule]bool)
+	}
+	var members []*astRule
+	for _, alt := range union.alts {
+		ar := a.resolve(alt)
+		if seen[ar] {
+			continue
+		}
+		seen[ar] = true
+		switch ar.kind {
+		case astUnion:
+			members = append(members, a.members(ar, seen)...)
+		case astStruct, astToken:
+			members = append(members, ar)
+		}
+	}
+	return members
+}
+
+// goType returns the type of a field holding a node of ar.
+func (a *astGen) goType(ar *astRule) string {
+	if a.resolve(ar.rule.Name).kind == astUnion {
+		return ar.goName
+	}
+	return "*" + ar.goName
+}
+
+// fieldType returns the type of f.
+func (a *astGen) fieldType(f *astField) string {
+	typ := "Node"
+	switch {
+	case f.token:
+		typ = "*Token"
+	case len(f.rules) == 1:
+		typ = a.goType(a.rules[f.rules[0]])
+	}
+	if f.many {
+		return "[]" + typ
+	}
+	return typ
+}
+
+// converter returns a call converting the tree t for f, which names
+// rules.
+func (a *astGen) converter(f *astField) string {
+	if len(f.rules) == 1 {
+		return "convert" + a.resolve(f.rules[0]).goName + "(t)"
+	}
+	return "firstMatch(t" + quoteList(f.rules) + ")"
+}
+
+func quoteList(names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, ", %q", name)
+	}
+	return b.String()
+}
+
+func (a *astGen) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&a.buf, format, args...)
+}
+
+func (a *astGen) write(pkg string) {
+	a.printf("// Code generated by GenerateAST. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	a.printf("import (\n\"errors\"\n\"fmt\"\n")
+	if a.multi {
+		a.printf("\"sort\"\n")
+	}
+	a.printf("\n\"github.com/Logiraptor/chicken/peg\"\n)\n\n")
+
+	a.printf("// Node is a node of the tree Convert builds.\ntype Node interface {\n")
+	a.printf("// Tree returns the parse tree the node was converted from.\nTree() *peg.ParseTree\n")
+	a.printf("// Children returns the nodes in the fields of the node, in the\n// order their trees appear in the input.\nChildren() []Node\n")
+	a.printf("// Accept calls the method of v for the type of the node.\nAccept(v Visitor)\n}\n\n")
+
+	a.printf("// Visitor has a method for each type of Node.\ntype Visitor interface {\n")
+	for _, ar := range a.order {
+		if ar.kind == astStruct || ar.kind == astToken {
+			a.printf("Visit%s(n *%s)\n", ar.goName, ar.goName)
+		}
+	}
+	if a.token {
+		a.printf("VisitToken(n *Token)\n")
+	}
+	a.printf("}\n\n")
+
+	a.printf("// Walk calls fn for n and, while fn returns true, for the\n// children of each node it is called for, depth first.\n")
+	a.printf("func Walk(n Node, fn func(Node) bool) {\nif fn(n) {\nfor _, c := range n.Children() {\nWalk(c, fn)\n}\n}\n}\n\n")
+
+	start := a.resolve(a.start.rule.Name)
+	a.printf("// Convert converts a tree built by rule %s.\n", a.start.rule.Name)
+	a.printf("func Convert(tree *peg.ParseTree) (%s, error) {\nreturn convert%s(tree)\n}\n\n", a.goType(a.start), start.goName)
+
+	if a.token {
+		a.printf("// Token is a labeled terminal.\ntype Token struct {\ntree *peg.ParseTree\nText string\n}\n\n")
+		a.writeMethods("Token", nil)
+	}
+	for _, ar := range a.order {
+		a.writeType(ar)
+	}
+	a.writeConvert()
+}
+
+func (a *astGen) writeType(ar *astRule) {
+	name := ar.rule.Name
+	switch ar.kind {
+	case astAlias:
+		a.printf("// %s is the node of rule %s, an alias of rule %s.\n", ar.goName, name, ar.target)
+		a.printf("type %s = %s\n\n", ar.goName, a.rules[ar.target].goName)
+		return
+	case astUnion:
+		a.printf("// %s is a node of rule %s: one of %s.\n", ar.goName, name, a.typeList(ar.alts))
+		a.printf("type %s interface {\nNode\nis%s()\n}\n\n", ar.goName, ar.goName)
+		return
+	case astToken:
+		a.printf("// %s is the text matched by rule %s.\n", ar.goName, name)
+		a.printf("type %s struct {\ntree *peg.ParseTree\nText string\n}\n\n", ar.goName)
+		a.writeMethods(ar.goName, ar)
+		return
+	}
+	a.printf("// %s is the node of rule %s.\ntype %s struct {\ntree *peg.ParseTree\n", ar.goName, name, ar.goName)
+	for _, f := range ar.fields {
+		a.printf("%s %s\n", f.goName, a.fieldType(f))
+	}
+	a.printf("}\n\n")
+	a.writeMethods(ar.goName, ar)
+}
+
+func (a *astGen) typeList(names []string) string {
+	var types []string
+	for _, name := range names {
+		types = append(types, a.rules[name].goName)
+	}
+	if len(types) < 2 {
+		return strings.Join(types, "")
+	}
+	return strings.Join(types[:len(types)-1], ", ") + " or " + types[len(types)-1]
+}
+
+// writeMethods writes the methods of the struct type called name,
+// which is the node type of ar if ar is not nil.
+func (a *astGen) writeMethods(name string, ar *astRule) {
+	a.printf("func (n *%s) Tree() *peg.ParseTree {\nreturn n.tree\n}\n\n", name)
+	a.printf("func (n *%s) Children() []Node {\n", name)
+	var fields []*astField
+	if ar != nil {
+		fields = ar.fields
+	}
+	if len(fields) == 0 {
+		a.printf("return nil\n}\n\n")
+	} else {
+		a.printf("var c []Node\n")
+		for _, f := range fields {
+			if f.many {
+				a.printf("for _, x := range n.%s {\nc = append(c, x)\n}\n", f.goName)
+			} else {
+				a.printf("if n.%s != nil {\nc = append(c, n.%s)\n}\n", f.goName, f.goName)
+			}
+		}
+		if len(fields) > 1 {
+			a.printf("return inTreeOrder(n.tree, c)\n}\n\n")
+		} else {
+			a.printf("return c\n}\n\n")
+		}
+	}
+	a.printf("func (n *%s) Accept(v Visitor) {\nv.Visit%s(n)\n}\n\n", name, name)
+	if ar != nil {
+		for _, u := range ar.unions {
+			a.printf("func (*%s) is%s() {}\n\n", name, u.goName)
+		}
+	}
+}
+
+func (a *astGen) writeConvert() {
+	for _, ar := range a.order {
+		name := ar.rule.Name
+		switch ar.kind {
+		case astAlias:
+			continue
+		case astUnion:
+			a.printf("func convert%s(t *peg.ParseTree) (%s, error) {\n", ar.goName, ar.goName)
+			a.printf("n, err := firstMatch(t%s)\nif err != nil {\nreturn nil, err\n}\n", quoteList(ar.alts))
+			a.printf("return n.(%s), nil\n}\n\n", ar.goName)
+			continue
+		}
+		a.printf("func convert%s(t *peg.ParseTree) (*%s, error) {\n", ar.goName, ar.goName)
+		if ar.kind == astToken {
+			a.printf("if _, err := fields.Match(%q, t); err != nil {\nreturn nil, err\n}\n", name)
+			a.printf("return &%s{tree: t, Text: t.Text()}, nil\n}\n\n", ar.goName)
+			continue
+		}
+		if len(ar.fields) == 0 {
+			a.printf("if _, err := fields.Match(%q, t); err != nil {\nreturn nil, err\n}\n", name)
+			a.printf("return &%s{tree: t}, nil\n}\n\n", ar.goName)
+			continue
+		}
+		a.printf("f, err := fields.Match(%q, t)\nif err != nil {\nreturn nil, err\n}\n", name)
+		a.printf("n := &%s{tree: t}\n", ar.goName)
+		for _, f := range ar.fields {
+			conv := a.converter(f)
+			if f.many {
+				a.printf("for _, t := range f[%q] {\n", f.key)
+				if f.token {
+					a.printf("n.%s = append(n.%s, &Token{tree: t, Text: t.Text()})\n}\n", f.goName, f.goName)
+					continue
+				}
+				a.printf("c, err := %s\nif err != nil {\nreturn nil, err\n}\n", conv)
+				a.printf("n.%s = append(n.%s, c)\n}\n", f.goName, f.goName)
+				continue
+			}
+			a.printf("if ts := f[%q]; len(ts) > 0 {\nt := ts[0]\n", f.key)
+			if f.token {
+				a.printf("n.%s = &Token{tree: t, Text: t.Text()}\n}\n", f.goName)
+				continue
+			}
+			a.printf("if n.%s, err = %s; err != nil {\nreturn nil, err\n}\n}\n", f.goName, conv)
+		}
+		a.printf("return n, nil\n}\n\n")
+	}
+
+	a.printf("// convert converts a tree built by the rule called rule.\n")
+	a.printf("func convert(rule string, t *peg.ParseTree) (Node, error) {\nswitch rule {\n")
+	for _, ar := range a.order {
+		a.printf("case %q:\nreturn convert%s(t)\n", ar.rule.Name, a.resolve(ar.rule.Name).goName)
+	}
+	a.printf("}\nreturn nil, errors.New(fmt.Sprintf(\"no node type for rule %%s\", rule))\n}\n\n")
+
+	a.printf("// firstMatch converts t as built by the first of rules that could\n// have built it.\n")
+	a.printf("func firstMatch(t *peg.ParseTree, rules ...string) (Node, error) {\n")
+	a.printf("for _, rule := range rules {\nif _, err := fields.Match(rule, t); err == nil {\nreturn convert(rule, t)\n}\n}\n")
+	a.printf("if t == nil {\nreturn nil, errors.New(fmt.Sprintf(\"no tree for any of %%v\", rules))\n}\n")
+	a.printf("return nil, errors.New(fmt.Sprintf(\"at offset %%d: tree of type %%q does not match any of %%v\", t.Start, t.Type, rules))\n}\n\n")
+
+	if a.multi {
+		a.printf("// inTreeOrder sorts nodes, converted from trees within t, into the\n// order their trees appear in t.\n")
+		a.printf("func inTreeOrder(t *peg.ParseTree, nodes []Node) []Node {\n")
+		a.printf("order := make(map[*peg.ParseTree]int, len(nodes))\nfor _, n := range nodes {\norder[n.Tree()] = -1\n}\n")
+		a.printf("next := 0\nvar walk func(t *peg.ParseTree)\nwalk = func(t *peg.ParseTree) {\n")
+		a.printf("if _, ok := order[t]; ok {\norder[t] = next\nnext++\nreturn\n}\nif t != nil {\nfor _, c := range t.Children {\nwalk(c)\n}\n}\n}\nwalk(t)\n")
+		a.printf("sort.SliceStable(nodes, func(i, j int) bool {\nreturn order[nodes[i].Tree()] < order[nodes[j].Tree()]\n})\nreturn nodes\n}\n\n")
+	}
+
+	a.printf("var fields = mustFieldMatcher(&peg.Grammar{Rules: []*peg.Rule{\n")
+	for _, r := range a.m.c.rules {
+		a.printf("{Name: %q, ", r.Name)
+		if r.Type != "" {
+			a.printf("Type: %q, ", r.Type)
+		}
+		a.printf("Expr: %s},\n", exprLiteral(r.Expr))
+	}
+	a.printf("}})\n\n")
+	a.printf("func mustFieldMatcher(g *peg.Grammar) *peg.FieldMatcher {\nm, err := peg.NewFieldMatcher(g)\nif err != nil {\npanic(err)\n}\nreturn m\n}\n")
+}
+
+var repeatKinds = map[RepeatKind]string{
+	ZeroOrMore: "peg.ZeroOrMore",
+	OneOrMore:  "peg.OneOrMore",
+	Optional:   "peg.Optional",
+}
+
+// exprLiteral returns Go source building e.
+func exprLiteral(e Expr) string {
+	list := func(exprs []Expr) string {
+		parts := make([]string, len(exprs))
+		for i, e := range exprs {
+			parts[i] = exprLiteral(e)
+		}
+		return "[]peg.Expr{" + strings.Join(parts, ", ") + "}"
+	}
+	switch e := e.(type) {
+	case *Sequence:
+		return "&peg.Sequence{Exprs: " + list(e.Exprs) + "}"
+	case *Choice:
+		return "&peg.Choice{Alternatives: " + list(e.Alternatives) + "}"
+	case *Repetition:
+		return "&peg.Repetition{Expr: " + exprLiteral(e.Expr) + ", Kind: " + repeatKinds[e.Kind] + "}"
+	case *Predicate:
+		if e.Not {
+			return "&peg.Predicate{Expr: " + exprLiteral(e.Expr) + ", Not: true}"
+		}
+		return "&peg.Predicate{Expr: " + exprLiteral(e.Expr) + "}"
+	case *Discard:
+		return "&peg.Discard{Expr: " + exprLiteral(e.Expr) + "}"
+	case *Label:
+		return fmt.Sprintf("&peg.Label{Name: %q, Expr: %s}", e.Name, exprLiteral(e.Expr))
+	case *Literal:
+		if e.IgnoreCase {
+			return fmt.Sprintf("&peg.Literal{Text: %q, IgnoreCase: true}", e.Text)
+		}
+		return fmt.Sprintf("&peg.Literal{Text: %q}", e.Text)
+	case *Regexp:
+		return fmt.Sprintf("&peg.Regexp{Pattern: %q}", e.Pattern)
+	case *Ref:
+		return fmt.Sprintf("&peg.Ref{Name: %q}", e.Name)
+	}
+	return "nil"
+}
+
+// goName turns a grammar name into an exported Go name by
+// capitalizing each run of letters and digits in it.
+func goName(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			if b.Len() == 0 && unicode.IsDigit(r) {
+				b.WriteByte('X')
+			}
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	s := b.String()
+	if s != "" && !unicode.IsUpper([]rune(s)[0]) {
+		return "X" + s
+	}
+	return s
+}
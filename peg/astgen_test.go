@@ -0,0 +1,142 @@
+package peg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGenerateASTExample checks that the code of internal/calcast is
+// what GenerateAST writes for its grammar. Its own tests check that
+// the code works.
+func TestGenerateASTExample(t *testing.T) {
+	dir := filepath.Join("internal", "calcast")
+	src, err := ioutil.ReadFile(filepath.Join(dir, "calc.peg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := ParseGrammar(strings.NewReader(string(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GenerateAST(g, "calcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := ioutil.ReadFile(filepath.Join(dir, "ast.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(exp) {
+		t.Errorf("%s is out of date; run go generate in %s", filepath.Join(dir, "ast.go"), dir)
+	}
+}
+
+func TestGenerateAST(t *testing.T) {
+	table := []struct {
+		grammar string
+		exp     []string // lines expected in the code
+	}{
+		{"list <- item (',' item)*\nitem <- ~'[a-z]+'", []string{
+			"Item []*Item",
+			"type Item struct {",
+			"func Convert(tree *peg.ParseTree) (*List, error) {",
+		}},
+		{"pair <- key:name '=' value:(name / number)?\nname <- ~'[a-z]+'\nnumber <- ~'[0-9]+'", []string{
+			"Key   *Name",
+			"Value Node",
+			`if n.Value, err = firstMatch(t, "name", "number"); err != nil {`,
+		}},
+		{"%start sum\nsum <- number (op:'+' number)*\nnumber <- digits\ndigits <- ~'[0-9]+'", []string{
+			"Number []*Number",
+			"Op     []*Token",
+			"type Number = Digits",
+			"n.Number = append(n.Number, c)",
+			"func (n *Token) Accept(v Visitor) {",
+			"return inTreeOrder(n.tree, c)",
+		}},
+		{"value <- scalar / list\nscalar <- word / num\nlist <- '[' value* ']'\nword <- ~'[a-z]+'\nnum <- ~'[0-9]+'", []string{
+			"func Convert(tree *peg.ParseTree) (Value, error) {",
+			"Value []Value",
+			"func (*Word) isScalar() {}",
+			"func (*Word) isValue() {}",
+			"func (*List) isValue() {}",
+		}},
+		{"%skip _\nstmt <- 'x' end\nend <- !~'.'\n_ <- ~' +'", []string{
+			"type Stmt struct {",
+			"VisitStmt(n *Stmt)",
+		}},
+	}
+	for _, tc := range table {
+		g, err := ParseGrammar(strings.NewReader(tc.grammar))
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := GenerateAST(g, "ast")
+		if err != nil {
+			t.Errorf("%q: %v", tc.grammar, err)
+			continue
+		}
+		lines := make(map[string]bool)
+		for _, line := range strings.Split(string(src), "\n") {
+			lines[strings.TrimSpace(line)] = true
+		}
+		for _, exp := range tc.exp {
+			if !lines[exp] {
+				t.Errorf("%q: no line %q in:\n%s", tc.grammar, exp, src)
+			}
+		}
+		for _, name := range []string{"End", "_"} {
+			if lines["type "+name+" struct {"] {
+				t.Errorf("%q: unexpected type %s", tc.grammar, name)
+			}
+		}
+	}
+}
+
+func TestGenerateASTErrors(t *testing.T) {
+	table := []struct {
+		grammar string
+		exp     string
+	}{
+		{"a_b <- 'x'\naB <- 'y'", "rules a_b and aB are both AB in Go"},
+		{"node <- 'x'", "rule node: Node is a name of the generated code"},
+		{"a <- b _\nb <- 'x'\n_ <- ' '", "rule _ has no Go name"},
+		{"a <- tree:b\nb <- 'x'", "rule a: field tree clashes with the method Tree; label it"},
+		{"a <- x:b x:'y'\nb <- 'x'", "rule a: label x names both terminals and rules"},
+		{"a <- x_y:b xY:b\nb <- 'x'", "rule a: fields x_y and xY are both XY in Go"},
+		{"a <- !'x'", "start rule a builds no trees"},
+	}
+	for _, tc := range table {
+		g, err := ParseGrammar(strings.NewReader(tc.grammar))
+		if err != nil {
+			t.Fatalf("%q: %v", tc.grammar, err)
+		}
+		if _, err := GenerateAST(g, "ast"); err == nil || err.Error() != tc.exp {
+			t.Errorf("%q: got error %v, expected %s", tc.grammar, err, tc.exp)
+		}
+	}
+
+	g := &Grammar{Rules: []*Rule{{Name: "a", Expr: &Ref{Name: "b"}}}}
+	if _, err := GenerateAST(g, "ast"); err == nil || err.Error() != "rule a: undefined rule b" {
+		t.Errorf("got error %v for an undefined rule", err)
+	}
+}
+
+func TestGoName(t *testing.T) {
+	table := map[string]string{
+		"expr":           "Expr",
+		"if_stmt":        "IfStmt",
+		"c.number":       "CNumber",
+		"sep_by(x, ',')": "SepByX",
+		"_":              "",
+		"_2":             "X2",
+		"über":           "Über",
+	}
+	for name, exp := range table {
+		if got := goName(name); got != exp {
+			t.Errorf("goName(%q) = %q, expected %q", name, got, exp)
+		}
+	}
+}
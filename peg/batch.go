@@ -0,0 +1,119 @@
+package peg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// BatchResult is the outcome of parsing one input of a batch.
+type BatchResult struct {
+	Tree *ParseTree
+	Err  error
+}
+
+// BatchStats summarize a batch of parses.
+type BatchStats struct {
+	Inputs   int           // inputs in the batch
+	Failures int           // inputs that could not be read or parsed
+	Bytes    int64         // bytes read from all inputs
+	Elapsed  time.Duration // wall clock time taken by the batch
+	Parsing  time.Duration // time spent reading and parsing, summed over inputs
+}
+
+// ParseBatch parses each of inputs as Parse would, on at most workers
+// goroutines at once; if workers is not positive, GOMAXPROCS is used.
+// The results are in the order of inputs, each with its own error.
+// Once ctx is done, parses in progress give up and inputs not yet
+// started fail with the context's error without being read.
+func (l *Language) ParseBatch(ctx context.Context, inputs []io.Reader, workers int) ([]BatchResult, BatchStats) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(inputs) {
+		workers = len(inputs)
+	}
+	results := make([]BatchResult, len(inputs))
+	stats := BatchStats{Inputs: len(inputs)}
+	start := time.Now()
+
+	var mu sync.Mutex // guards stats
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				began := time.Now()
+				n, res := l.parseBatched(ctx, inputs[i])
+				took := time.Since(began)
+				results[i] = res
+
+				mu.Lock()
+				stats.Bytes += n
+				stats.Parsing += took
+				if res.Err != nil {
+					stats.Failures++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	done := ctx.Done()
+	next := 0
+feed:
+	for ; next < len(inputs); next++ {
+		select {
+		case work <- next:
+		case <-done:
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	for i := next; i < len(inputs); i++ {
+		results[i].Err = ctx.Err()
+		stats.Failures++
+	}
+	stats.Elapsed = time.Since(start)
+	return results, stats
+}
+
+// maxPooledBuffer bounds the read buffers kept for reuse, so that one
+// huge input does not pin its memory for the rest of the program.
+const maxPooledBuffer = 1 << 20
+
+var readBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// parseBatched reads in and parses it, returning the number of bytes
+// read. Inputs are read through a pooled buffer, so that reading costs
+// one allocation of the exact size of the input; trees point into the
+// text of their Source, so the text is then copied out of the buffer
+// rather than parsed in place.
+func (l *Language) parseBatched(ctx context.Context, in io.Reader) (int64, BatchResult) {
+	n, text, err := readPooled(in)
+	if err != nil {
+		return n, BatchResult{Err: err}
+	}
+	tree, err := l.parseTree(ctx, l.root, &Source{buf: text})
+	return n, BatchResult{Tree: tree, Err: err}
+}
+
+// readPooled reads all of in into a copy of a pooled buffer.
+func readPooled(in io.Reader) (int64, []byte, error) {
+	buf := readBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	n, err := buf.ReadFrom(in)
+	text := append([]byte(nil), buf.Bytes()...)
+	if buf.Cap() <= maxPooledBuffer {
+		readBuffers.Put(buf)
+	}
+	return n, text, err
+}
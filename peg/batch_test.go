@@ -0,0 +1,166 @@
+package peg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseBatch(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(traceGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readErr := errors.New("read failed")
+	sources := []string{"a=1", "b=c", "=", "", "abc=42"}
+	var inputs []io.Reader
+	for _, src := range sources {
+		inputs = append(inputs, strings.NewReader(src))
+	}
+	inputs = append(inputs, io.MultiReader(strings.NewReader("a="), &failingReader{readErr}))
+
+	results, stats := lang.ParseBatch(context.Background(), inputs, 2)
+	if len(results) != len(inputs) {
+		t.Fatalf("got %d results for %d inputs", len(results), len(inputs))
+	}
+	for i, src := range sources {
+		exp, expErr := lang.ParseString(src)
+		if (results[i].Err != nil) != (expErr != nil) {
+			t.Errorf("%q: got error %v, expected %v", src, results[i].Err, expErr)
+			continue
+		}
+		if err := treeCompare(results[i].Tree, exp); err != nil {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+	if last := results[len(results)-1]; last.Err != readErr || last.Tree != nil {
+		t.Errorf("expected the read error, got %v", last)
+	}
+
+	exp := BatchStats{Inputs: 6, Failures: 3, Bytes: 15}
+	if stats.Inputs != exp.Inputs || stats.Failures != exp.Failures || stats.Bytes != exp.Bytes {
+		t.Errorf("got stats %+v, expected %+v", stats, exp)
+	}
+	if stats.Elapsed <= 0 || stats.Parsing <= 0 {
+		t.Errorf("times not recorded: %+v", stats)
+	}
+}
+
+func TestParseBatchWorkers(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(traceGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c concurrency
+	inputs := make([]io.Reader, 20)
+	for i := range inputs {
+		inputs[i] = &slowReader{r: strings.NewReader("a=1"), c: &c}
+	}
+	results, _ := lang.ParseBatch(context.Background(), inputs, 3)
+	for _, res := range results {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	if c.max > 3 {
+		t.Errorf("%d inputs read at once by 3 workers", c.max)
+	}
+}
+
+func TestParseBatchCancel(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(traceGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	inputs := []io.Reader{strings.NewReader("a=1"), strings.NewReader("b=2")}
+	results, stats := lang.ParseBatch(ctx, inputs, 1)
+	for _, res := range results {
+		if res.Err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, res.Err)
+		}
+	}
+	if stats.Failures != 2 {
+		t.Errorf("got %d failures, expected 2", stats.Failures)
+	}
+}
+
+func TestParseBatchErrorsKeepText(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(traceGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := lang.ParseBatch(context.Background(), []io.Reader{strings.NewReader("a=XXXXXXXXXX")}, 1)
+	if results[0].Err == nil {
+		t.Fatal("expected an error")
+	}
+	exp := results[0].Err.Error()
+	for i := 0; i < 10; i++ {
+		lang.ParseBatch(context.Background(), []io.Reader{strings.NewReader("b=ZZZZZZZZZZ")}, 1)
+	}
+	if got := results[0].Err.Error(); got != exp {
+		t.Errorf("error changed from %q to %q", exp, got)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+// concurrency tracks the most slowReaders being read at once.
+type concurrency struct {
+	mu          sync.Mutex
+	active, max int
+}
+
+type slowReader struct {
+	r io.Reader
+	c *concurrency
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.c.mu.Lock()
+	r.c.active++
+	if r.c.active > r.c.max {
+		r.c.max = r.c.active
+	}
+	r.c.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	r.c.mu.Lock()
+	r.c.active--
+	r.c.mu.Unlock()
+	return r.r.Read(p)
+}
+
+// BenchmarkBatchRead compares reading inputs through the pooled
+// buffer of ParseBatch with reading each with ioutil.ReadAll.
+func BenchmarkBatchRead(b *testing.B) {
+	src := genINI(rand.New(rand.NewSource(1)), 16<<10)
+	b.Run("pooled", func(b *testing.B) {
+		b.SetBytes(int64(len(src)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := readPooled(strings.NewReader(src)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("readall", func(b *testing.B) {
+		b.SetBytes(int64(len(src)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ioutil.ReadAll(strings.NewReader(src)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package peg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corpus lists the grammars of testdata/corpus, each with a generator
+// of valid input of about n bytes.
+var corpus = []struct {
+	name string
+	gen  func(r *rand.Rand, n int) string
+}{
+	{"json", genJSON},
+	{"arith", genArith},
+	{"ini", genINI},
+	{"csv", genCSV},
+	{"clike", genCLike},
+}
+
+func loadCorpus(tb testing.TB, name string, opts ...ParserOption) *Language {
+	src, err := ioutil.ReadFile(filepath.Join("testdata", "corpus", name+".peg"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	lang, err := NewParser(strings.NewReader(string(src)), opts...)
+	if err != nil {
+		tb.Fatalf("%s: %v", name, err)
+	}
+	return lang
+}
+
+// TestCorpus checks that the generated inputs parse in full, so that
+// the benchmarks measure successful parses.
+func TestCorpus(t *testing.T) {
+	for _, c := range corpus {
+		lang := loadCorpus(t, c.name, Lossless())
+		input := c.gen(rand.New(rand.NewSource(1)), 4096)
+		tree, err := lang.ParseString(input)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		for _, trailing := range tree.Trailing {
+			if trailing.Type == "" {
+				t.Errorf("%s: input left unparsed: %.40q", c.name, trailing.Data)
+			}
+		}
+	}
+}
+
+func BenchmarkCorpus(b *testing.B) {
+	for _, c := range corpus {
+		lang := loadCorpus(b, c.name)
+		for _, size := range []int{1 << 10, 16 << 10, 256 << 10} {
+			input := c.gen(rand.New(rand.NewSource(1)), size)
+			b.Run(fmt.Sprintf("%s/%dKB", c.name, size>>10), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := lang.ParseString(input); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// backtrackGrammar tries the same operand up to three times at each
+// level of nesting, so that without memoization the work grows as 3^n
+// in the depth n of the input.
+const backtrackGrammar = `sum <- (atom '+' sum) / (atom '-' sum) / atom
+atom <- ('(' sum ')') / ~'[0-9]+'`
+
+func BenchmarkBacktracking(b *testing.B) {
+	lang, err := NewParser(strings.NewReader(backtrackGrammar))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, depth := range []int{2, 4, 6, 8} {
+		input := strings.Repeat("(", depth) + "1" + strings.Repeat(")", depth)
+		b.Run(fmt.Sprintf("depth%d", depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := lang.ParseString(input); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func genJSON(r *rand.Rand, n int) string {
+	var b strings.Builder
+	b.WriteString("[\n")
+	for i := 0; b.Len() < n; i++ {
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		genJSONValue(r, &b, 3)
+	}
+	b.WriteString("\n]\n")
+	return b.String()
+}
+
+func genJSONValue(r *rand.Rand, b *strings.Builder, depth int) {
+	k := r.Intn(7)
+	if depth == 0 {
+		k %= 5
+	}
+	switch k {
+	case 0:
+		fmt.Fprintf(b, "%d", r.Intn(100000)-500)
+	case 1:
+		fmt.Fprintf(b, "%.3fe%d", r.Float64()*100, r.Intn(10))
+	case 2:
+		fmt.Fprintf(b, "%q", genWord(r)+" \\\"quoted\\\"")
+	case 3:
+		b.WriteString([]string{"true", "false", "null"}[r.Intn(3)])
+	case 4:
+		fmt.Fprintf(b, "%q", genWord(r))
+	case 5:
+		b.WriteString("[")
+		for i := r.Intn(5); i > 0; i-- {
+			genJSONValue(r, b, depth-1)
+			if i > 1 {
+				b.WriteString(", ")
+			}
+		}
+		b.WriteString("]")
+	case 6:
+		b.WriteString("{")
+		for i := r.Intn(5); i > 0; i-- {
+			fmt.Fprintf(b, "%q: ", genWord(r))
+			genJSONValue(r, b, depth-1)
+			if i > 1 {
+				b.WriteString(", ")
+			}
+		}
+		b.WriteString("}")
+	}
+}
+
+func genArith(r *rand.Rand, n int) string {
+	var b strings.Builder
+	genArithExpr(r, &b, 4)
+	for b.Len() < n {
+		b.WriteString(" +\n")
+		genArithExpr(r, &b, 4)
+	}
+	return b.String()
+}
+
+func genArithExpr(r *rand.Rand, b *strings.Builder, depth int) {
+	for i := r.Intn(4); i >= 0; i-- {
+		switch k := r.Intn(5); {
+		case depth > 0 && k == 0:
+			b.WriteString("(")
+			genArithExpr(r, b, depth-1)
+			b.WriteString(")")
+		case k == 1:
+			b.WriteString("-" + genWord(r))
+		case k == 2:
+			b.WriteString(genWord(r))
+		default:
+			fmt.Fprintf(b, "%d.%d", r.Intn(1000), r.Intn(100))
+		}
+		if i > 0 {
+			b.WriteString([]string{" + ", " - ", " * ", " / ", "%"}[r.Intn(5)])
+		}
+	}
+}
+
+func genINI(r *rand.Rand, n int) string {
+	var b strings.Builder
+	for b.Len() < n {
+		fmt.Fprintf(&b, "; section %d\n[%s.%s]\n", b.Len(), genWord(r), genWord(r))
+		for i := r.Intn(8); i >= 0; i-- {
+			fmt.Fprintf(&b, "%s = %s %d\n", genWord(r), genWord(r), r.Intn(1000))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func genCSV(r *rand.Rand, n int) string {
+	var b strings.Builder
+	b.WriteString("id,name,comment,score\r\n")
+	for i := 0; b.Len() < n; i++ {
+		fmt.Fprintf(&b, "%d,%s,\"%s, \"\"%s\"\"\",%d.%d\r\n", i, genWord(r), genWord(r), genWord(r), r.Intn(100), r.Intn(10))
+	}
+	return b.String()
+}
+
+func genCLike(r *rand.Rand, n int) string {
+	var b strings.Builder
+	for i := 0; b.Len() < n; i++ {
+		fmt.Fprintf(&b, "int %s%d(int a, char b) {\n", genWord(r), i)
+		fmt.Fprintf(&b, "\tint x = a * (b + %d) - %d;\n", r.Intn(100), r.Intn(100))
+		b.WriteString("\t// loop until done\n")
+		fmt.Fprintf(&b, "\twhile (x > 0 && !done(x, \"%s\")) {\n", genWord(r))
+		b.WriteString("\t\tif (x % 2 == 0) x = x / 2; else x = 3 * x + 1;\n")
+		b.WriteString("\t}\n")
+		b.WriteString("\treturn x;\n}\n\n")
+	}
+	return b.String()
+}
+
+func genWord(r *rand.Rand) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	w := make([]byte, 1+r.Intn(8))
+	for i := range w {
+		w[i] = letters[r.Intn(len(letters))]
+	}
+	return string(w)
+}
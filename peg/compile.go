@@ -0,0 +1,241 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Compile turns g into a Language. When g defines a rule more than
+// once the last definition takes effect. Rule references, the start
+// and skip rules and regular expressions are checked here. The
+// Language keeps its own copy of g, which may be modified afterwards.
+func Compile(g *Grammar, opts ...ParserOption) (*Language, error) {
+	cfg := newConfig(opts)
+	if len(g.Rules) == 0 {
+		return nil, errors.New("grammar has no rules")
+	}
+
+	rules, index, err := g.effectiveRules()
+	if err != nil {
+		return nil, err
+	}
+	norm := (&Grammar{Rules: rules, Start: g.Start, Skip: g.Skip}).clone()
+
+	c := &compiler{rules: norm.Rules, index: index, names: make([]string, len(norm.Rules))}
+	table := &ruleTable{lexemes: make([]*Lexeme, len(norm.Rules)), index: index}
+	for i, r := range norm.Rules {
+		lex, err := c.expr(r.Expr, c.typ(i))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("rule %s: %s", r.Name, err))
+		}
+		if r.Lexical {
+			lex = NewLexicalLexer(lex)
+		}
+		table.lexemes[i] = newRuleBoundary(r.Name, lex)
+	}
+
+	lang := &Language{
+		root:       table.lexemes[0],
+		rules:      table,
+		keepTrivia: cfg.keepTrivia,
+		lossless:   cfg.lossless,
+		grammar:    norm,
+	}
+	if norm.Start != "" {
+		i, ok := index[norm.Start]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("start rule %s is not defined", norm.Start))
+		}
+		lang.root = table.lexemes[i]
+		if i == 0 {
+			norm.Start = ""
+		}
+	}
+	if norm.Skip != "" {
+		i, ok := index[norm.Skip]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("skip rule %s is not defined", norm.Skip))
+		}
+		lang.skip = table.lexemes[i]
+	}
+	return lang, nil
+}
+
+// effectiveRules returns the rules of g that take effect, in the
+// order their names are first defined, and the index of each name.
+func (g *Grammar) effectiveRules() ([]*Rule, map[string]int, error) {
+	var rules []*Rule
+	index := make(map[string]int)
+	for _, r := range g.Rules {
+		if r.Name == "" {
+			return nil, nil, errors.New("grammar has a rule with no name")
+		}
+		if r.Expr == nil {
+			return nil, nil, errors.New(fmt.Sprintf("rule %s has no expression", r.Name))
+		}
+		if i, ok := index[r.Name]; ok {
+			rules[i] = r
+			continue
+		}
+		index[r.Name] = len(rules)
+		rules = append(rules, r)
+	}
+	return rules, index, nil
+}
+
+// compiler builds the lexemes of a grammar's rules. A reference to a
+// rule is compiled to the rule's index in the table being built, so
+// no lexeme needs to be modified once constructed.
+type compiler struct {
+	rules  []*Rule
+	index  map[string]int
+	names  []string // the tree name of each rule, once known
+	naming []bool   // rules whose names are being worked out
+}
+
+// typ returns the type of the trees built by the terminals,
+// sequences and choices of rule i.
+func (c *compiler) typ(i int) string {
+	if t := c.rules[i].Type; t != "" {
+		return t
+	}
+	return c.rules[i].Name
+}
+
+// name returns the Name of the lexeme compiled for rule i, which is
+// the Name given to references to it. It follows the constructors:
+// a rule that only repeats, discards or refers to another takes its
+// name from that.
+func (c *compiler) name(i int) string {
+	if c.names[i] != "" {
+		return c.names[i]
+	}
+	if c.naming == nil {
+		c.naming = make([]bool, len(c.rules))
+	}
+	if c.naming[i] {
+		// A rule that is only an alias of itself, which can never
+		// match anyway.
+		return c.typ(i)
+	}
+	c.naming[i] = true
+	c.names[i] = c.exprName(c.rules[i].Expr, c.typ(i))
+	c.naming[i] = false
+	return c.names[i]
+}
+
+func (c *compiler) exprName(e Expr, typ string) string {
+	switch e := e.(type) {
+	case *Choice:
+		if len(e.Alternatives) == 1 {
+			return c.exprName(e.Alternatives[0], typ)
+		}
+	case *Repetition:
+		return c.exprName(e.Expr, typ) + repeatOps[e.Kind]
+	case *Predicate:
+		if e.Not {
+			return "!" + c.exprName(e.Expr, typ)
+		}
+		return "&" + c.exprName(e.Expr, typ)
+	case *Discard:
+		return c.exprName(e.Expr, typ) + "^"
+	case *Label:
+		return c.exprName(e.Expr, typ)
+	case *Ref:
+		if i, ok := c.index[e.Name]; ok {
+			return c.name(i)
+		}
+	}
+	return typ
+}
+
+// expr builds the lexeme matching e. Terminals, sequences and
+// choices produce trees of the given type.
+func (c *compiler) expr(e Expr, typ string) (*Lexeme, error) {
+	switch e := e.(type) {
+	case *Sequence:
+		if len(e.Exprs) == 0 {
+			return nil, errors.New("empty sequence")
+		}
+		deps, err := c.exprs(e.Exprs, typ)
+		if err != nil {
+			return nil, err
+		}
+		return NewConcatLexer(typ, deps), nil
+	case *Choice:
+		if len(e.Alternatives) == 0 {
+			return nil, errors.New("empty choice")
+		}
+		alts, err := c.exprs(e.Alternatives, typ)
+		if err != nil {
+			return nil, err
+		}
+		lex := alts[0]
+		for _, alt := range alts[1:] {
+			lex = NewAlternateLexer(typ, lex, alt)
+		}
+		return lex, nil
+	case *Repetition:
+		lex, err := c.expr(e.Expr, typ)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Kind {
+		case ZeroOrMore:
+			return NewStarClosure(lex), nil
+		case OneOrMore:
+			return NewPlusClosure(lex), nil
+		case Optional:
+			return NewOptionClosure(lex), nil
+		}
+		return nil, errors.New(fmt.Sprintf("unknown repetition kind %d", e.Kind))
+	case *Predicate:
+		lex, err := c.expr(e.Expr, typ)
+		if err != nil {
+			return nil, err
+		}
+		if e.Not {
+			return NewNotPredicate(lex), nil
+		}
+		return NewAndPredicate(lex), nil
+	case *Discard:
+		lex, err := c.expr(e.Expr, typ)
+		if err != nil {
+			return nil, err
+		}
+		return NewDiscardLexer(lex), nil
+	case *Label:
+		return c.expr(e.Expr, typ)
+	case *Literal:
+		if e.IgnoreCase {
+			return NewFoldLiteralLexer(typ, e.Text), nil
+		}
+		return NewLiteralLexer(typ, e.Text), nil
+	case *Regexp:
+		re, err := regexp.Compile(e.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return NewRegexpLexer(typ, re), nil
+	case *Ref:
+		i, ok := c.index[e.Name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("undefined rule %s", e.Name))
+		}
+		return newRefLexeme(e.Name, i, c.name(i)), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported expression %T", e))
+}
+
+func (c *compiler) exprs(exprs []Expr, typ string) ([]*Lexeme, error) {
+	lexemes := make([]*Lexeme, len(exprs))
+	for i, e := range exprs {
+		lex, err := c.expr(e, typ)
+		if err != nil {
+			return nil, err
+		}
+		lexemes[i] = lex
+	}
+	return lexemes, nil
+}
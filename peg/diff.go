@@ -0,0 +1,161 @@
+package peg
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A CompareOption relaxes how Equal and Diff compare trees.
+type CompareOption func(*compareConfig)
+
+type compareConfig struct {
+	ignorePositions bool
+	ignoreTrivia    bool
+	ignoreInnerData bool
+}
+
+// IgnorePositions compares trees regardless of their Start and End,
+// as when one of them was written by hand or read from an S-expression.
+func IgnorePositions() CompareOption {
+	return func(c *compareConfig) {
+		c.ignorePositions = true
+	}
+}
+
+// IgnoreTrivia compares trees regardless of their Trivia and Trailing.
+func IgnoreTrivia() CompareOption {
+	return func(c *compareConfig) {
+		c.ignoreTrivia = true
+	}
+}
+
+// IgnoreInnerData compares the Data of leaves only, not of trees with
+// children.
+func IgnoreInnerData() CompareOption {
+	return func(c *compareConfig) {
+		c.ignoreInnerData = true
+	}
+}
+
+// Equal reports whether p and q are the same tree: of the same types,
+// with the same Data, positions, children and trivia. Data that is nil
+// differs from empty Data, as a tree with no text differs from a leaf
+// that matched nothing. Either tree may be nil.
+func (p *ParseTree) Equal(q *ParseTree, opts ...CompareOption) bool {
+	d := newDiffer(opts, 1)
+	d.tree("", p, q)
+	return len(d.diffs) == 0
+}
+
+// Diff compares got with want as Equal does, and describes how they
+// differ, one difference per line. Each starts with the path to the
+// tree where it occurs: the types of the trees leading to it, each
+// with its index among the children of its parent, or :trivia or
+// :trailing and the index for trivia, as in
+//
+//	sum/sum*[1]/sum[0]/number[1]: got data "2", expected "3"
+//
+// Trees of different types are not compared further. Diff returns
+// nil if the trees are equal.
+func Diff(got, want *ParseTree, opts ...CompareOption) []string {
+	d := newDiffer(opts, -1)
+	var name string
+	switch {
+	case want != nil:
+		name = want.Type
+	case got != nil:
+		name = got.Type
+	}
+	d.tree(name, got, want)
+	return d.diffs
+}
+
+type differ struct {
+	compareConfig
+	diffs []string
+	limit int // the number of differences to stop at, or < 0
+}
+
+func newDiffer(opts []CompareOption, limit int) *differ {
+	d := &differ{limit: limit}
+	for _, opt := range opts {
+		opt(&d.compareConfig)
+	}
+	return d
+}
+
+func (d *differ) add(path, format string, args ...interface{}) {
+	d.diffs = append(d.diffs, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (d *differ) done() bool {
+	return d.limit >= 0 && len(d.diffs) >= d.limit
+}
+
+func (d *differ) tree(path string, got, want *ParseTree) {
+	switch {
+	case got == nil && want == nil:
+		return
+	case got == nil:
+		d.add(path, "missing %s", want.short())
+		return
+	case want == nil:
+		d.add(path, "unexpected %s", got.short())
+		return
+	case got.Type != want.Type:
+		d.add(path, "got %s, expected %s", got.short(), want.short())
+		return
+	}
+	inner := len(got.Children) > 0 || len(want.Children) > 0
+	if !(d.ignoreInnerData && inner) && (!bytes.Equal(got.Data, want.Data) || (got.Data == nil) != (want.Data == nil)) {
+		d.add(path, "got data %s, expected %s", got.quoteData(), want.quoteData())
+	}
+	if !d.ignorePositions && (got.Start != want.Start || got.End != want.End) {
+		d.add(path, "got position %d:%d, expected %d:%d", got.Start, got.End, want.Start, want.End)
+	}
+	if !d.ignoreTrivia {
+		d.list(path, ":trivia", got.Trivia, want.Trivia)
+	}
+	d.list(path, "", got.Children, want.Children)
+	if !d.ignoreTrivia {
+		d.list(path, ":trailing", got.Trailing, want.Trailing)
+	}
+}
+
+func (d *differ) list(path, list string, got, want []*ParseTree) {
+	for i := 0; (i < len(got) || i < len(want)) && !d.done(); i++ {
+		var g, w *ParseTree
+		if i < len(got) {
+			g = got[i]
+		}
+		if i < len(want) {
+			w = want[i]
+		}
+		name := list
+		switch {
+		case name != "":
+		case w != nil:
+			name = w.Type
+		case g != nil:
+			name = g.Type
+		}
+		d.tree(fmt.Sprintf("%s/%s[%d]", path, name, i), g, w)
+	}
+}
+
+// short describes the tree in one line, as an S-expression if it fits.
+func (p *ParseTree) short() string {
+	if s := strings.TrimSuffix(p.SExpr(), "\n"); !strings.Contains(s, "\n") {
+		return s
+	}
+	return "(" + sexprSymbol(p.Type) + " ...)"
+}
+
+func (p *ParseTree) quoteData() string {
+	if p.Data == nil {
+		return "none"
+	}
+	return strconv.Quote(string(p.Data))
+}
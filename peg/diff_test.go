@@ -0,0 +1,94 @@
+package peg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	lang, err := NewParser(strings.NewReader("%skip _\nsum <- num ('+' num)*\nnum <- ~'[0-9]+'\n_ <- ~' +'"), KeepTrivia())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(src string) *ParseTree {
+		tree, err := lang.ParseString(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tree
+	}
+	a := parse("1 + 2")
+	if !a.Equal(parse("1 + 2")) {
+		t.Error("tree differs from itself")
+	}
+	if diffs := Diff(a, a); diffs != nil {
+		t.Errorf("unexpected differences %q", diffs)
+	}
+
+	table := []struct {
+		src  string
+		opts []CompareOption
+		exp  []string
+	}{
+		{"1 + 3", nil, []string{`sum/sum*[1]/sum[0]/num[1]: got data "2", expected "3"`}},
+		{"1  + 2", nil, []string{
+			`sum: got position 0:5, expected 0:6`,
+			`sum/sum*[1]: got position 2:5, expected 3:6`,
+			`sum/sum*[1]/sum[0]: got position 2:5, expected 3:6`,
+			`sum/sum*[1]/sum[0]/sum[0]: got position 2:3, expected 3:4`,
+			`sum/sum*[1]/sum[0]/sum[0]/:trivia[0]: got data " ", expected "  "`,
+			`sum/sum*[1]/sum[0]/sum[0]/:trivia[0]: got position 1:2, expected 1:3`,
+			`sum/sum*[1]/sum[0]/num[1]: got position 4:5, expected 5:6`,
+			`sum/sum*[1]/sum[0]/num[1]/:trivia[0]: got position 3:4, expected 4:5`,
+		}},
+		{"1  + 2", []CompareOption{IgnorePositions()}, []string{
+			`sum/sum*[1]/sum[0]/sum[0]/:trivia[0]: got data " ", expected "  "`,
+		}},
+		{"1+2", []CompareOption{IgnorePositions(), IgnoreTrivia()}, nil},
+		{"1 + 2 + 3", []CompareOption{IgnorePositions(), IgnoreTrivia()}, []string{
+			`sum/sum*[1]/sum[1]: missing (sum ...)`,
+		}},
+		{"1", []CompareOption{IgnorePositions(), IgnoreTrivia()}, []string{
+			`sum/sum*[1]/sum[0]: unexpected (sum ...)`,
+		}},
+	}
+	for _, tc := range table {
+		diffs := Diff(a, parse(tc.src), tc.opts...)
+		if !reflect.DeepEqual(diffs, tc.exp) {
+			t.Errorf("%q: got differences\n%s\nexpected\n%s", tc.src, strings.Join(diffs, "\n"), strings.Join(tc.exp, "\n"))
+		}
+		if eq := a.Equal(parse(tc.src), tc.opts...); eq != (tc.exp == nil) {
+			t.Errorf("%q: Equal returned %v", tc.src, eq)
+		}
+	}
+	num, err := lang.ParseRuleString("num", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs, exp := Diff(num, a), []string{`sum: got (num "1"), expected (sum ...)`}; !reflect.DeepEqual(diffs, exp) {
+		t.Errorf("got differences %q, expected %q", diffs, exp)
+	}
+}
+
+func TestEqualData(t *testing.T) {
+	leaf := &ParseTree{Type: "a", Data: []byte("x")}
+	table := []struct {
+		a, b *ParseTree
+		opts []CompareOption
+		exp  bool
+	}{
+		{nil, nil, nil, true},
+		{leaf, nil, nil, false},
+		{nil, leaf, nil, false},
+		{&ParseTree{Type: "a"}, &ParseTree{Type: "a", Data: []byte{}}, nil, false},
+		{&ParseTree{Type: "a", Data: []byte("x"), Children: []*ParseTree{leaf}}, &ParseTree{Type: "a", Children: []*ParseTree{leaf}}, nil, false},
+		{&ParseTree{Type: "a", Data: []byte("x"), Children: []*ParseTree{leaf}}, &ParseTree{Type: "a", Children: []*ParseTree{leaf}}, []CompareOption{IgnoreInnerData()}, true},
+		{&ParseTree{Type: "a", Data: []byte("x")}, &ParseTree{Type: "a"}, []CompareOption{IgnoreInnerData()}, false},
+	}
+	for i, tc := range table {
+		if eq := tc.a.Equal(tc.b, tc.opts...); eq != tc.exp {
+			t.Errorf("%d: Equal returned %v, expected %v", i, eq, tc.exp)
+		}
+	}
+}
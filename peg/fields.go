@@ -0,0 +1,306 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A FieldMatcher takes apart the trees built by the rules of a
+// grammar, recovering the trees matched by each label and rule
+// reference of a rule. It undoes the shortcuts taken when trees are
+// built, such as a sequence giving way to its only child, by matching
+// the rule's expression against the tree. The code GenerateAST writes
+// converts trees with one.
+type FieldMatcher struct {
+	c       *compiler
+	types   []map[string]bool // the types of the trees each rule may build
+	nilable []bool            // rules that may build no tree at all
+}
+
+// NewFieldMatcher returns a FieldMatcher for the trees of Compile(g).
+func NewFieldMatcher(g *Grammar) (*FieldMatcher, error) {
+	rules, index, err := g.effectiveRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		var undefined string
+		walkExpr(r.Expr, func(e Expr) {
+			if ref, ok := e.(*Ref); ok && undefined == "" {
+				if _, ok := index[ref.Name]; !ok {
+					undefined = ref.Name
+				}
+			}
+		})
+		if undefined != "" {
+			return nil, errors.New(fmt.Sprintf("rule %s: undefined rule %s", r.Name, undefined))
+		}
+	}
+	m := &FieldMatcher{
+		c:       &compiler{rules: rules, index: index, names: make([]string, len(rules))},
+		types:   make([]map[string]bool, len(rules)),
+		nilable: make([]bool, len(rules)),
+	}
+	for i := range m.types {
+		m.types[i] = make(map[string]bool)
+	}
+	// Rules refer to one another, so their types are widened until
+	// they no longer change.
+	for changed := true; changed; {
+		changed = false
+		for i, r := range rules {
+			types, nilable := m.exprTypes(r.Expr, m.c.typ(i))
+			for typ := range types {
+				if !m.types[i][typ] {
+					m.types[i][typ] = true
+					changed = true
+				}
+			}
+			if nilable && !m.nilable[i] {
+				m.nilable[i] = true
+				changed = true
+			}
+		}
+	}
+	return m, nil
+}
+
+// exprTypes returns the types of the trees e may build when compiled
+// for a rule of type typ, and whether it may build none.
+func (m *FieldMatcher) exprTypes(e Expr, typ string) (map[string]bool, bool) {
+	types := make(map[string]bool)
+	switch e := e.(type) {
+	case *Sequence:
+		// A sequence building a single tree returns that tree
+		// instead of one of its own.
+		types[typ] = true
+		var present []map[string]bool
+		var all []map[string]bool
+		for _, part := range e.Exprs {
+			t, nilable := m.exprTypes(part, typ)
+			if !nilable {
+				present = append(present, t)
+			}
+			all = append(all, t)
+		}
+		switch len(present) {
+		case 0:
+			for _, t := range all {
+				union(types, t)
+			}
+		case 1:
+			union(types, present[0])
+		}
+		return types, false
+	case *Choice:
+		nilable := false
+		for _, alt := range e.Alternatives {
+			t, n := m.exprTypes(alt, typ)
+			union(types, t)
+			nilable = nilable || n
+		}
+		return types, nilable
+	case *Repetition:
+		if e.Kind == Optional {
+			t, _ := m.exprTypes(e.Expr, typ)
+			return t, true
+		}
+		types[m.c.exprName(e, typ)] = true
+		return types, false
+	case *Predicate, *Discard:
+		return types, true
+	case *Label:
+		return m.exprTypes(e.Expr, typ)
+	case *Ref:
+		i := m.c.index[e.Name]
+		return union(types, m.types[i]), m.nilable[i]
+	}
+	types[typ] = true
+	return types, false
+}
+
+func union(dst, src map[string]bool) map[string]bool {
+	for k := range src {
+		dst[k] = true
+	}
+	return dst
+}
+
+// refersToRules reports whether e refers to a rule building trees.
+func (m *FieldMatcher) refersToRules(e Expr) bool {
+	found := false
+	walkExpr(e, func(e Expr) {
+		if ref, ok := e.(*Ref); ok && len(m.types[m.c.index[ref.Name]]) > 0 {
+			found = true
+		}
+	})
+	return found
+}
+
+// Match matches tree, built by the rule called rule, against the
+// rule's expression. It returns the trees matched by each label, and
+// by each rule reference outside a label, keyed by the label or the
+// name of the rule referred to, in the order they appear in tree. A
+// label on an expression referring to rules names the trees of those
+// rules; on any other expression it names the leaves built by its
+// literals and regular expressions, which are otherwise left out. A
+// tree that rule could not have built is an error.
+func (m *FieldMatcher) Match(rule string, tree *ParseTree) (map[string][]*ParseTree, error) {
+	i, ok := m.c.index[rule]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("undefined rule %s", rule))
+	}
+	var items []*ParseTree
+	if tree != nil {
+		items = []*ParseTree{tree}
+	}
+	f := &fieldMatch{m: m, typ: m.c.typ(i)}
+	if !f.expr(m.c.rules[i].Expr, items, func(rest []*ParseTree) bool { return len(rest) == 0 }) {
+		if tree == nil {
+			return nil, errors.New(fmt.Sprintf("no tree for rule %s", rule))
+		}
+		return nil, errors.New(fmt.Sprintf("at offset %d: tree of type %q does not match rule %s", tree.Start, tree.Type, rule))
+	}
+	fields := make(map[string][]*ParseTree)
+	for _, c := range f.caps {
+		fields[c.key] = append(fields[c.key], c.tree)
+	}
+	return fields, nil
+}
+
+// fieldMatch matches an expression against a list of trees, the
+// children of a tree or a tree on its own. The trees left over are
+// passed to a continuation, which reports whether the rest of the
+// match succeeds; alternatives are tried until one does.
+type fieldMatch struct {
+	m     *FieldMatcher
+	typ   string // the type of the rule being matched
+	label string // the label in effect, if any
+	terms bool   // whether the label names terminals rather than rules
+	caps  []fieldCapture
+}
+
+type fieldCapture struct {
+	key  string
+	tree *ParseTree
+}
+
+// try runs fn, dropping the captures it made if it fails.
+func (f *fieldMatch) try(fn func() bool) bool {
+	n := len(f.caps)
+	if fn() {
+		return true
+	}
+	f.caps = f.caps[:n]
+	return false
+}
+
+// take consumes the first of items, recording it under key unless a
+// label is in effect, in which case the label is the key.
+func (f *fieldMatch) take(key string, items []*ParseTree, k func([]*ParseTree) bool) bool {
+	if f.label != "" {
+		key = f.label
+	}
+	return f.try(func() bool {
+		f.caps = append(f.caps, fieldCapture{key, items[0]})
+		return k(items[1:])
+	})
+}
+
+func (f *fieldMatch) expr(e Expr, items []*ParseTree, k func([]*ParseTree) bool) bool {
+	switch e := e.(type) {
+	case *Sequence:
+		if len(items) == 0 {
+			return false
+		}
+		tree, rest := items[0], items[1:]
+		done := func(left []*ParseTree) bool { return len(left) == 0 && k(rest) }
+		if tree.Data == nil && tree.Type == f.typ && f.try(func() bool { return f.seq(e.Exprs, tree.Children, done) }) {
+			return true
+		}
+		return f.seq(e.Exprs, items[:1], done)
+	case *Choice:
+		for _, alt := range e.Alternatives {
+			if f.try(func() bool { return f.expr(alt, items, k) }) {
+				return true
+			}
+		}
+		return false
+	case *Repetition:
+		if e.Kind == Optional {
+			return f.try(func() bool { return f.expr(e.Expr, items, k) }) || k(items)
+		}
+		if len(items) == 0 || items[0].Data != nil || items[0].Type != f.m.c.exprName(e, f.typ) {
+			return false
+		}
+		return f.each(e.Expr, items[0].Children, func() bool { return k(items[1:]) })
+	case *Predicate, *Discard:
+		return k(items)
+	case *Label:
+		outer, outerTerms := f.label, f.terms
+		f.label, f.terms = e.Name, !f.m.refersToRules(e.Expr)
+		ok := f.expr(e.Expr, items, func(rest []*ParseTree) bool {
+			f.label, f.terms = outer, outerTerms
+			ok := k(rest)
+			f.label, f.terms = e.Name, !f.m.refersToRules(e.Expr)
+			return ok
+		})
+		f.label, f.terms = outer, outerTerms
+		return ok
+	case *Literal:
+		if len(items) == 0 || !f.leaf(items[0]) {
+			return false
+		}
+		if data := string(items[0].Data); e.IgnoreCase && !strings.EqualFold(data, e.Text) || !e.IgnoreCase && data != e.Text {
+			return false
+		}
+		return f.terminal(items, k)
+	case *Regexp:
+		if len(items) == 0 || !f.leaf(items[0]) {
+			return false
+		}
+		return f.terminal(items, k)
+	case *Ref:
+		i := f.m.c.index[e.Name]
+		if len(items) > 0 && f.m.types[i][items[0].Type] && f.take(e.Name, items, k) {
+			return true
+		}
+		return f.m.nilable[i] && k(items)
+	}
+	return false
+}
+
+// terminal consumes the leaf built by a terminal, recording it if
+// the label in effect names terminals.
+func (f *fieldMatch) terminal(items []*ParseTree, k func([]*ParseTree) bool) bool {
+	if !f.terms {
+		return k(items[1:])
+	}
+	return f.take("", items, k)
+}
+
+// leaf reports whether tree is a leaf built by a terminal of the rule.
+func (f *fieldMatch) leaf(tree *ParseTree) bool {
+	return tree.Data != nil && tree.Type == f.typ
+}
+
+func (f *fieldMatch) seq(exprs []Expr, items []*ParseTree, k func([]*ParseTree) bool) bool {
+	if len(exprs) == 0 {
+		return k(items)
+	}
+	return f.expr(exprs[0], items, func(rest []*ParseTree) bool {
+		return f.seq(exprs[1:], rest, k)
+	})
+}
+
+// each matches every one of children against e, each on its own, as
+// built by the iterations of a repetition of e.
+func (f *fieldMatch) each(e Expr, children []*ParseTree, k func() bool) bool {
+	if len(children) == 0 {
+		return k()
+	}
+	return f.expr(e, children[:1], func(rest []*ParseTree) bool {
+		return len(rest) == 0 && f.each(e, children[1:], k)
+	})
+}
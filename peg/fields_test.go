@@ -0,0 +1,109 @@
+package peg
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+const fieldsGrammar = `%skip _
+sum     <- left:product (op:('+' / '-') right:product)*
+product <- atom ('*' atom)*
+power   <- base:atom ('^' exp:power)?
+atom    <- number / ('(' sum ')') / (sign:'-' atom)
+number  <- ~'[0-9]+'
+_       <- ~'\s+'^
+`
+
+func TestFieldMatcher(t *testing.T) {
+	g, err := ParseGrammar(strings.NewReader(fieldsGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFieldMatcher(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		rule, input string
+		exp         string
+	}{
+		{"sum", "1", "left=1"},
+		{"sum", "1 + 2*3 - 4", "left=1 op=+ op=- right=2*3 right=4"},
+		{"product", "1*(2+3)*4", "atom=1 atom=(2+3) atom=4"},
+		{"power", "2", "base=2"},
+		{"power", "2^3^4", "base=2 exp=3^4"},
+		{"atom", "-2", "atom=2 sign=-"},
+		{"atom", "(1)", "sum=1"},
+		{"atom", "7", "number=7"},
+		{"number", "7", ""},
+	}
+	for _, tc := range table {
+		g.Start = tc.rule
+		lang, err := Compile(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := lang.ParseString(tc.input)
+		if err != nil {
+			t.Errorf("%s %q: %v", tc.rule, tc.input, err)
+			continue
+		}
+		fields, err := m.Match(tc.rule, tree)
+		if err != nil {
+			t.Errorf("%s %q: %v", tc.rule, tc.input, err)
+			continue
+		}
+		if got := fieldsText(fields); got != tc.exp {
+			t.Errorf("%s %q: got %q, expected %q", tc.rule, tc.input, got, tc.exp)
+		}
+	}
+}
+
+func TestFieldMatcherErrors(t *testing.T) {
+	g, err := ParseGrammar(strings.NewReader(fieldsGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFieldMatcher(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &ParseTree{Type: "number", Data: []byte("1")}
+	for _, tc := range []struct {
+		rule string
+		tree *ParseTree
+		exp  string
+	}{
+		{"sum", &ParseTree{Type: "sum"}, `at offset 0: tree of type "sum" does not match rule sum`},
+		{"product", &ParseTree{Type: "product", Children: []*ParseTree{leaf, leaf}}, `at offset 0: tree of type "product" does not match rule product`},
+		{"atom", &ParseTree{Type: "atom", Data: []byte("+")}, `at offset 0: tree of type "atom" does not match rule atom`},
+		{"atom", nil, "no tree for rule atom"},
+		{"term", leaf, "undefined rule term"},
+	} {
+		if _, err := m.Match(tc.rule, tc.tree); err == nil || err.Error() != tc.exp {
+			t.Errorf("%s: got error %v, expected %s", tc.rule, err, tc.exp)
+		}
+	}
+
+	g.Rules = append(g.Rules, &Rule{Name: "bad", Expr: &Ref{Name: "missing"}})
+	if _, err := NewFieldMatcher(g); err == nil || err.Error() != "rule bad: undefined rule missing" {
+		t.Errorf("got error %v for an undefined rule", err)
+	}
+}
+
+// fieldsText renders fields as key=text pairs, sorted by key.
+func fieldsText(fields map[string][]*ParseTree) string {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, tree := range fields[key] {
+			parts = append(parts, key+"="+tree.Text())
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,378 @@
+package peg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// A FlatTree is a parse tree stored in a single slice. Nodes refer to
+// one another by index, and their data by offsets into the parsed
+// text, so building one takes a handful of allocations however many
+// nodes it has. Languages build every tree this way; Parse then
+// converts the result into ParseTrees, while ParseFlat hands it over
+// as is. A FlatTree is read-only and may be shared between goroutines.
+type FlatTree struct {
+	src   []byte
+	nodes []flatNode
+	ext   [][]byte // data of trees built by lexemes from outside the package
+	root  int32
+}
+
+// maxFlatSize bounds the length of the text a parse reads and the
+// number of trees it builds, which flatNodes refer to with int32s.
+const maxFlatSize = math.MaxInt32
+
+// flatNode is a tree in the arena of a Source. Index 0 of an arena is
+// never used, so that a zero index means no tree.
+type flatNode struct {
+	typ              string
+	start, end       int32 // span of the tree as offsets into the source
+	ext              int32 // the data is ext[ext-1] if > 0, none if < 0, else the span
+	child, next      int32 // first child, and next in the list holding this tree
+	trivia, trailing int32 // first trivia tree and first trailing tree
+}
+
+// ParseFlat is like Parse, but returns the tree as a FlatTree, which
+// is cheaper to build and to keep than ParseTrees.
+func (l *Language) ParseFlat(source io.Reader) (*FlatTree, error) {
+	s, err := NewSource(source)
+	if err != nil {
+		return nil, err
+	}
+	root, err := l.parseSource(context.Background(), l.root, s)
+	if err != nil {
+		return nil, err
+	}
+	return s.flatTree(root), nil
+}
+
+// Root returns the root of the tree. It is the zero Node if the parse
+// produced no tree, as when the start rule discards all it matches.
+func (t *FlatTree) Root() Node {
+	return Node{t: t, i: t.root}
+}
+
+// Len returns the number of nodes in the tree, counting trivia.
+func (t *FlatTree) Len() int {
+	var n int
+	t.walk(t.root, func(int32) { n++ })
+	return n
+}
+
+// Tree converts t into ParseTrees.
+func (t *FlatTree) Tree() *ParseTree {
+	return t.Root().Tree()
+}
+
+func (t *FlatTree) walk(i int32, fn func(int32)) {
+	if i == 0 {
+		return
+	}
+	fn(i)
+	n := &t.nodes[i]
+	for _, list := range [...]int32{n.trivia, n.child, n.trailing} {
+		for c := list; c != 0; c = t.nodes[c].next {
+			t.walk(c, fn)
+		}
+	}
+}
+
+// A Node is a view of one tree of a FlatTree. Its methods mirror the
+// fields of ParseTree. The zero Node stands for no tree.
+type Node struct {
+	t *FlatTree
+	i int32
+}
+
+// IsZero reports whether n stands for no tree.
+func (n Node) IsZero() bool {
+	return n.i == 0
+}
+
+func (n Node) node() *flatNode {
+	if n.i == 0 {
+		return &flatNode{ext: -1}
+	}
+	return &n.t.nodes[n.i]
+}
+
+// Type returns the type of the tree, as ParseTree.Type.
+func (n Node) Type() string {
+	return n.node().typ
+}
+
+// Data returns the text matched by a leaf, as ParseTree.Data. It
+// shares memory with the parsed text and must not be modified.
+func (n Node) Data() []byte {
+	f := n.node()
+	switch {
+	case f.ext > 0:
+		return n.t.ext[f.ext-1]
+	case f.ext < 0:
+		return nil
+	}
+	return n.t.src[f.start:f.end]
+}
+
+// Start returns the offset in the parsed text at which the tree
+// starts, as ParseTree.Start.
+func (n Node) Start() int {
+	return int(n.node().start)
+}
+
+// End returns the offset in the parsed text at which the tree ends, as
+// ParseTree.End.
+func (n Node) End() int {
+	return int(n.node().end)
+}
+
+// Children returns the children of the tree, as ParseTree.Children.
+func (n Node) Children() []Node {
+	return n.list(n.node().child)
+}
+
+// Trivia returns the trivia before the tree, as ParseTree.Trivia.
+func (n Node) Trivia() []Node {
+	return n.list(n.node().trivia)
+}
+
+// Trailing returns the trivia after the tree, as ParseTree.Trailing.
+func (n Node) Trailing() []Node {
+	return n.list(n.node().trailing)
+}
+
+func (n Node) list(first int32) []Node {
+	var nodes []Node
+	for c := first; c != 0; c = n.t.nodes[c].next {
+		nodes = append(nodes, Node{t: n.t, i: c})
+	}
+	return nodes
+}
+
+// Bytes returns the text covered by the tree, as ParseTree.Bytes.
+func (n Node) Bytes() []byte {
+	var buf bytes.Buffer
+	n.writeText(&buf)
+	return buf.Bytes()
+}
+
+func (n Node) writeText(buf *bytes.Buffer) {
+	if n.i == 0 {
+		return
+	}
+	f := n.node()
+	for c := f.trivia; c != 0; c = n.t.nodes[c].next {
+		Node{t: n.t, i: c}.writeText(buf)
+	}
+	buf.Write(n.Data())
+	for c := f.child; c != 0; c = n.t.nodes[c].next {
+		Node{t: n.t, i: c}.writeText(buf)
+	}
+	for c := f.trailing; c != 0; c = n.t.nodes[c].next {
+		Node{t: n.t, i: c}.writeText(buf)
+	}
+}
+
+// Tree converts the tree into ParseTrees, or returns nil for the zero
+// Node. All the ParseTrees are allocated at once.
+func (n Node) Tree() *ParseTree {
+	if n.i == 0 {
+		return nil
+	}
+	var trees, links int
+	n.t.walk(n.i, func(i int32) {
+		trees++
+		f := &n.t.nodes[i]
+		for _, list := range [...]int32{f.trivia, f.child, f.trailing} {
+			for c := list; c != 0; c = n.t.nodes[c].next {
+				links++
+			}
+		}
+	})
+	b := treeBuilder{
+		t:     n.t,
+		trees: make([]ParseTree, 0, trees),
+		links: make([]*ParseTree, 0, links),
+	}
+	return b.build(n.i)
+}
+
+// treeBuilder converts a FlatTree into ParseTrees allocated from two
+// slabs, sized beforehand so that they never move.
+type treeBuilder struct {
+	t     *FlatTree
+	trees []ParseTree
+	links []*ParseTree
+}
+
+func (b *treeBuilder) build(i int32) *ParseTree {
+	b.trees = append(b.trees, ParseTree{})
+	tree := &b.trees[len(b.trees)-1]
+	n := Node{t: b.t, i: i}
+	f := n.node()
+	tree.Type = f.typ
+	tree.Data = n.Data()
+	tree.Start, tree.End = int(f.start), int(f.end)
+	tree.Trivia = b.list(f.trivia)
+	tree.Children = b.list(f.child)
+	tree.Trailing = b.list(f.trailing)
+	return tree
+}
+
+// list builds the trees of a list. The slice returned has no spare
+// capacity, so appending to it cannot clobber the next list.
+func (b *treeBuilder) list(first int32) []*ParseTree {
+	if first == 0 {
+		return nil
+	}
+	start := len(b.links)
+	for c := first; c != 0; c = b.t.nodes[c].next {
+		b.links = append(b.links, nil)
+	}
+	end := len(b.links)
+	for k, c := start, first; c != 0; k, c = k+1, b.t.nodes[c].next {
+		b.links[k] = b.build(c)
+	}
+	return b.links[start:end:end]
+}
+
+// maxPooledArena bounds the arenas kept for reuse by Parse.
+const maxPooledArena = 1 << 16
+
+var arenas = sync.Pool{
+	New: func() interface{} { return new([]flatNode) },
+}
+
+// flatTree returns the tree at root, taking over the arena of s.
+func (s *Source) flatTree(root int32) *FlatTree {
+	t := &FlatTree{src: s.buf, nodes: s.arena, ext: s.ext, root: root}
+	s.arena, s.ext = nil, nil
+	return t
+}
+
+// tree converts the tree at i into ParseTrees.
+func (s *Source) tree(i int32) *ParseTree {
+	t := FlatTree{src: s.buf, nodes: s.arena, ext: s.ext}
+	return Node{t: &t, i: i}.Tree()
+}
+
+// maxFlat returns the bound on the input and arena of s: maxFlatSize,
+// unless a test has set a lower one.
+func (s *Source) maxFlat() int {
+	if s.flatLimit > 0 {
+		return s.flatLimit
+	}
+	return maxFlatSize
+}
+
+// newNode adds n to the arena, returning its index. A parse building
+// more trees than the arena can index is aborted.
+func (s *Source) newNode(n flatNode) int32 {
+	if max := s.maxFlat(); len(s.arena) >= max {
+		if s.abort == nil {
+			s.abort = errors.New(fmt.Sprintf("parse builds more than %d trees", max-1))
+		}
+		return 0
+	}
+	if len(s.arena) == 0 {
+		s.arena = append(s.arena, flatNode{})
+	}
+	s.arena = append(s.arena, n)
+	return int32(len(s.arena) - 1)
+}
+
+// leaf adds a tree of the given type whose data is buf[start:end].
+func (s *Source) leaf(typ string, start, end int, trivia int32) int32 {
+	return s.newNode(flatNode{typ: typ, start: int32(start), end: int32(end), trivia: trivia})
+}
+
+// inner adds a tree of the given type with no data. It spans those of
+// its children that are not empty, or is empty at pos if all are.
+func (s *Source) inner(typ string, pos int, children, trivia int32) int32 {
+	f := flatNode{typ: typ, start: -1, end: int32(pos), ext: -1, child: children, trivia: trivia}
+	for c := children; c != 0; c = s.arena[c].next {
+		if child := &s.arena[c]; child.start < child.end {
+			if f.start < 0 {
+				f.start = child.start
+			}
+			f.end = child.end
+		}
+	}
+	if f.start < 0 {
+		f.start = f.end
+	}
+	return s.newNode(f)
+}
+
+// mark and release discard the trees built by an attempt that failed
+// or whose trees are not wanted: everything added to the arena after
+// mark is dropped by release. A lexeme that fails may leave trees
+// behind; whoever recovers from the failure releases them.
+func (s *Source) mark() int {
+	return len(s.arena)
+}
+
+func (s *Source) release(mark int) {
+	s.arena = s.arena[:mark]
+}
+
+// join returns the list a followed by the list b.
+func (s *Source) join(a, b int32) int32 {
+	if a == 0 {
+		return b
+	}
+	last := a
+	for s.arena[last].next != 0 {
+		last = s.arena[last].next
+	}
+	s.arena[last].next = b
+	return a
+}
+
+// match runs lex at pos, returning the index of its tree. Lexemes
+// built outside this package produce ParseTrees, which are copied
+// into the arena.
+func (s *Source) match(lex *Lexeme, pos int) (int32, error, int) {
+	if lex.match != nil {
+		return lex.match(s, pos)
+	}
+	tree, err, n := lex.Lexer(s, pos)
+	return s.adopt(tree), err, n
+}
+
+func (s *Source) adopt(tree *ParseTree) int32 {
+	if tree == nil {
+		return 0
+	}
+	f := flatNode{typ: tree.Type, start: int32(tree.Start), end: int32(tree.End), ext: -1}
+	if tree.Data != nil {
+		s.ext = append(s.ext, tree.Data)
+		f.ext = int32(len(s.ext))
+	}
+	f.trivia = s.adoptList(tree.Trivia)
+	f.child = s.adoptList(tree.Children)
+	f.trailing = s.adoptList(tree.Trailing)
+	return s.newNode(f)
+}
+
+func (s *Source) adoptList(trees []*ParseTree) int32 {
+	var first, last int32
+	for _, tree := range trees {
+		i := s.adopt(tree)
+		if i == 0 {
+			continue
+		}
+		if first == 0 {
+			first = i
+		} else {
+			s.arena[last].next = i
+		}
+		last = i
+	}
+	return first
+}
@@ -0,0 +1,198 @@
+package peg
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestParseFlat(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(triviaGrammar), Lossless())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{"1+2", " 12 +\t3+ 4 \n", "7 ?"} {
+		flat, err := lang.ParseFlat(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := lang.ParseString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := flatCompare(flat.Root(), tree); err != nil {
+			t.Errorf("%q: %v", input, err)
+		}
+		if err := treeCompare(flat.Tree(), tree); err != nil {
+			t.Errorf("%q: %v", input, err)
+		}
+		if got := string(flat.Root().Bytes()); got != input {
+			t.Errorf("lossless round trip failed: got %q exp %q", got, input)
+		}
+	}
+
+	flat, err := lang.ParseFlat(strings.NewReader("12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sum, digit+, two digits and an empty sum*.
+	if n := flat.Len(); n != 5 {
+		t.Errorf("got %d nodes, expected 5", n)
+	}
+	digits := flat.Root().Children()[0].Children()
+	if len(digits) != 2 || string(digits[1].Data()) != "2" || digits[1].Type() != "digit" {
+		t.Errorf("unexpected children %v", digits)
+	}
+}
+
+// flatCompare checks that n holds the same tree as exp, trivia
+// included.
+func flatCompare(n Node, exp *ParseTree) error {
+	got := n.Tree()
+	if err := treeCompare(got, exp); err != nil {
+		return err
+	}
+	if string(got.Bytes()) != string(exp.Bytes()) {
+		return fmt.Errorf("text mismatch: %q exp: %q", got.Bytes(), exp.Bytes())
+	}
+	return nil
+}
+
+func TestFlatTreeAppend(t *testing.T) {
+	lang, err := NewParser(strings.NewReader("list <- item+\nitem <- 'a' / 'b'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString("abab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Children share one slab; growing one list must not overwrite
+	// the next.
+	first := tree.Children[0]
+	tree.Children = append(tree.Children, &ParseTree{Type: "extra"})
+	if tree.Children[0] != first || len(tree.Children) != 5 {
+		t.Errorf("append clobbered children: %v", tree)
+	}
+}
+
+// TestFlatSizeLimit checks that inputs and trees too large for the
+// int32 offsets of a FlatTree are errors.
+func TestFlatSizeLimit(t *testing.T) {
+	lang, err := NewParser(strings.NewReader("list <- item+\nitem <- 'a' / 'b'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(input string, limit int) error {
+		s := &Source{buf: []byte(input), flatLimit: limit}
+		_, err := lang.parseSource(context.Background(), lang.root, s)
+		return err
+	}
+	if err := parse("abab", 8); err != nil {
+		t.Errorf("got error %v for a tree of 5 nodes", err)
+	}
+	if err := parse("ababababa", 8); err == nil || err.Error() != "input of 9 bytes exceeds the maximum of 8" {
+		t.Errorf("got error %v for a long input", err)
+	}
+	if err := parse("abab", 5); err == nil || err.Error() != "parse builds more than 4 trees" {
+		t.Errorf("got error %v for a large tree", err)
+	}
+}
+
+// BenchmarkParse and BenchmarkParseFlat compare building ParseTrees
+// with building a FlatTree. Run at the commit before trees were built
+// in an arena, BenchmarkParse took about 79,600 allocations and 3.0MB
+// per op; BenchmarkTreeBuild isolates the part of that spent on trees.
+func BenchmarkParse(b *testing.B) {
+	lang := loadCorpus(b, "json")
+	input := genJSON(rand.New(rand.NewSource(1)), 16<<10)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := lang.ParseString(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseFlat(b *testing.B) {
+	lang := loadCorpus(b, "json")
+	input := genJSON(rand.New(rand.NewSource(1)), 16<<10)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := lang.ParseFlat(strings.NewReader(input)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTreeBuild compares building the ParseTrees of a parse
+// through an arena, as Parse does, with building them one allocation
+// at a time, as it did before. The latter is a lower bound on the old
+// cost, as trees built by failed alternatives are not counted.
+func BenchmarkTreeBuild(b *testing.B) {
+	lang := loadCorpus(b, "json")
+	flat, err := lang.ParseFlat(strings.NewReader(genJSON(rand.New(rand.NewSource(1)), 16<<10)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("arena", func(b *testing.B) {
+		b.ReportAllocs()
+		var arena []flatNode // reused, as Parse does
+		for i := 0; i < b.N; i++ {
+			s := &Source{buf: flat.src, arena: arena[:0]}
+			s.tree(rebuildFlat(s, flat, flat.root))
+			arena = s.arena
+		}
+	})
+	b.Run("nodes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rebuildNodes(flat, flat.root)
+		}
+	})
+}
+
+// rebuildFlat copies the tree at i of t into the arena of s.
+func rebuildFlat(s *Source, t *FlatTree, i int32) int32 {
+	f := t.nodes[i]
+	f.trivia = rebuildFlatList(s, t, f.trivia)
+	f.child = rebuildFlatList(s, t, f.child)
+	f.trailing = rebuildFlatList(s, t, f.trailing)
+	f.next = 0
+	return s.newNode(f)
+}
+
+func rebuildFlatList(s *Source, t *FlatTree, first int32) int32 {
+	var head, last int32
+	for c := first; c != 0; c = t.nodes[c].next {
+		i := rebuildFlat(s, t, c)
+		if head == 0 {
+			head = i
+		} else {
+			s.arena[last].next = i
+		}
+		last = i
+	}
+	return head
+}
+
+// rebuildNodes copies the tree at i of t into ParseTrees allocated
+// one by one, with their lists grown by append.
+func rebuildNodes(t *FlatTree, i int32) *ParseTree {
+	f := &t.nodes[i]
+	tree := &ParseTree{Type: f.typ, Data: Node{t: t, i: i}.Data(), Start: int(f.start), End: int(f.end)}
+	for c := f.trivia; c != 0; c = t.nodes[c].next {
+		tree.Trivia = append(tree.Trivia, rebuildNodes(t, c))
+	}
+	for c := f.child; c != 0; c = t.nodes[c].next {
+		tree.Children = append(tree.Children, rebuildNodes(t, c))
+	}
+	for c := f.trailing; c != 0; c = t.nodes[c].next {
+		tree.Trailing = append(tree.Trailing, rebuildNodes(t, c))
+	}
+	return tree
+}
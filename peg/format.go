@@ -0,0 +1,109 @@
+package peg
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Format returns the grammar src in canonical form: one space
+// between the parts of an expression, ' / ' between alternatives,
+// and the '<-' of consecutive rules aligned. Comments are kept,
+// runs of blank lines are collapsed, and the result ends in a
+// newline. Only the tokens of src are examined, so Format works on
+// grammars whose imports or rules would not resolve.
+func Format(src []byte) ([]byte, error) {
+	lines, err := splitLines(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	blank := false
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case len(line) == 0:
+			blank = buf.Len() > 0
+			i++
+			continue
+		case blank:
+			buf.WriteByte('\n')
+			blank = false
+		}
+
+		if assignment(line) < 0 {
+			buf.WriteString(tokensText(line))
+			buf.WriteByte('\n')
+			i++
+			continue
+		}
+
+		// A block of rules, possibly interleaved with comment lines,
+		// is aligned as a unit.
+		j := i
+		width := 0
+		for ; j < len(lines); j++ {
+			if k := assignment(lines[j]); k >= 0 {
+				if w := len(tokensText(lines[j][:k])); w > width {
+					width = w
+				}
+			} else if len(lines[j]) != 1 || lines[j][0].typ != itemComment {
+				break
+			}
+		}
+		for _, line := range lines[i:j] {
+			k := assignment(line)
+			if k < 0 {
+				buf.WriteString(line[0].val)
+				buf.WriteByte('\n')
+				continue
+			}
+			name := tokensText(line[:k])
+			buf.WriteString(name)
+			buf.WriteString(strings.Repeat(" ", width-len(name)))
+			buf.WriteString(" <- ")
+			buf.WriteString(tokensText(line[k+1:]))
+			buf.WriteByte('\n')
+		}
+		i = j
+	}
+	return buf.Bytes(), nil
+}
+
+// splitLines lexes src into lines of tokens, without whitespace.
+// Lex errors are reported as a *GrammarError.
+func splitLines(src []byte) ([][]item, error) {
+	l := lex(bytes.NewReader(src))
+	var lines [][]item
+	var line []item
+	last := item{line: 1, col: 1}
+	for {
+		next, ok := l.nextItem()
+		if !ok {
+			return nil, position{line: last.line, col: last.col}.errorf("unexpected input")
+		}
+		switch next.typ {
+		case itemError:
+			return nil, position{line: next.line, col: next.col}.errorf("%s", next.val)
+		case itemEOF:
+			return append(lines, line), nil
+		case itemNewline:
+			lines = append(lines, line)
+			line = nil
+		case itemWhitespace:
+		default:
+			line = append(line, next)
+		}
+		last = next
+	}
+}
+
+// assignment returns the index of the '<-' in line, or -1.
+func assignment(line []item) int {
+	for i, tok := range line {
+		if tok.typ == itemAssignment {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,74 @@
+package peg
+
+import (
+	"testing"
+)
+
+type FormatTest struct {
+	input string
+	exp   string
+}
+
+var formatTestTable = []FormatTest{
+	FormatTest{
+		"prgm <- 'a'",
+		"prgm <- 'a'\n",
+	},
+	FormatTest{
+		"prgm<-a  b/c\n\n\n\nlonger_name   <-   ~'\\d+'  '\\''i\na <- 'a'*_?^\n",
+		"prgm <- a b / c\n\nlonger_name <- ~'\\d+' '\\''i\na           <- 'a'* _?^\n",
+	},
+	FormatTest{
+		"# leading comment\n\n\nexpr <- term ('+' term)* # sums\n# between\n  term<-~'\\d+'\n\n",
+		"# leading comment\n\nexpr <- term ('+' term)* # sums\n# between\nterm <- ~'\\d+'\n",
+	},
+	FormatTest{
+		"%start  expr\nimport   \"common.peg\"  as c\nlist <- sep_by( c.number , ',' )\nsep_by(x,s) <- x ( s x )*",
+		"%start expr\nimport \"common.peg\" as c\nlist         <- sep_by(c.number, ',')\nsep_by(x, s) <- x (s x)*\n",
+	},
+	FormatTest{
+		"sum<-left:num  ( op:( '+'/'-' )  right:num )*",
+		"sum <- left:num (op:('+' / '-') right:num)*\n",
+	},
+}
+
+func TestFormatTable(t *testing.T) {
+	for _, tc := range formatTestTable {
+		out, err := Format([]byte(tc.input))
+		if err != nil {
+			t.Error(tc.input)
+			t.Error(err)
+			continue
+		}
+		if string(out) != tc.exp {
+			t.Errorf("Format(%q):\ngot:\n%s\nexp:\n%s", tc.input, out, tc.exp)
+		}
+
+		again, err := Format(out)
+		if err != nil || string(again) != string(out) {
+			t.Errorf("Format is not idempotent for %q: %q", out, again)
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	for _, tc := range []struct {
+		grammar   string
+		line, col int
+	}{
+		{"prgm <- 'a", 1, 9},
+		{"prgm <- ~'a", 1, 9},
+		{"prgm < 'a'", 1, 6},
+		{"# rules\nprgm <- [", 2, 9},
+	} {
+		_, err := Format([]byte(tc.grammar))
+		gerr, ok := err.(*GrammarError)
+		if !ok {
+			t.Errorf("%q: expected a GrammarError, got %v", tc.grammar, err)
+			continue
+		}
+		if gerr.Line != tc.line || gerr.Col != tc.col {
+			t.Errorf("%q: got %v, expected an error at %d:%d", tc.grammar, gerr, tc.line, tc.col)
+		}
+	}
+}
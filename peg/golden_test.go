@@ -0,0 +1,16 @@
+package peg_test
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/Logiraptor/chicken/peg/pegtest"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of TestGolden")
+
+// TestGolden parses the inputs in testdata/golden with the grammars
+// beside them. Run it with -update to rewrite the golden files.
+func TestGolden(t *testing.T) {
+	pegtest.Run(t, "testdata/golden", *update)
+}
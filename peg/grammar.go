@@ -0,0 +1,361 @@
+package peg
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Grammar is the structure of a peg grammar. ParseGrammar produces
+// one from grammar text, with imports merged and macros expanded;
+// it can equally be built or transformed in code, and is turned into
+// a Language by Compile.
+type Grammar struct {
+	Rules []*Rule
+	// Start names the default entry point. If empty, the first
+	// rule is used.
+	Start string
+	// Skip names the rule matched as trivia before each terminal,
+	// if any.
+	Skip string
+}
+
+// Rule is a named expression of a grammar.
+type Rule struct {
+	Name string
+	Expr Expr
+	// Type is the type given to the parse trees the rule builds.
+	// If empty, Name is used.
+	Type string
+	// Lexical rules are tokens: no trivia is skipped inside them.
+	Lexical bool
+}
+
+// Rule returns the last rule of g with the given name, or nil.
+func (g *Grammar) Rule(name string) *Rule {
+	for i := len(g.Rules) - 1; i >= 0; i-- {
+		if g.Rules[i].Name == name {
+			return g.Rules[i]
+		}
+	}
+	return nil
+}
+
+// An Expr is a parsing expression: one of *Sequence, *Choice,
+// *Repetition, *Predicate, *Discard, *Label, *Literal, *Regexp or
+// *Ref.
+type Expr interface {
+	String() string
+	expr()
+}
+
+// Sequence matches each of its expressions in turn.
+type Sequence struct {
+	Exprs []Expr
+}
+
+// Choice matches the first of its alternatives that matches.
+type Choice struct {
+	Alternatives []Expr
+}
+
+// RepeatKind is the kind of a Repetition.
+type RepeatKind int
+
+const (
+	ZeroOrMore RepeatKind = iota // e*
+	OneOrMore                    // e+
+	Optional                     // e?
+)
+
+// Repetition matches Expr as many times as its Kind allows.
+type Repetition struct {
+	Expr Expr
+	Kind RepeatKind
+}
+
+// Predicate matches if Expr does (&e) or, if Not is set, if Expr
+// does not (!e). It never consumes input.
+type Predicate struct {
+	Expr Expr
+	Not  bool
+}
+
+// Discard matches Expr but leaves it out of the parse tree (e^).
+type Discard struct {
+	Expr Expr
+}
+
+// Label names what Expr matches (name:e). It does not change how
+// Expr matches or the trees it builds; GenerateAST names fields
+// after labels.
+type Label struct {
+	Name string
+	Expr Expr
+}
+
+// Literal matches Text exactly or, if IgnoreCase is set, under
+// Unicode case folding.
+type Literal struct {
+	Text       string
+	IgnoreCase bool
+}
+
+// Regexp matches the regular expression Pattern.
+type Regexp struct {
+	Pattern string
+}
+
+// Ref matches the rule called Name.
+type Ref struct {
+	Name string
+}
+
+func (*Sequence) expr()   {}
+func (*Choice) expr()     {}
+func (*Repetition) expr() {}
+func (*Predicate) expr()  {}
+func (*Discard) expr()    {}
+func (*Label) expr()      {}
+func (*Literal) expr()    {}
+func (*Regexp) expr()     {}
+func (*Ref) expr()        {}
+
+// Expressions are printed in grammar syntax, in which '/' binds
+// tighter than sequencing: 'a b / c' is 'a (b / c)'. Operands are
+// parenthesized where the grammar would otherwise group them
+// differently.
+
+const (
+	atomPrec = iota
+	postfixPrec
+	prefixPrec
+	choicePrec
+	sequencePrec
+)
+
+func precedence(e Expr) int {
+	switch e.(type) {
+	case *Repetition, *Discard:
+		return postfixPrec
+	case *Predicate, *Label:
+		return prefixPrec
+	case *Choice:
+		return choicePrec
+	case *Sequence:
+		return sequencePrec
+	}
+	return atomPrec
+}
+
+// operand prints e, parenthesized unless its precedence is at most max.
+func operand(e Expr, max int) string {
+	if precedence(e) > max {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+func (s *Sequence) String() string {
+	parts := make([]string, len(s.Exprs))
+	for i, e := range s.Exprs {
+		parts[i] = operand(e, choicePrec)
+	}
+	if len(parts) == 0 {
+		return "()"
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *Choice) String() string {
+	parts := make([]string, len(c.Alternatives))
+	for i, e := range c.Alternatives {
+		if i == 0 && precedence(e) == choicePrec {
+			parts[i] = e.String()
+		} else if i == 0 {
+			parts[i] = operand(e, postfixPrec)
+		} else {
+			parts[i] = operand(e, atomPrec)
+		}
+	}
+	return strings.Join(parts, " / ")
+}
+
+var repeatOps = map[RepeatKind]string{
+	ZeroOrMore: "*",
+	OneOrMore:  "+",
+	Optional:   "?",
+}
+
+func (r *Repetition) String() string {
+	return operand(r.Expr, postfixPrec) + repeatOps[r.Kind]
+}
+
+func (p *Predicate) String() string {
+	if p.Not {
+		return "!" + operand(p.Expr, prefixPrec)
+	}
+	return "&" + operand(p.Expr, prefixPrec)
+}
+
+func (d *Discard) String() string {
+	return operand(d.Expr, postfixPrec) + "^"
+}
+
+func (l *Label) String() string {
+	return l.Name + ":" + operand(l.Expr, prefixPrec)
+}
+
+func (l *Literal) String() string {
+	if l.IgnoreCase {
+		return quote(l.Text) + "i"
+	}
+	return quote(l.Text)
+}
+
+func (r *Regexp) String() string {
+	return "~" + quote(r.Pattern)
+}
+
+func (r *Ref) String() string {
+	return r.Name
+}
+
+// String returns g in canonical grammar syntax, which ParseGrammar
+// reads back into an equivalent grammar. Directives come first,
+// followed by the rules with their arrows aligned. Rules whose names
+// the syntax cannot express, such as imported rules and macro
+// expansions, are printed under plain names derived from theirs,
+// with a %type directive keeping the type of their trees.
+func (g *Grammar) String() string {
+	names := g.printNames()
+	rename := func(name string) string {
+		if n, ok := names[name]; ok {
+			return n
+		}
+		return name
+	}
+	var buf bytes.Buffer
+	if g.Start != "" {
+		buf.WriteString("%start " + rename(g.Start) + "\n")
+	}
+	if g.Skip != "" {
+		buf.WriteString("%skip " + rename(g.Skip) + "\n")
+	}
+	var lexical, types []string
+	var rules []ruleLine
+	typed := make(map[string]bool)
+	for _, r := range g.Rules {
+		name := rename(r.Name)
+		if r.Lexical {
+			lexical = append(lexical, name)
+		}
+		typ := r.Type
+		if typ == "" {
+			typ = r.Name
+		}
+		if typ != name && !typed[name] {
+			typed[name] = true
+			types = append(types, "%type "+name+" "+quote(typ)+"\n")
+		}
+		e := cloneExpr(r.Expr)
+		walkExpr(e, func(e Expr) {
+			if ref, ok := e.(*Ref); ok {
+				ref.Name = rename(ref.Name)
+			}
+		})
+		rules = append(rules, ruleLine{name: name, body: e.String()})
+	}
+	if len(lexical) > 0 {
+		buf.WriteString("%lexical " + strings.Join(lexical, " ") + "\n")
+	}
+	for _, t := range types {
+		buf.WriteString(t)
+	}
+	writeRules(&buf, rules)
+	return buf.String()
+}
+
+// printNames returns the names under which String prints the rules
+// of g whose names are not plain identifiers. Each is made of the
+// words of the original name joined by underscores, lengthened with
+// more underscores until it clashes with no other rule.
+func (g *Grammar) printNames() map[string]string {
+	taken := make(map[string]bool)
+	for _, r := range g.Rules {
+		taken[r.Name] = true
+	}
+	names := make(map[string]string)
+	for _, r := range g.Rules {
+		if _, ok := names[r.Name]; ok || isIdentifier(r.Name) {
+			continue
+		}
+		name := strings.Join(strings.FieldsFunc(r.Name, func(r rune) bool { return !isIdentRune(r) }), "_")
+		if name == "" {
+			name = "rule"
+		}
+		for taken[name] {
+			name += "_"
+		}
+		taken[name] = true
+		names[r.Name] = name
+	}
+	return names
+}
+
+// isIdentifier reports whether name is a plain identifier of the
+// grammar syntax.
+func isIdentifier(name string) bool {
+	for _, r := range name {
+		if !isIdentRune(r) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// clone returns a deep copy of g.
+func (g *Grammar) clone() *Grammar {
+	c := *g
+	c.Rules = make([]*Rule, len(g.Rules))
+	for i, r := range g.Rules {
+		rc := *r
+		rc.Expr = cloneExpr(r.Expr)
+		c.Rules[i] = &rc
+	}
+	return &c
+}
+
+func cloneExpr(e Expr) Expr {
+	switch e := e.(type) {
+	case *Sequence:
+		return &Sequence{Exprs: cloneExprs(e.Exprs)}
+	case *Choice:
+		return &Choice{Alternatives: cloneExprs(e.Alternatives)}
+	case *Repetition:
+		return &Repetition{Expr: cloneExpr(e.Expr), Kind: e.Kind}
+	case *Predicate:
+		return &Predicate{Expr: cloneExpr(e.Expr), Not: e.Not}
+	case *Discard:
+		return &Discard{Expr: cloneExpr(e.Expr)}
+	case *Label:
+		return &Label{Name: e.Name, Expr: cloneExpr(e.Expr)}
+	case *Literal:
+		c := *e
+		return &c
+	case *Regexp:
+		c := *e
+		return &c
+	case *Ref:
+		c := *e
+		return &c
+	}
+	return e
+}
+
+func cloneExprs(exprs []Expr) []Expr {
+	c := make([]Expr, len(exprs))
+	for i, e := range exprs {
+		c[i] = cloneExpr(e)
+	}
+	return c
+}
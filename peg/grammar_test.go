@@ -0,0 +1,274 @@
+package peg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGrammar(t *testing.T) {
+	g, err := ParseGrammar(strings.NewReader("%skip _\n%lexical word\nlist <- word (',' word)* !'x'i\nword <- &~'[a-z]' ~'\\w+'^ / 'it\\'s'+\n_ <- ~'\\s+'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &Grammar{
+		Skip: "_",
+		Rules: []*Rule{
+			&Rule{Name: "list", Expr: &Sequence{Exprs: []Expr{
+				&Ref{Name: "word"},
+				&Repetition{Kind: ZeroOrMore, Expr: &Sequence{Exprs: []Expr{
+					&Literal{Text: ","},
+					&Ref{Name: "word"},
+				}}},
+				&Predicate{Not: true, Expr: &Literal{Text: "x", IgnoreCase: true}},
+			}}},
+			&Rule{Name: "word", Lexical: true, Expr: &Sequence{Exprs: []Expr{
+				&Predicate{Expr: &Regexp{Pattern: "[a-z]"}},
+				&Repetition{Kind: OneOrMore, Expr: &Choice{Alternatives: []Expr{
+					&Discard{Expr: &Regexp{Pattern: "\\w+"}},
+					&Literal{Text: "it's"},
+				}}},
+			}}},
+			&Rule{Name: "_", Expr: &Regexp{Pattern: "\\s+"}},
+		},
+	}
+	if !reflect.DeepEqual(g, exp) {
+		t.Errorf("got:\n%s\nexp:\n%s", g, exp)
+	}
+}
+
+func TestParseGrammarMacros(t *testing.T) {
+	g, err := ParseGrammar(strings.NewReader("list <- sep_by(item, ',')\nsep_by(x, sep) <- x (sep x)*\nitem <- 'a'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := g.Rule("sep_by(item, ',')")
+	if r == nil {
+		t.Fatalf("expansion missing from %s", g)
+	}
+	if r.Type != "sep_by" {
+		t.Errorf("expansion has type %q, expected sep_by", r.Type)
+	}
+	if g.Start != "" {
+		t.Errorf("unexpected start rule %s", g.Start)
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	lang, err := NewParser(strings.NewReader("prgm <- (!'end' ~'[a-z]+' ' ')* 'end' !~'.'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lang.ParseString("a b end"); err != nil {
+		t.Error(err)
+	}
+	if _, err := lang.ParseString("a end b"); err == nil {
+		t.Error("expected !~'.' to reject trailing input")
+	}
+
+	lang, err = NewParser(strings.NewReader("prgm <- &'ab' ~'[a-z]+'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := treeCompare(tree, &ParseTree{Type: "prgm", Data: []byte("abc")}); err != nil {
+		t.Error(err)
+	}
+	if _, err := lang.ParseString("acb"); err == nil {
+		t.Error("expected &'ab' to reject acb")
+	}
+
+	for _, bad := range []string{"prgm <- 'a' !", "prgm <- ! * 'a'", "prgm <- 'a' / !'b'"} {
+		if _, err := ParseGrammar(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	g, err := ParseGrammar(strings.NewReader("sum <- left:num (op:'+' / '-' right:num)*\nnum <- ~'[0-9]+'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &Sequence{Exprs: []Expr{
+		&Label{Name: "left", Expr: &Ref{Name: "num"}},
+		&Repetition{Kind: ZeroOrMore, Expr: &Sequence{Exprs: []Expr{
+			&Label{Name: "op", Expr: &Choice{Alternatives: []Expr{&Literal{Text: "+"}, &Literal{Text: "-"}}}},
+			&Label{Name: "right", Expr: &Ref{Name: "num"}},
+		}}},
+	}}
+	if !reflect.DeepEqual(g.Rules[0].Expr, exp) {
+		t.Errorf("got %s, expected %s", g.Rules[0].Expr, exp)
+	}
+
+	// Labels leave the trees alone.
+	plain, err := NewParser(strings.NewReader("sum <- num (('+' / '-') num)*\nnum <- ~'[0-9]+'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	labeled, err := Compile(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := plain.ParseString("1+2-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := labeled.ParseString("1+2-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := Diff(b, a); len(diffs) > 0 {
+		t.Errorf("labels changed the tree: %v", diffs)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	g := &Grammar{Rules: []*Rule{
+		&Rule{Name: "pair", Expr: &Sequence{Exprs: []Expr{
+			&Ref{Name: "key"},
+			&Discard{Expr: &Literal{Text: "="}},
+			&Ref{Name: "value"},
+		}}},
+		&Rule{Name: "key", Expr: &Regexp{Pattern: "[a-z]+"}},
+		&Rule{Name: "value", Expr: &Regexp{Pattern: "[0-9]+"}},
+	}}
+	lang, err := Compile(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString("a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ParseTree{Type: "pair", Children: []*ParseTree{
+		&ParseTree{Type: "key", Data: []byte("a")},
+		&ParseTree{Type: "value", Data: []byte("1")},
+	}}
+	if err := treeCompare(tree, exp); err != nil {
+		t.Error(err)
+	}
+
+	// Transforming the grammar leaves the compiled language alone.
+	g.Rule("value").Expr = &Choice{Alternatives: []Expr{
+		&Regexp{Pattern: "[0-9]+"},
+		&Literal{Text: "true", IgnoreCase: true},
+	}}
+	if _, err := lang.ParseString("a=TRUE"); err == nil {
+		t.Error("compiled language changed with its grammar")
+	}
+	lang, err = Compile(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lang.ParseString("a=TRUE"); err != nil {
+		t.Error(err)
+	}
+	if exp := "pair  <- key '='^ value\nkey   <- ~'[a-z]+'\nvalue <- ~'[0-9]+' / 'true'i\n"; lang.String() != exp {
+		t.Errorf("got:\n%s\nexp:\n%s", lang.String(), exp)
+	}
+}
+
+func TestCompileShared(t *testing.T) {
+	g, err := ParseGrammar(strings.NewReader("%skip _\nlist <- words\nwords <- word+\nword <- ~'[a-z]+'\n_ <- ~' +'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := Compile(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossless, err := Compile(g, Lossless())
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced := plain.WithTracer(TraceRules(NewTextTracer(new(bytes.Buffer)), "word"))
+
+	exp := &ParseTree{Type: "word+", Children: []*ParseTree{
+		&ParseTree{Type: "word", Data: []byte("ab")},
+		&ParseTree{Type: "word", Data: []byte("c")},
+	}}
+	// Parsing with one Language must not change how the others
+	// resolve their rules.
+	for i := 0; i < 2; i++ {
+		for _, lang := range []*Language{plain, lossless, traced} {
+			tree, err := lang.ParseString(" ab c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := treeCompare(tree, exp); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	tree, err := lossless.ParseRuleString("words", "ab c ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(tree.Bytes()); got != "ab c " {
+		t.Errorf("lossless round trip failed: got %q", got)
+	}
+	if got, exp := plain.String(), lossless.String(); got != exp {
+		t.Errorf("languages compiled from one grammar differ:\n%s\n%s", got, exp)
+	}
+}
+
+var compileErrorTable = []*Grammar{
+	&Grammar{},
+	&Grammar{Rules: []*Rule{&Rule{Name: "a", Expr: &Regexp{Pattern: "("}}}},
+	&Grammar{Rules: []*Rule{&Rule{Name: "a", Expr: &Ref{Name: "b"}}}},
+	&Grammar{Rules: []*Rule{&Rule{Name: "a", Expr: &Sequence{}}}},
+	&Grammar{Rules: []*Rule{&Rule{Name: "a"}}},
+	&Grammar{Rules: []*Rule{&Rule{Name: "a", Expr: &Literal{Text: "a"}}}, Start: "b"},
+	&Grammar{Rules: []*Rule{&Rule{Name: "a", Expr: &Literal{Text: "a"}}}, Skip: "b"},
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, g := range compileErrorTable {
+		if _, err := Compile(g); err == nil {
+			t.Errorf("expected error compiling %s", g)
+		}
+	}
+	if _, err := NewParser(strings.NewReader("prgm <- ~'('")); err == nil {
+		t.Error("expected error for invalid regexp")
+	}
+}
+
+func TestExprString(t *testing.T) {
+	a, b, c := &Ref{Name: "a"}, &Ref{Name: "b"}, &Ref{Name: "c"}
+	table := []struct {
+		expr Expr
+		exp  string
+	}{
+		{&Sequence{Exprs: []Expr{a, &Choice{Alternatives: []Expr{b, c}}}}, "a b / c"},
+		{&Choice{Alternatives: []Expr{&Sequence{Exprs: []Expr{a, b}}, c}}, "(a b) / c"},
+		{&Choice{Alternatives: []Expr{a, &Repetition{Expr: b, Kind: OneOrMore}}}, "a / (b+)"},
+		{&Choice{Alternatives: []Expr{&Predicate{Expr: a, Not: true}, b}}, "(!a) / b"},
+		{&Predicate{Expr: &Choice{Alternatives: []Expr{a, b}}}, "&(a / b)"},
+		{&Predicate{Expr: &Repetition{Expr: a, Kind: Optional}, Not: true}, "!a?"},
+		{&Repetition{Expr: &Sequence{Exprs: []Expr{a, b}}, Kind: ZeroOrMore}, "(a b)*"},
+		{&Discard{Expr: &Literal{Text: "it's"}}, "'it\\'s'^"},
+		{&Sequence{Exprs: []Expr{&Label{Name: "x", Expr: a}, &Label{Name: "op", Expr: &Choice{Alternatives: []Expr{b, c}}}}}, "x:a op:(b / c)"},
+		{&Choice{Alternatives: []Expr{&Label{Name: "x", Expr: a}, b}}, "(x:a) / b"},
+		{&Label{Name: "xs", Expr: &Repetition{Expr: &Sequence{Exprs: []Expr{a, b}}, Kind: ZeroOrMore}}, "xs:(a b)*"},
+		{&Predicate{Expr: &Label{Name: "x", Expr: a}, Not: true}, "!x:a"},
+	}
+	for _, tc := range table {
+		if s := tc.expr.String(); s != tc.exp {
+			t.Errorf("got %s, expected %s", s, tc.exp)
+			continue
+		}
+		g, err := ParseGrammar(strings.NewReader("r <- " + tc.exp + "\na <- 'a'\nb <- 'b'\nc <- 'c'"))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if s := g.Rules[0].Expr.String(); s != tc.exp {
+			t.Errorf("%s does not round trip: %s", tc.exp, s)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package grammars
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// ArithGrammar is arithmetic over numbers and variables, with the
+// usual precedence: ^ (right associative) binds tighter than unary -,
+// which binds tighter than * and /, then + and -.
+const ArithGrammar = `%skip _
+expr    <- sum end
+sum     <- product (addop product)*
+product <- unary (mulop unary)*
+unary   <- ('-' unary) / power
+power   <- atom ('^' unary)?
+atom    <- number / name / ('(' sum ')')
+addop   <- '+' / '-'
+mulop   <- '*' / '/'
+number  <- ~'[0-9]+(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?'
+name    <- ~'[A-Za-z_][A-Za-z0-9_]*'
+end     <- !~'(?s).'
+_       <- ~'[ \t\r\n]+'
+`
+
+var arithLanguage = lazy("arithmetic", ArithGrammar)
+
+// Arith returns the Language of ArithGrammar.
+func Arith() *peg.Language {
+	return arithLanguage()
+}
+
+// EvalArith parses src as arithmetic and evaluates it, as ArithEval.
+func EvalArith(src string, vars map[string]float64) (float64, error) {
+	tree, err := Arith().ParseString(src)
+	if err != nil {
+		return 0, err
+	}
+	return ArithEval(tree, vars)
+}
+
+// ArithEval evaluates a tree of the Arith Language, looking variables
+// up in vars. Using an undefined variable or dividing by zero is an
+// error.
+func ArithEval(tree *peg.ParseTree, vars map[string]float64) (float64, error) {
+	if tree == nil {
+		return 0, unexpected("arithmetic", tree)
+	}
+	switch tree.Type {
+	case "number":
+		return strconv.ParseFloat(string(tree.Data), 64)
+	case "name":
+		v, ok := vars[string(tree.Data)]
+		if !ok {
+			return 0, errors.New(fmt.Sprintf("grammars: undefined variable %q", tree.Data))
+		}
+		return v, nil
+	}
+	if tree.Data != nil {
+		return 0, unexpected("arithmetic", tree)
+	}
+	// The operands of a binary operator are spread over a repetition
+	// of subtrees, and of ^ over nested ones, which flatten undoes.
+	var ops []string
+	var operands []*peg.ParseTree
+	var flatten func(t *peg.ParseTree)
+	flatten = func(t *peg.ParseTree) {
+		for _, c := range t.Children {
+			switch {
+			case isArithOp(tree, c):
+				ops = append(ops, string(c.Data))
+			case c.Type == tree.Type+"*", c.Type == tree.Type && tree.Type != "unary" && len(c.Children) > 0 && isArithOp(tree, c.Children[0]):
+				flatten(c)
+			default:
+				operands = append(operands, c)
+			}
+		}
+	}
+	flatten(tree)
+
+	if len(operands) == 0 {
+		return 0, unexpected("arithmetic", tree)
+	}
+	v, err := ArithEval(operands[0], vars)
+	if err != nil {
+		return 0, err
+	}
+	switch tree.Type {
+	case "unary":
+		return -v, nil
+	case "atom":
+		return v, nil
+	}
+	if len(ops) != len(operands)-1 {
+		return 0, unexpected("arithmetic", tree)
+	}
+	for i, op := range ops {
+		w, err := ArithEval(operands[i+1], vars)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "+":
+			v += w
+		case "-":
+			v -= w
+		case "*":
+			v *= w
+		case "/":
+			if w == 0 {
+				return 0, errors.New("grammars: division by zero")
+			}
+			v /= w
+		case "^":
+			v = math.Pow(v, w)
+		}
+	}
+	return v, nil
+}
+
+// isArithOp reports whether t is an operator or parenthesis of the
+// tree being evaluated. Punctuation takes the type of its rule.
+func isArithOp(tree, t *peg.ParseTree) bool {
+	return t.Data != nil && (t.Type == "addop" || t.Type == "mulop" || t.Type == tree.Type)
+}
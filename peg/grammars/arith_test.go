@@ -0,0 +1,43 @@
+package grammars
+
+import "testing"
+
+func TestArith(t *testing.T) {
+	vars := map[string]float64{"x": 3, "y_2": 0.5}
+	table := []struct {
+		src string
+		exp float64
+	}{
+		{"1", 1},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"(-2) ^ 2", 4},
+		{"--x", 3},
+		{"x * y_2 + 1.5e1", 16.5},
+		{"((x))", 3},
+		{"2 ^ -1", 0.5},
+		{"1-\n-1", 2},
+	}
+	for _, tc := range table {
+		got, err := EvalArith(tc.src, vars)
+		if err != nil {
+			t.Errorf("%q: %v", tc.src, err)
+			continue
+		}
+		if got != tc.exp {
+			t.Errorf("%q: got %v, expected %v", tc.src, got, tc.exp)
+		}
+	}
+}
+
+func TestArithErrors(t *testing.T) {
+	for _, src := range []string{"", "1 +", "(1", "1 2", "2 ** 3", "1 / (x - 3)", "z + 1", "1.", "-"} {
+		if v, err := EvalArith(src, map[string]float64{"x": 3}); err == nil {
+			t.Errorf("%q: expected error, got %v", src, v)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package grammars
+
+import (
+	"bytes"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// CSVGrammar is comma-separated values as defined by RFC 4180, also
+// accepting bare newlines as record separators.
+const CSVGrammar = `file    <- record (crlf record)* end
+record  <- field (',' field)*
+field   <- escaped / text
+escaped <- ~'"(?:[^"]|"")*"'
+text    <- ~'[^,"\r\n]*'
+crlf    <- ~'\r?\n'
+end     <- !~'(?s).'
+`
+
+var csvLanguage = lazy("CSV", CSVGrammar)
+
+// CSV returns the Language of CSVGrammar.
+func CSV() *peg.Language {
+	return csvLanguage()
+}
+
+// ParseCSV parses src as CSV and returns its records, as CSVRecords.
+func ParseCSV(src string) ([][]string, error) {
+	tree, err := CSV().ParseString(src)
+	if err != nil {
+		return nil, err
+	}
+	return CSVRecords(tree)
+}
+
+// CSVRecords converts a tree of the CSV Language into its records.
+// Quoted fields are unquoted, keeping any line breaks inside them as
+// they are. A line break ending the input does not start another
+// record, so empty input has no records. Records may differ in length.
+func CSVRecords(tree *peg.ParseTree) ([][]string, error) {
+	if tree == nil {
+		return nil, unexpected("CSV", tree)
+	}
+	var records [][]string
+	recs := collect(tree, ofType("record"))
+	for i, rec := range recs {
+		fields := collect(rec, isCSVField)
+		if i == len(recs)-1 && len(fields) == 1 && fields[0].Type == "text" && len(fields[0].Data) == 0 {
+			break
+		}
+		var record []string
+		for _, field := range fields {
+			if field.Type == "text" {
+				record = append(record, string(field.Data))
+				continue
+			}
+			quoted := field.Data[1 : len(field.Data)-1]
+			record = append(record, string(bytes.Replace(quoted, []byte(`""`), []byte(`"`), -1)))
+		}
+		if len(record) == 0 {
+			return nil, unexpected("CSV", rec)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func isCSVField(t *peg.ParseTree) bool {
+	return (t.Type == "text" || t.Type == "escaped") && t.Data != nil
+}
@@ -0,0 +1,59 @@
+package grammars
+
+import (
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSV(t *testing.T) {
+	table := []string{
+		"a",
+		"a,b,c\r\n1,2,3\r\n",
+		"a,b\n1,2",
+		`"quoted, with comma","say ""hi""",plain`,
+		"\"multi\nline\",x\r\n",
+		"a,,b\r\n",
+		"x\n\"\"",
+	}
+	for _, src := range table {
+		got, err := ParseCSV(src)
+		if err != nil {
+			t.Errorf("%q: %v", src, err)
+			continue
+		}
+		exp, err := csv.NewReader(strings.NewReader(src)).ReadAll()
+		if err != nil {
+			t.Fatalf("%q: %v", src, err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%q: got %q, expected %q", src, got, exp)
+		}
+	}
+
+	// Unlike encoding/csv, blank lines are records and line breaks in
+	// quoted fields are kept.
+	for src, exp := range map[string][][]string{
+		"a,b\n\nc\n":     {{"a", "b"}, {""}, {"c"}},
+		"\"x\r\ny\"\r\n": {{"x\r\ny"}},
+		"":               nil,
+	} {
+		got, err := ParseCSV(src)
+		if err != nil {
+			t.Errorf("%q: %v", src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%q: got %q, expected %q", src, got, exp)
+		}
+	}
+}
+
+func TestCSVErrors(t *testing.T) {
+	for _, src := range []string{`"unterminated`, `a"b`, `"a"b`, "a\r"} {
+		if v, err := ParseCSV(src); err == nil {
+			t.Errorf("%q: expected error, got %q", src, v)
+		}
+	}
+}
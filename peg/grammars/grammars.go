@@ -0,0 +1,89 @@
+// Package grammars provides ready-made languages for common formats:
+// JSON, CSV, INI, arithmetic expressions, URIs and semantic versions.
+//
+// Each format has a function returning its compiled Language, which
+// is built on first use and shared, a function converting the
+// ParseTrees of that Language into Go values, and a function doing
+// both to a string:
+//
+//	v, err := grammars.ParseJSON(`{"a": [1, 2]}`)
+//
+// The grammars are exported as constants too, so that they can be
+// imported into other grammars or used as a starting point.
+package grammars
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// lazy returns a function compiling grammar on its first call. The
+// grammars of this package are fixed and tested, so failing to
+// compile one is a bug.
+func lazy(name, grammar string) func() *peg.Language {
+	var once sync.Once
+	var lang *peg.Language
+	return func() *peg.Language {
+		once.Do(func() {
+			var err error
+			lang, err = peg.NewParser(strings.NewReader(grammar))
+			if err != nil {
+				panic(fmt.Sprintf("grammars: %s grammar: %v", name, err))
+			}
+		})
+		return lang
+	}
+}
+
+// collect returns the trees below tree for which match is true, in
+// order, without looking inside them.
+func collect(tree *peg.ParseTree, match func(*peg.ParseTree) bool) []*peg.ParseTree {
+	var found []*peg.ParseTree
+	for _, child := range tree.Children {
+		if match(child) {
+			found = append(found, child)
+		} else {
+			found = append(found, collect(child, match)...)
+		}
+	}
+	return found
+}
+
+// ofType returns a match for collect accepting inner trees of the
+// given types. Leaves of those types are the punctuation of the rule
+// they are named after, such as the '[' of an array, and are skipped.
+func ofType(types ...string) func(*peg.ParseTree) bool {
+	return func(t *peg.ParseTree) bool {
+		if t.Data != nil {
+			return false
+		}
+		for _, typ := range types {
+			if t.Type == typ {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// leaf returns the first leaf below tree of the given type.
+func leaf(tree *peg.ParseTree, typ string) (*peg.ParseTree, bool) {
+	found := collect(tree, func(t *peg.ParseTree) bool {
+		return t.Type == typ && t.Data != nil
+	})
+	if len(found) == 0 {
+		return nil, false
+	}
+	return found[0], true
+}
+
+func unexpected(format string, tree *peg.ParseTree) error {
+	if tree == nil {
+		return errors.New(fmt.Sprintf("grammars: no %s tree", format))
+	}
+	return errors.New(fmt.Sprintf("grammars: unexpected %s tree of type %q", format, tree.Type))
+}
@@ -0,0 +1,39 @@
+package grammars
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+var all = map[string]string{
+	"JSON":       JSONGrammar,
+	"CSV":        CSVGrammar,
+	"INI":        INIGrammar,
+	"arithmetic": ArithGrammar,
+	"URI":        URIGrammar,
+	"semver":     SemverGrammar,
+}
+
+// TestGrammars checks that the grammars are formatted and lint free.
+func TestGrammars(t *testing.T) {
+	for name, src := range all {
+		formatted, err := peg.Format([]byte(src))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(formatted) != src {
+			t.Errorf("%s is not formatted:\n%s", name, formatted)
+		}
+		g, err := peg.ParseGrammar(strings.NewReader(src))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		for _, w := range peg.Lint(g) {
+			t.Errorf("%s: %v", name, w)
+		}
+	}
+}
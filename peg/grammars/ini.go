@@ -0,0 +1,79 @@
+package grammars
+
+import (
+	"strings"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// INIGrammar is the INI format: [section] headers, key = value pairs
+// and whole-line comments starting with ; or #.
+const INIGrammar = `%skip _
+file    <- line* last? end
+line    <- (section / pair / comment)? nl
+last    <- section / pair / comment
+section <- '[' name ']'
+pair    <- key '=' value
+name    <- ~'[^\]\r\n]+'
+key     <- ~'[^\s=\[;#][^=\r\n]*'
+value   <- ~'[^\r\n]*'
+comment <- ~'[;#][^\r\n]*'
+nl      <- ~'\r?\n'
+end     <- !~'(?s).'
+_       <- ~'[ \t]+'
+`
+
+var iniLanguage = lazy("INI", INIGrammar)
+
+// INI returns the Language of INIGrammar.
+func INI() *peg.Language {
+	return iniLanguage()
+}
+
+// ParseINI parses src as INI and returns its sections, as INISections.
+func ParseINI(src string) (map[string]map[string]string, error) {
+	tree, err := INI().ParseString(src)
+	if err != nil {
+		return nil, err
+	}
+	return INISections(tree)
+}
+
+// INISections converts a tree of the INI Language into a map from
+// section names to the pairs of each section. Pairs before the first
+// section go under the name "". Names, keys and values are trimmed of
+// spaces, and of repeated keys the last wins. Comments are dropped;
+// ; and # only start one at the beginning of a line.
+func INISections(tree *peg.ParseTree) (map[string]map[string]string, error) {
+	if tree == nil {
+		return nil, unexpected("INI", tree)
+	}
+	sections := make(map[string]map[string]string)
+	section := ""
+	for _, t := range collect(tree, ofType("section", "pair")) {
+		if t.Type == "section" {
+			name, ok := leaf(t, "name")
+			if !ok {
+				return nil, unexpected("INI", t)
+			}
+			section = strings.TrimSpace(string(name.Data))
+			if sections[section] == nil {
+				sections[section] = make(map[string]string)
+			}
+			continue
+		}
+		key, ok := leaf(t, "key")
+		if !ok {
+			return nil, unexpected("INI", t)
+		}
+		var val string
+		if v, ok := leaf(t, "value"); ok {
+			val = strings.TrimSpace(string(v.Data))
+		}
+		if sections[section] == nil {
+			sections[section] = make(map[string]string)
+		}
+		sections[section][strings.TrimSpace(string(key.Data))] = val
+	}
+	return sections, nil
+}
@@ -0,0 +1,45 @@
+package grammars
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestINI(t *testing.T) {
+	table := []struct {
+		src string
+		exp map[string]map[string]string
+	}{
+		{"", map[string]map[string]string{}},
+		{"name = top\n[server]\nhost = example.com\nport=8080\n", map[string]map[string]string{
+			"":       {"name": "top"},
+			"server": {"host": "example.com", "port": "8080"},
+		}},
+		{"; comment\r\n\r\n[ a b ]\r\n# another\r\nkey with spaces = value; not a comment  \r\nempty =\r\n[empty]", map[string]map[string]string{
+			"a b":   {"key with spaces": "value; not a comment", "empty": ""},
+			"empty": {},
+		}},
+		{"[s]\nk = 1\n[t]\n[s]\nk = 2\nurl = a=b", map[string]map[string]string{
+			"s": {"k": "2", "url": "a=b"},
+			"t": {},
+		}},
+	}
+	for _, tc := range table {
+		got, err := ParseINI(tc.src)
+		if err != nil {
+			t.Errorf("%q: %v", tc.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("%q: got %v, expected %v", tc.src, got, tc.exp)
+		}
+	}
+}
+
+func TestINIErrors(t *testing.T) {
+	for _, src := range []string{"[unclosed\n", "no value\n", "[]\n", "= value\n", "[a] b\n"} {
+		if v, err := ParseINI(src); err == nil {
+			t.Errorf("%q: expected error, got %v", src, v)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package grammars
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// JSONGrammar is JSON as defined by RFC 8259.
+const JSONGrammar = `%skip _
+json     <- value end
+value    <- object / array / string / number / literal
+object   <- '{' members? '}'
+members  <- pair (',' pair)*
+pair     <- string ':' value
+array    <- '[' elements? ']'
+elements <- value (',' value)*
+string   <- ~'"(?:[^"\\\x00-\x1f]|\\["\\/bfnrt]|\\u[0-9a-fA-F]{4})*"'
+number   <- ~'-?(?:0|[1-9][0-9]*)(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?'
+literal  <- 'true' / 'false' / 'null'
+end      <- !~'(?s).'
+_        <- ~'[ \t\r\n]+'
+`
+
+var jsonLanguage = lazy("JSON", JSONGrammar)
+
+// JSON returns the Language of JSONGrammar.
+func JSON() *peg.Language {
+	return jsonLanguage()
+}
+
+// ParseJSON parses src as JSON and returns its value, as JSONValue.
+func ParseJSON(src string) (interface{}, error) {
+	tree, err := JSON().ParseString(src)
+	if err != nil {
+		return nil, err
+	}
+	return JSONValue(tree)
+}
+
+// JSONValue converts a tree of the JSON Language into the values
+// encoding/json would decode it to: map[string]interface{} for
+// objects, []interface{} for arrays, string, float64, bool and nil.
+// Of repeated object keys the last wins.
+func JSONValue(tree *peg.ParseTree) (interface{}, error) {
+	if tree == nil || !isJSONValue(tree) {
+		return nil, unexpected("JSON", tree)
+	}
+	switch tree.Type {
+	case "object":
+		obj := make(map[string]interface{})
+		for _, pair := range collect(tree, ofType("pair")) {
+			if len(pair.Children) != 3 {
+				return nil, unexpected("JSON", pair)
+			}
+			key, err := unquoteJSON(pair.Children[0].Data)
+			if err != nil {
+				return nil, err
+			}
+			val, err := JSONValue(pair.Children[2])
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = val
+		}
+		return obj, nil
+	case "array":
+		arr := []interface{}{}
+		for _, elem := range collect(tree, isJSONValue) {
+			val, err := JSONValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		return arr, nil
+	case "string":
+		return unquoteJSON(tree.Data)
+	case "number":
+		return strconv.ParseFloat(string(tree.Data), 64)
+	}
+	switch string(tree.Data) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return nil, nil
+}
+
+func isJSONValue(t *peg.ParseTree) bool {
+	switch t.Type {
+	case "string", "number", "literal":
+		return t.Data != nil
+	case "object", "array":
+		return t.Data == nil
+	}
+	return false
+}
+
+// unquoteJSON decodes a JSON string literal, quotes included, which
+// the grammar has already checked.
+func unquoteJSON(quoted []byte) (string, error) {
+	if len(quoted) < 2 {
+		return "", errors.New(fmt.Sprintf("grammars: invalid JSON string %q", quoted))
+	}
+	s := quoted[1 : len(quoted)-1]
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		if s[i] != '\\' {
+			buf = append(buf, s[i])
+			i++
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", errors.New(fmt.Sprintf("grammars: invalid JSON string %q", quoted))
+		}
+		switch c := s[i+1]; c {
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'u':
+			r, n := decodeJSONEscape(s[i:])
+			if n == 0 {
+				return "", errors.New(fmt.Sprintf("grammars: invalid JSON string %q", quoted))
+			}
+			buf = append(buf, string(r)...)
+			i += n
+			continue
+		default:
+			buf = append(buf, c)
+		}
+		i += 2
+	}
+	return string(buf), nil
+}
+
+// decodeJSONEscape decodes the \u escape at the start of s, combining
+// surrogate pairs. It returns the rune and the bytes used, or 0 bytes
+// if the escape is malformed. Unpaired surrogates decode to U+FFFD,
+// as encoding/json does.
+func decodeJSONEscape(s []byte) (rune, int) {
+	hex := func(s []byte) (rune, bool) {
+		if len(s) < 6 || s[0] != '\\' || s[1] != 'u' {
+			return 0, false
+		}
+		v, err := strconv.ParseUint(string(s[2:6]), 16, 16)
+		return rune(v), err == nil
+	}
+	r, ok := hex(s)
+	if !ok {
+		return 0, 0
+	}
+	if !utf16.IsSurrogate(r) {
+		return r, 6
+	}
+	if low, ok := hex(s[6:]); ok {
+		if dec := utf16.DecodeRune(r, low); dec != utf8.RuneError {
+			return dec, 12
+		}
+	}
+	return utf8.RuneError, 6
+}
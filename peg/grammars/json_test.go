@@ -0,0 +1,47 @@
+package grammars
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	table := []string{
+		`null`,
+		`true`,
+		` false `,
+		`0`,
+		`-12.5e3`,
+		`""`,
+		`"a\"b\\c\/d\b\f\n\r\t"`,
+		`"é中😀\ud800x"`,
+		`[]`,
+		`[1, "two", [3], {}]`,
+		`{}`,
+		`{"a": 1, "b": {"c": [true, null]}, "a": 2}`,
+		"{\n\t\"nested\": [[], [[]], {\"x\": {\"y\": \"z\"}}]\n}\n",
+	}
+	for _, src := range table {
+		got, err := ParseJSON(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		var exp interface{}
+		if err := json.Unmarshal([]byte(src), &exp); err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: got %#v, expected %#v", src, got, exp)
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, src := range []string{``, `{`, `[1,]`, `{"a" 1}`, `01`, `"\x"`, "\"\t\"", `nul`, `1 2`, `{a: 1}`} {
+		if v, err := ParseJSON(src); err == nil {
+			t.Errorf("%s: expected error, got %#v", src, v)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package grammars
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// SemverGrammar is the version syntax of Semantic Versioning 2.0.0.
+const SemverGrammar = `version    <- major '.' minor '.' patch ('-' prerelease)? ('+' build)? end
+prerelease <- preid ('.' preid)*
+build      <- buildid ('.' buildid)*
+major      <- ~'0|[1-9][0-9]*'
+minor      <- ~'0|[1-9][0-9]*'
+patch      <- ~'0|[1-9][0-9]*'
+preid      <- ~'[0-9A-Za-z-]*[A-Za-z-][0-9A-Za-z-]*|0|[1-9][0-9]*'
+buildid    <- ~'[0-9A-Za-z-]+'
+end        <- !~'(?s).'
+`
+
+var semverLanguage = lazy("semver", SemverGrammar)
+
+// Semver returns the Language of SemverGrammar.
+func Semver() *peg.Language {
+	return semverLanguage()
+}
+
+// A Version is a semantic version.
+type Version struct {
+	Major, Minor, Patch uint64
+	Prerelease          []string
+	Build               []string
+}
+
+// String formats v as in SemverGrammar.
+func (v Version) String() string {
+	s := strconv.FormatUint(v.Major, 10) + "." + strconv.FormatUint(v.Minor, 10) + "." + strconv.FormatUint(v.Patch, 10)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if len(v.Build) > 0 {
+		s += "+" + strings.Join(v.Build, ".")
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 as v has lower, equal or higher
+// precedence than w. Build metadata does not count.
+func (v Version) Compare(w Version) int {
+	for _, p := range [...][2]uint64{{v.Major, w.Major}, {v.Minor, w.Minor}, {v.Patch, w.Patch}} {
+		if c := compareUint(p[0], p[1]); c != 0 {
+			return c
+		}
+	}
+	// A pre-release has lower precedence than its normal version.
+	switch {
+	case len(v.Prerelease) == 0 && len(w.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(w.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(w.Prerelease); i++ {
+		if c := comparePrerelease(v.Prerelease[i], w.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.Prerelease)), uint64(len(w.Prerelease)))
+}
+
+// comparePrerelease compares pre-release identifiers: numerically if
+// both are numbers, by ASCII otherwise, with numbers lower.
+func comparePrerelease(a, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		return compareUint(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// ParseSemver parses src as a semantic version, as SemverValue.
+func ParseSemver(src string) (Version, error) {
+	tree, err := Semver().ParseString(src)
+	if err != nil {
+		return Version{}, err
+	}
+	return SemverValue(tree)
+}
+
+// SemverValue converts a tree of the Semver Language into a Version.
+// Numbers too large for a uint64 are an error.
+func SemverValue(tree *peg.ParseTree) (Version, error) {
+	var v Version
+	if tree == nil {
+		return v, unexpected("semver", tree)
+	}
+	for _, part := range []struct {
+		typ string
+		n   *uint64
+	}{{"major", &v.Major}, {"minor", &v.Minor}, {"patch", &v.Patch}} {
+		num, ok := leaf(tree, part.typ)
+		if !ok {
+			return v, unexpected("semver", tree)
+		}
+		n, err := strconv.ParseUint(string(num.Data), 10, 64)
+		if err != nil {
+			return v, err
+		}
+		*part.n = n
+	}
+	for _, id := range collect(tree, func(t *peg.ParseTree) bool {
+		return t.Data != nil && (t.Type == "preid" || t.Type == "buildid")
+	}) {
+		if id.Type == "preid" {
+			v.Prerelease = append(v.Prerelease, string(id.Data))
+		} else {
+			v.Build = append(v.Build, string(id.Data))
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,79 @@
+package grammars
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSemver(t *testing.T) {
+	table := []struct {
+		src string
+		exp Version
+	}{
+		{"0.0.0", Version{}},
+		{"1.2.3", Version{Major: 1, Minor: 2, Patch: 3}},
+		{"10.20.30-alpha.1", Version{Major: 10, Minor: 20, Patch: 30, Prerelease: []string{"alpha", "1"}}},
+		{"1.0.0+build.0042", Version{Major: 1, Build: []string{"build", "0042"}}},
+		{"1.0.0-0A.is.legal+x-y", Version{Major: 1, Prerelease: []string{"0A", "is", "legal"}, Build: []string{"x-y"}}},
+		{"1.0.0--", Version{Major: 1, Prerelease: []string{"-"}}},
+	}
+	for _, tc := range table {
+		got, err := ParseSemver(tc.src)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("%s: got %#v, expected %#v", tc.src, got, tc.exp)
+		}
+		if s := got.String(); s != tc.src {
+			t.Errorf("%s: formatted as %s", tc.src, s)
+		}
+	}
+}
+
+func TestSemverErrors(t *testing.T) {
+	for _, src := range []string{"", "1", "1.2", "01.2.3", "1.2.3-", "1.2.3-01", "1.2.3+", "1.2.3-a..b", "v1.2.3", "1.2.3 ", "99999999999999999999.0.0"} {
+		if v, err := ParseSemver(src); err == nil {
+			t.Errorf("%s: expected error, got %v", src, v)
+		}
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	// The precedence example of Semantic Versioning 2.0.0, in order.
+	order := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"2.0.0",
+		"2.1.0",
+		"2.1.1",
+	}
+	for i, a := range order {
+		for j, b := range order {
+			va, err := ParseSemver(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vb, err := ParseSemver(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exp := compareUint(uint64(i), uint64(j))
+			if c := va.Compare(vb); c != exp {
+				t.Errorf("%s vs %s: got %d, expected %d", a, b, c, exp)
+			}
+		}
+	}
+	a, _ := ParseSemver("1.0.0+a")
+	b, _ := ParseSemver("1.0.0+b")
+	if c := a.Compare(b); c != 0 {
+		t.Errorf("build metadata changed precedence: %d", c)
+	}
+}
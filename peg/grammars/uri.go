@@ -0,0 +1,118 @@
+package grammars
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// URIGrammar is the URI syntax of RFC 3986, without its relative
+// references. IP literals are checked for their characters only.
+const URIGrammar = `uri       <- scheme ':' hier ('?' query)? ('#' fragment)? end
+hier      <- ('//' authority abempty) / path
+authority <- (userinfo '@')? host (':' port)?
+scheme    <- ~'[A-Za-z][A-Za-z0-9+.\-]*'
+userinfo  <- ~'(?:[A-Za-z0-9\-._~!$&\'()*+,;=:]|%[0-9A-Fa-f]{2})*'
+host      <- ~'\[(?:[0-9A-Fa-f:.]+|v[0-9A-Fa-f]+\.[A-Za-z0-9\-._~!$&\'()*+,;=:]+)\]|(?:[A-Za-z0-9\-._~!$&\'()*+,;=]|%[0-9A-Fa-f]{2})*'
+port      <- ~'[0-9]*'
+abempty   <- ~'(?:/(?:[A-Za-z0-9\-._~!$&\'()*+,;=:@]|%[0-9A-Fa-f]{2})*)*'
+path      <- ~'(?:[A-Za-z0-9\-._~!$&\'()*+,;=:@/]|%[0-9A-Fa-f]{2})*'
+query     <- ~'(?:[A-Za-z0-9\-._~!$&\'()*+,;=:@/?]|%[0-9A-Fa-f]{2})*'
+fragment  <- ~'(?:[A-Za-z0-9\-._~!$&\'()*+,;=:@/?]|%[0-9A-Fa-f]{2})*'
+end       <- !~'(?s).'
+`
+
+var uriLanguage = lazy("URI", URIGrammar)
+
+// URI returns the Language of URIGrammar.
+func URI() *peg.Language {
+	return uriLanguage()
+}
+
+// ParseURI parses src as a URI and returns it, as URIValue.
+func ParseURI(src string) (*url.URL, error) {
+	tree, err := URI().ParseString(src)
+	if err != nil {
+		return nil, err
+	}
+	return URIValue(tree)
+}
+
+// URIValue converts a tree of the URI Language into a url.URL, setting
+// its fields as url.Parse does for the same text. In particular, the path of a
+// URI with neither an authority nor a leading slash is its Opaque
+// part, and the Host includes the port.
+func URIValue(tree *peg.ParseTree) (*url.URL, error) {
+	if tree == nil {
+		return nil, unexpected("URI", tree)
+	}
+	scheme, ok := leaf(tree, "scheme")
+	if !ok {
+		return nil, unexpected("URI", tree)
+	}
+	u := &url.URL{Scheme: strings.ToLower(string(scheme.Data))}
+	if host, ok := leaf(tree, "host"); ok {
+		h, err := url.PathUnescape(string(host.Data))
+		if err != nil {
+			return nil, err
+		}
+		u.Host = h
+		if port, ok := leaf(tree, "port"); ok {
+			u.Host += ":" + string(port.Data)
+		}
+		if user, ok := leaf(tree, "userinfo"); ok {
+			info := string(user.Data)
+			name, password, hasPassword := info, "", false
+			if i := strings.IndexByte(info, ':'); i >= 0 {
+				name, password, hasPassword = info[:i], info[i+1:], true
+			}
+			if name, err = url.PathUnescape(name); err != nil {
+				return nil, err
+			}
+			if password, err = url.PathUnescape(password); err != nil {
+				return nil, err
+			}
+			if hasPassword {
+				u.User = url.UserPassword(name, password)
+			} else {
+				u.User = url.User(name)
+			}
+		}
+	}
+	path, ok := leaf(tree, "abempty")
+	if !ok {
+		path, ok = leaf(tree, "path")
+	}
+	if ok {
+		p := string(path.Data)
+		if u.Host == "" && u.User == nil && path.Type == "path" && !strings.HasPrefix(p, "/") {
+			u.Opaque = p
+		} else {
+			unescaped, err := url.PathUnescape(p)
+			if err != nil {
+				return nil, err
+			}
+			u.Path = unescaped
+			if u.EscapedPath() != p {
+				u.RawPath = p
+			}
+		}
+	}
+	if query, ok := leaf(tree, "query"); ok {
+		u.RawQuery = string(query.Data)
+		u.ForceQuery = u.RawQuery == ""
+	}
+	if fragment, ok := leaf(tree, "fragment"); ok {
+		f := string(fragment.Data)
+		unescaped, err := url.PathUnescape(f)
+		if err != nil {
+			return nil, err
+		}
+		u.Fragment = unescaped
+		if u.EscapedFragment() != f {
+			u.RawFragment = f
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,48 @@
+package peg
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An Importer locates the grammars named by import statements.
+//
+//	import "common.peg" as c
+//
+// makes every rule of common.peg available as c.rule. Without an
+// alias the imported rules share the namespace of the importing
+// grammar. Either way, a rule defined by the importing grammar
+// overrides an imported rule of the same (qualified) name, including
+// for references made from within the imported grammar.
+type Importer interface {
+	Import(path string) (io.ReadCloser, error)
+}
+
+// DirImporter resolves import paths relative to a directory.
+type DirImporter string
+
+func (d DirImporter) Import(path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(path)))
+}
+
+// MapImporter resolves import paths from grammars held in memory.
+type MapImporter map[string]string
+
+func (m MapImporter) Import(path string) (io.ReadCloser, error) {
+	grammar, ok := m[path]
+	if !ok {
+		return nil, &os.PathError{Op: "import", Path: path, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(strings.NewReader(grammar)), nil
+}
+
+// WithImporter sets the Importer used to resolve import statements.
+// Grammars containing imports fail to compile without one.
+func WithImporter(imp Importer) ParserOption {
+	return func(c *config) {
+		c.importer = imp
+	}
+}
@@ -0,0 +1,113 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+var commonGrammar = MapImporter{
+	"common.peg": "number <- digit+\ndigit <- ~'[0-9]'\nname <- ~'[a-z]+'",
+	"hex.peg":    "import \"common.peg\" as c\nvalue <- '0x' c.number\nc.digit <- ~'[0-9a-f]'",
+	"loop.peg":   "import \"loop.peg\"\nx <- 'x'",
+	"a.peg":      "name <- 'a'",
+	"b.peg":      "name <- 'b'",
+}
+
+type ImportTest struct {
+	language string
+	input    string
+	exp      *ParseTree
+}
+
+var importTestTable = []ImportTest{
+	ImportTest{
+		"import \"common.peg\" as c\nprgm <- c.name '=' c.number",
+		"x=12",
+		&ParseTree{Type: "prgm", Children: []*ParseTree{
+			&ParseTree{Type: "c.name", Data: []byte("x")},
+			&ParseTree{Type: "prgm", Data: []byte("=")},
+			&ParseTree{Type: "c.digit+", Children: []*ParseTree{
+				&ParseTree{Type: "c.digit", Data: []byte("1")},
+				&ParseTree{Type: "c.digit", Data: []byte("2")},
+			}},
+		}},
+	},
+	ImportTest{
+		"import \"common.peg\"\nprgm <- number",
+		"7",
+		&ParseTree{Type: "digit+", Children: []*ParseTree{
+			&ParseTree{Type: "digit", Data: []byte("7")},
+		}},
+	},
+	ImportTest{
+		"prgm <- h.value\nimport \"hex.peg\" as h",
+		"0xff",
+		&ParseTree{Type: "h.value", Children: []*ParseTree{
+			&ParseTree{Type: "h.value", Data: []byte("0x")},
+			&ParseTree{Type: "h.c.digit+", Children: []*ParseTree{
+				&ParseTree{Type: "h.c.digit", Data: []byte("f")},
+				&ParseTree{Type: "h.c.digit", Data: []byte("f")},
+			}},
+		}},
+	},
+	ImportTest{
+		"import \"hex.peg\" as h\nprgm <- h.value\nh.c.digit <- '1'",
+		"0x11",
+		&ParseTree{Type: "h.value", Children: []*ParseTree{
+			&ParseTree{Type: "h.value", Data: []byte("0x")},
+			&ParseTree{Type: "h.c.digit+", Children: []*ParseTree{
+				&ParseTree{Type: "h.c.digit", Data: []byte("1")},
+				&ParseTree{Type: "h.c.digit", Data: []byte("1")},
+			}},
+		}},
+	},
+	ImportTest{
+		"import \"a.peg\"\nprgm <- name\nname <- 'z'",
+		"z",
+		&ParseTree{Type: "name", Data: []byte("z")},
+	},
+}
+
+func TestImportTable(t *testing.T) {
+	for _, tc := range importTestTable {
+		lang, err := NewParser(strings.NewReader(tc.language), WithImporter(commonGrammar))
+		if err != nil {
+			t.Error(tc.language)
+			t.Error(err)
+			continue
+		}
+
+		tree, err := lang.ParseString(tc.input)
+		if err != nil {
+			t.Error(tc.language)
+			t.Error(err)
+			continue
+		}
+
+		if err := treeCompare(tree, tc.exp); err != nil {
+			t.Error(tc.language)
+			t.Error(err)
+		}
+	}
+}
+
+var importErrorTable = []string{
+	"import \"common.peg\" as c\nimport \"a.peg\" as c\nprgm <- c.name",
+	"import \"a.peg\"\nimport \"b.peg\"\nprgm <- name",
+	"import \"common.peg\" as c\nprgm <- c.number\nc.letter <- 'a'",
+	"import \"loop.peg\"\nprgm <- x",
+	"import \"missing.peg\"\nprgm <- x",
+	"import \"common.peg\" as\nprgm <- x",
+}
+
+func TestImportErrors(t *testing.T) {
+	for _, grammar := range importErrorTable {
+		if _, err := NewParser(strings.NewReader(grammar), WithImporter(commonGrammar)); err == nil {
+			t.Errorf("expected error for grammar:\n%s", grammar)
+		}
+	}
+
+	if _, err := NewParser(strings.NewReader("import \"a.peg\"\nprgm <- name")); err == nil {
+		t.Error("expected error when importing without an Importer")
+	}
+}
@@ -0,0 +1,626 @@
+// Code generated by GenerateAST. DO NOT EDIT.
+
+package calcast
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// Node is a node of the tree Convert builds.
+type Node interface {
+	// Tree returns the parse tree the node was converted from.
+	Tree() *peg.ParseTree
+	// Children returns the nodes in the fields of the node, in the
+	// order their trees appear in the input.
+	Children() []Node
+	// Accept calls the method of v for the type of the node.
+	Accept(v Visitor)
+}
+
+// Visitor has a method for each type of Node.
+type Visitor interface {
+	VisitProgram(n *Program)
+	VisitAssign(n *Assign)
+	VisitPrint(n *Print)
+	VisitExpr(n *Expr)
+	VisitTerm(n *Term)
+	VisitNeg(n *Neg)
+	VisitCall(n *Call)
+	VisitAtom(n *Atom)
+	VisitNumber(n *Number)
+	VisitIdent(n *Ident)
+	VisitToken(n *Token)
+}
+
+// Walk calls fn for n and, while fn returns true, for the
+// children of each node it is called for, depth first.
+func Walk(n Node, fn func(Node) bool) {
+	if fn(n) {
+		for _, c := range n.Children() {
+			Walk(c, fn)
+		}
+	}
+}
+
+// Convert converts a tree built by rule program.
+func Convert(tree *peg.ParseTree) (*Program, error) {
+	return convertProgram(tree)
+}
+
+// Token is a labeled terminal.
+type Token struct {
+	tree *peg.ParseTree
+	Text string
+}
+
+func (n *Token) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Token) Children() []Node {
+	return nil
+}
+
+func (n *Token) Accept(v Visitor) {
+	v.VisitToken(n)
+}
+
+// Program is the node of rule program.
+type Program struct {
+	tree *peg.ParseTree
+	Stmt []Stmt
+}
+
+func (n *Program) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Program) Children() []Node {
+	var c []Node
+	for _, x := range n.Stmt {
+		c = append(c, x)
+	}
+	return c
+}
+
+func (n *Program) Accept(v Visitor) {
+	v.VisitProgram(n)
+}
+
+// Stmt is a node of rule stmt: one of Assign or Print.
+type Stmt interface {
+	Node
+	isStmt()
+}
+
+// Assign is the node of rule assign.
+type Assign struct {
+	tree  *peg.ParseTree
+	Name  *Ident
+	Value *Expr
+}
+
+func (n *Assign) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Assign) Children() []Node {
+	var c []Node
+	if n.Name != nil {
+		c = append(c, n.Name)
+	}
+	if n.Value != nil {
+		c = append(c, n.Value)
+	}
+	return inTreeOrder(n.tree, c)
+}
+
+func (n *Assign) Accept(v Visitor) {
+	v.VisitAssign(n)
+}
+
+func (*Assign) isStmt() {}
+
+// Print is the node of rule print.
+type Print struct {
+	tree *peg.ParseTree
+	Args []*Expr
+}
+
+func (n *Print) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Print) Children() []Node {
+	var c []Node
+	for _, x := range n.Args {
+		c = append(c, x)
+	}
+	return c
+}
+
+func (n *Print) Accept(v Visitor) {
+	v.VisitPrint(n)
+}
+
+func (*Print) isStmt() {}
+
+// Expr is the node of rule expr.
+type Expr struct {
+	tree  *peg.ParseTree
+	Left  *Term
+	Op    []*Token
+	Right []*Term
+}
+
+func (n *Expr) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Expr) Children() []Node {
+	var c []Node
+	if n.Left != nil {
+		c = append(c, n.Left)
+	}
+	for _, x := range n.Op {
+		c = append(c, x)
+	}
+	for _, x := range n.Right {
+		c = append(c, x)
+	}
+	return inTreeOrder(n.tree, c)
+}
+
+func (n *Expr) Accept(v Visitor) {
+	v.VisitExpr(n)
+}
+
+// Term is the node of rule term.
+type Term struct {
+	tree  *peg.ParseTree
+	Left  Factor
+	Op    []*Token
+	Right []Factor
+}
+
+func (n *Term) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Term) Children() []Node {
+	var c []Node
+	if n.Left != nil {
+		c = append(c, n.Left)
+	}
+	for _, x := range n.Op {
+		c = append(c, x)
+	}
+	for _, x := range n.Right {
+		c = append(c, x)
+	}
+	return inTreeOrder(n.tree, c)
+}
+
+func (n *Term) Accept(v Visitor) {
+	v.VisitTerm(n)
+}
+
+// Factor is a node of rule factor: one of Neg, Call or Atom.
+type Factor interface {
+	Node
+	isFactor()
+}
+
+// Neg is the node of rule neg.
+type Neg struct {
+	tree    *peg.ParseTree
+	Operand Factor
+}
+
+func (n *Neg) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Neg) Children() []Node {
+	var c []Node
+	if n.Operand != nil {
+		c = append(c, n.Operand)
+	}
+	return c
+}
+
+func (n *Neg) Accept(v Visitor) {
+	v.VisitNeg(n)
+}
+
+func (*Neg) isFactor() {}
+
+// Call is the node of rule call.
+type Call struct {
+	tree *peg.ParseTree
+	Fn   *Ident
+	Args []*Expr
+}
+
+func (n *Call) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Call) Children() []Node {
+	var c []Node
+	if n.Fn != nil {
+		c = append(c, n.Fn)
+	}
+	for _, x := range n.Args {
+		c = append(c, x)
+	}
+	return inTreeOrder(n.tree, c)
+}
+
+func (n *Call) Accept(v Visitor) {
+	v.VisitCall(n)
+}
+
+func (*Call) isFactor() {}
+
+// Atom is the node of rule atom.
+type Atom struct {
+	tree  *peg.ParseTree
+	Value Node
+	Inner *Expr
+}
+
+func (n *Atom) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Atom) Children() []Node {
+	var c []Node
+	if n.Value != nil {
+		c = append(c, n.Value)
+	}
+	if n.Inner != nil {
+		c = append(c, n.Inner)
+	}
+	return inTreeOrder(n.tree, c)
+}
+
+func (n *Atom) Accept(v Visitor) {
+	v.VisitAtom(n)
+}
+
+func (*Atom) isFactor() {}
+
+// Var is the node of rule var, an alias of rule ident.
+type Var = Ident
+
+// Number is the text matched by rule number.
+type Number struct {
+	tree *peg.ParseTree
+	Text string
+}
+
+func (n *Number) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Number) Children() []Node {
+	return nil
+}
+
+func (n *Number) Accept(v Visitor) {
+	v.VisitNumber(n)
+}
+
+// Ident is the text matched by rule ident.
+type Ident struct {
+	tree *peg.ParseTree
+	Text string
+}
+
+func (n *Ident) Tree() *peg.ParseTree {
+	return n.tree
+}
+
+func (n *Ident) Children() []Node {
+	return nil
+}
+
+func (n *Ident) Accept(v Visitor) {
+	v.VisitIdent(n)
+}
+
+func convertProgram(t *peg.ParseTree) (*Program, error) {
+	f, err := fields.Match("program", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Program{tree: t}
+	for _, t := range f["stmt"] {
+		c, err := convertStmt(t)
+		if err != nil {
+			return nil, err
+		}
+		n.Stmt = append(n.Stmt, c)
+	}
+	return n, nil
+}
+
+func convertStmt(t *peg.ParseTree) (Stmt, error) {
+	n, err := firstMatch(t, "assign", "print")
+	if err != nil {
+		return nil, err
+	}
+	return n.(Stmt), nil
+}
+
+func convertAssign(t *peg.ParseTree) (*Assign, error) {
+	f, err := fields.Match("assign", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Assign{tree: t}
+	if ts := f["name"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Name, err = convertIdent(t); err != nil {
+			return nil, err
+		}
+	}
+	if ts := f["value"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Value, err = convertExpr(t); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func convertPrint(t *peg.ParseTree) (*Print, error) {
+	f, err := fields.Match("print", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Print{tree: t}
+	for _, t := range f["args"] {
+		c, err := convertExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		n.Args = append(n.Args, c)
+	}
+	return n, nil
+}
+
+func convertExpr(t *peg.ParseTree) (*Expr, error) {
+	f, err := fields.Match("expr", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Expr{tree: t}
+	if ts := f["left"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Left, err = convertTerm(t); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range f["op"] {
+		n.Op = append(n.Op, &Token{tree: t, Text: t.Text()})
+	}
+	for _, t := range f["right"] {
+		c, err := convertTerm(t)
+		if err != nil {
+			return nil, err
+		}
+		n.Right = append(n.Right, c)
+	}
+	return n, nil
+}
+
+func convertTerm(t *peg.ParseTree) (*Term, error) {
+	f, err := fields.Match("term", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Term{tree: t}
+	if ts := f["left"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Left, err = convertFactor(t); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range f["op"] {
+		n.Op = append(n.Op, &Token{tree: t, Text: t.Text()})
+	}
+	for _, t := range f["right"] {
+		c, err := convertFactor(t)
+		if err != nil {
+			return nil, err
+		}
+		n.Right = append(n.Right, c)
+	}
+	return n, nil
+}
+
+func convertFactor(t *peg.ParseTree) (Factor, error) {
+	n, err := firstMatch(t, "neg", "call", "atom")
+	if err != nil {
+		return nil, err
+	}
+	return n.(Factor), nil
+}
+
+func convertNeg(t *peg.ParseTree) (*Neg, error) {
+	f, err := fields.Match("neg", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Neg{tree: t}
+	if ts := f["operand"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Operand, err = convertFactor(t); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func convertCall(t *peg.ParseTree) (*Call, error) {
+	f, err := fields.Match("call", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Call{tree: t}
+	if ts := f["fn"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Fn, err = convertIdent(t); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range f["args"] {
+		c, err := convertExpr(t)
+		if err != nil {
+			return nil, err
+		}
+		n.Args = append(n.Args, c)
+	}
+	return n, nil
+}
+
+func convertAtom(t *peg.ParseTree) (*Atom, error) {
+	f, err := fields.Match("atom", t)
+	if err != nil {
+		return nil, err
+	}
+	n := &Atom{tree: t}
+	if ts := f["value"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Value, err = firstMatch(t, "number", "var"); err != nil {
+			return nil, err
+		}
+	}
+	if ts := f["inner"]; len(ts) > 0 {
+		t := ts[0]
+		if n.Inner, err = convertExpr(t); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func convertNumber(t *peg.ParseTree) (*Number, error) {
+	if _, err := fields.Match("number", t); err != nil {
+		return nil, err
+	}
+	return &Number{tree: t, Text: t.Text()}, nil
+}
+
+func convertIdent(t *peg.ParseTree) (*Ident, error) {
+	if _, err := fields.Match("ident", t); err != nil {
+		return nil, err
+	}
+	return &Ident{tree: t, Text: t.Text()}, nil
+}
+
+// convert converts a tree built by the rule called rule.
+func convert(rule string, t *peg.ParseTree) (Node, error) {
+	switch rule {
+	case "program":
+		return convertProgram(t)
+	case "stmt":
+		return convertStmt(t)
+	case "assign":
+		return convertAssign(t)
+	case "print":
+		return convertPrint(t)
+	case "expr":
+		return convertExpr(t)
+	case "term":
+		return convertTerm(t)
+	case "factor":
+		return convertFactor(t)
+	case "neg":
+		return convertNeg(t)
+	case "call":
+		return convertCall(t)
+	case "atom":
+		return convertAtom(t)
+	case "var":
+		return convertIdent(t)
+	case "number":
+		return convertNumber(t)
+	case "ident":
+		return convertIdent(t)
+	}
+	return nil, errors.New(fmt.Sprintf("no node type for rule %s", rule))
+}
+
+// firstMatch converts t as built by the first of rules that could
+// have built it.
+func firstMatch(t *peg.ParseTree, rules ...string) (Node, error) {
+	for _, rule := range rules {
+		if _, err := fields.Match(rule, t); err == nil {
+			return convert(rule, t)
+		}
+	}
+	if t == nil {
+		return nil, errors.New(fmt.Sprintf("no tree for any of %v", rules))
+	}
+	return nil, errors.New(fmt.Sprintf("at offset %d: tree of type %q does not match any of %v", t.Start, t.Type, rules))
+}
+
+// inTreeOrder sorts nodes, converted from trees within t, into the
+// order their trees appear in t.
+func inTreeOrder(t *peg.ParseTree, nodes []Node) []Node {
+	order := make(map[*peg.ParseTree]int, len(nodes))
+	for _, n := range nodes {
+		order[n.Tree()] = -1
+	}
+	next := 0
+	var walk func(t *peg.ParseTree)
+	walk = func(t *peg.ParseTree) {
+		if _, ok := order[t]; ok {
+			order[t] = next
+			next++
+			return
+		}
+		if t != nil {
+			for _, c := range t.Children {
+				walk(c)
+			}
+		}
+	}
+	walk(t)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return order[nodes[i].Tree()] < order[nodes[j].Tree()]
+	})
+	return nodes
+}
+
+var fields = mustFieldMatcher(&peg.Grammar{Rules: []*peg.Rule{
+	{Name: "program", Expr: &peg.Repetition{Expr: &peg.Ref{Name: "stmt"}, Kind: peg.ZeroOrMore}},
+	{Name: "stmt", Expr: &peg.Choice{Alternatives: []peg.Expr{&peg.Ref{Name: "assign"}, &peg.Ref{Name: "print"}}}},
+	{Name: "assign", Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Literal{Text: "let"}, &peg.Label{Name: "name", Expr: &peg.Ref{Name: "ident"}}, &peg.Literal{Text: "="}, &peg.Label{Name: "value", Expr: &peg.Ref{Name: "expr"}}, &peg.Literal{Text: ";"}}}},
+	{Name: "print", Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Literal{Text: "print"}, &peg.Label{Name: "args", Expr: &peg.Repetition{Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Ref{Name: "expr"}, &peg.Repetition{Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Literal{Text: ","}, &peg.Ref{Name: "expr"}}}, Kind: peg.ZeroOrMore}}}, Kind: peg.Optional}}, &peg.Literal{Text: ";"}}}},
+	{Name: "expr", Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Label{Name: "left", Expr: &peg.Ref{Name: "term"}}, &peg.Repetition{Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Label{Name: "op", Expr: &peg.Choice{Alternatives: []peg.Expr{&peg.Literal{Text: "+"}, &peg.Literal{Text: "-"}}}}, &peg.Label{Name: "right", Expr: &peg.Ref{Name: "term"}}}}, Kind: peg.ZeroOrMore}}}},
+	{Name: "term", Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Label{Name: "left", Expr: &peg.Ref{Name: "factor"}}, &peg.Repetition{Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Label{Name: "op", Expr: &peg.Choice{Alternatives: []peg.Expr{&peg.Literal{Text: "*"}, &peg.Literal{Text: "/"}}}}, &peg.Label{Name: "right", Expr: &peg.Ref{Name: "factor"}}}}, Kind: peg.ZeroOrMore}}}},
+	{Name: "factor", Expr: &peg.Choice{Alternatives: []peg.Expr{&peg.Ref{Name: "neg"}, &peg.Ref{Name: "call"}, &peg.Ref{Name: "atom"}}}},
+	{Name: "neg", Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Literal{Text: "-"}, &peg.Label{Name: "operand", Expr: &peg.Ref{Name: "factor"}}}}},
+	{Name: "call", Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Label{Name: "fn", Expr: &peg.Ref{Name: "ident"}}, &peg.Literal{Text: "("}, &peg.Label{Name: "args", Expr: &peg.Repetition{Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Ref{Name: "expr"}, &peg.Repetition{Expr: &peg.Sequence{Exprs: []peg.Expr{&peg.Literal{Text: ","}, &peg.Ref{Name: "expr"}}}, Kind: peg.ZeroOrMore}}}, Kind: peg.Optional}}, &peg.Literal{Text: ")"}}}},
+	{Name: "atom", Expr: &peg.Choice{Alternatives: []peg.Expr{&peg.Label{Name: "value", Expr: &peg.Choice{Alternatives: []peg.Expr{&peg.Ref{Name: "number"}, &peg.Ref{Name: "var"}}}}, &peg.Sequence{Exprs: []peg.Expr{&peg.Literal{Text: "("}, &peg.Label{Name: "inner", Expr: &peg.Ref{Name: "expr"}}, &peg.Literal{Text: ")"}}}}}},
+	{Name: "var", Expr: &peg.Ref{Name: "ident"}},
+	{Name: "number", Expr: &peg.Regexp{Pattern: "[0-9]+"}},
+	{Name: "ident", Expr: &peg.Regexp{Pattern: "[a-z]+"}},
+	{Name: "_", Expr: &peg.Regexp{Pattern: "\\s+"}},
+}})
+
+func mustFieldMatcher(g *peg.Grammar) *peg.FieldMatcher {
+	m, err := peg.NewFieldMatcher(g)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
@@ -0,0 +1,196 @@
+package calcast
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+func parse(t *testing.T, src string) *Program {
+	grammar, err := ioutil.ReadFile("calc.peg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lang, err := peg.NewParser(strings.NewReader(string(grammar)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := Convert(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prog
+}
+
+// evaluator runs a program, printing into out.
+type evaluator struct {
+	vars  map[string]int
+	stack []int
+	out   []string
+}
+
+func (e *evaluator) push(v int) {
+	e.stack = append(e.stack, v)
+}
+
+func (e *evaluator) pop() int {
+	v := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return v
+}
+
+func (e *evaluator) VisitProgram(n *Program) {
+	for _, stmt := range n.Stmt {
+		stmt.Accept(e)
+	}
+}
+
+func (e *evaluator) VisitAssign(n *Assign) {
+	n.Value.Accept(e)
+	e.vars[n.Name.Text] = e.pop()
+}
+
+func (e *evaluator) VisitPrint(n *Print) {
+	var vals []string
+	for _, arg := range n.Args {
+		arg.Accept(e)
+		vals = append(vals, strconv.Itoa(e.pop()))
+	}
+	e.out = append(e.out, strings.Join(vals, " "))
+}
+
+func (e *evaluator) VisitExpr(n *Expr) {
+	n.Left.Accept(e)
+	for i, op := range n.Op {
+		n.Right[i].Accept(e)
+		r, l := e.pop(), e.pop()
+		if op.Text == "+" {
+			e.push(l + r)
+		} else {
+			e.push(l - r)
+		}
+	}
+}
+
+func (e *evaluator) VisitTerm(n *Term) {
+	n.Left.Accept(e)
+	for i, op := range n.Op {
+		n.Right[i].Accept(e)
+		r, l := e.pop(), e.pop()
+		if op.Text == "*" {
+			e.push(l * r)
+		} else {
+			e.push(l / r)
+		}
+	}
+}
+
+func (e *evaluator) VisitNeg(n *Neg) {
+	n.Operand.Accept(e)
+	e.push(-e.pop())
+}
+
+// VisitCall knows one function, max.
+func (e *evaluator) VisitCall(n *Call) {
+	max := 0
+	for i, arg := range n.Args {
+		arg.Accept(e)
+		if v := e.pop(); i == 0 || v > max {
+			max = v
+		}
+	}
+	e.push(max)
+}
+
+func (e *evaluator) VisitAtom(n *Atom) {
+	if n.Value != nil {
+		n.Value.Accept(e)
+	} else {
+		n.Inner.Accept(e)
+	}
+}
+
+func (e *evaluator) VisitNumber(n *Number) {
+	v, _ := strconv.Atoi(n.Text)
+	e.push(v)
+}
+
+func (e *evaluator) VisitIdent(n *Ident) {
+	e.push(e.vars[n.Text])
+}
+
+func (e *evaluator) VisitToken(n *Token) {}
+
+func TestConvert(t *testing.T) {
+	prog := parse(t, "let x = 1 + 2*3; let y = -x; print x, (x - 4) * 2, y; print max(x, 10, 3) - 1; print;")
+	if len(prog.Stmt) != 5 {
+		t.Fatalf("got %d statements, expected 5", len(prog.Stmt))
+	}
+	assign, ok := prog.Stmt[0].(*Assign)
+	if !ok {
+		t.Fatalf("got %T, expected an *Assign", prog.Stmt[0])
+	}
+	if assign.Name.Text != "x" || len(assign.Value.Op) != 1 || assign.Value.Op[0].Text != "+" {
+		t.Errorf("got assignment %q", assign.Tree().Bytes())
+	}
+	if neg, ok := prog.Stmt[1].(*Assign).Value.Left.Left.(*Neg); !ok || neg.Operand.Tree().Text() != "x" {
+		t.Errorf("got %q for -x", prog.Stmt[1].(*Assign).Value.Tree().Text())
+	}
+
+	e := &evaluator{vars: make(map[string]int)}
+	prog.Accept(e)
+	if exp := []string{"7 6 -7", "9", ""}; !reflect.DeepEqual(e.out, exp) {
+		t.Errorf("got output %q, expected %q", e.out, exp)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	prog := parse(t, "let a = b + max(c, (d)); print a;")
+	var names []string
+	Walk(prog, func(n Node) bool {
+		if id, ok := n.(*Ident); ok {
+			names = append(names, id.Text)
+		}
+		_, isCall := n.(*Call)
+		return !isCall
+	})
+	if exp := []string{"a", "b", "a"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("got %q, expected %q", names, exp)
+	}
+
+	// Children come in the order of the input, not of the fields.
+	prog = parse(t, "print 1 + 2 - 3 * 4;")
+	var texts []string
+	Walk(prog, func(n Node) bool {
+		switch n := n.(type) {
+		case *Number:
+			texts = append(texts, n.Text)
+		case *Token:
+			texts = append(texts, n.Text)
+		}
+		return true
+	})
+	if exp := []string{"1", "+", "2", "-", "3", "*", "4"}; !reflect.DeepEqual(texts, exp) {
+		t.Errorf("got %q, expected %q", texts, exp)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	for _, tree := range []*peg.ParseTree{
+		nil,
+		{Type: "ident", Data: []byte("x")},
+		{Type: "stmt*", Children: []*peg.ParseTree{{Type: "number", Data: []byte("1")}}},
+	} {
+		if prog, err := Convert(tree); err == nil {
+			t.Errorf("expected an error converting %v, got %v", tree, prog)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package calcast is the code GenerateAST writes for calc.peg, kept
+// as an example and to test that the code compiles and works.
+package calcast
+
+//go:generate go run ../../../cmd/pegast -pkg calcast -o ast.go calc.peg
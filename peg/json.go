@@ -0,0 +1,94 @@
+package peg
+
+import "encoding/json"
+
+// jsonTree is the JSON form of a ParseTree. Text is a pointer so that
+// a leaf matching nothing keeps its empty text, apart from inner trees
+// which have none.
+type jsonTree struct {
+	Type     string      `json:"type"`
+	Text     *string     `json:"text,omitempty"`
+	Start    int         `json:"start"`
+	End      int         `json:"end"`
+	Trivia   []*jsonTree `json:"trivia,omitempty"`
+	Children []*jsonTree `json:"children,omitempty"`
+	Trailing []*jsonTree `json:"trailing,omitempty"`
+}
+
+// MarshalJSON encodes the tree as a JSON object with the fields type,
+// text, start, end, trivia, children and trailing, in that order.
+// Text is left out for trees with no Data, and the lists when empty.
+// Data that is not valid UTF-8 cannot be represented, and has its
+// invalid bytes replaced by U+FFFD.
+func (p *ParseTree) MarshalJSON() ([]byte, error) {
+	return json.Marshal(toJSONTree(p))
+}
+
+// UnmarshalJSON decodes a tree encoded by MarshalJSON.
+func (p *ParseTree) UnmarshalJSON(data []byte) error {
+	var t jsonTree
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+	*p = *fromJSONTree(&t)
+	return nil
+}
+
+func toJSONTree(p *ParseTree) *jsonTree {
+	if p == nil {
+		return nil
+	}
+	t := &jsonTree{
+		Type:     p.Type,
+		Start:    p.Start,
+		End:      p.End,
+		Trivia:   toJSONTrees(p.Trivia),
+		Children: toJSONTrees(p.Children),
+		Trailing: toJSONTrees(p.Trailing),
+	}
+	if p.Data != nil {
+		text := string(p.Data)
+		t.Text = &text
+	}
+	return t
+}
+
+func toJSONTrees(trees []*ParseTree) []*jsonTree {
+	if len(trees) == 0 {
+		return nil
+	}
+	list := make([]*jsonTree, len(trees))
+	for i, tree := range trees {
+		list[i] = toJSONTree(tree)
+	}
+	return list
+}
+
+func fromJSONTree(t *jsonTree) *ParseTree {
+	if t == nil {
+		return nil
+	}
+	p := &ParseTree{
+		Type:     t.Type,
+		Start:    t.Start,
+		End:      t.End,
+		Trivia:   fromJSONTrees(t.Trivia),
+		Children: fromJSONTrees(t.Children),
+		Trailing: fromJSONTrees(t.Trailing),
+	}
+	if t.Text != nil {
+		p.Data = []byte(*t.Text)
+	}
+	return p
+}
+
+func fromJSONTrees(list []*jsonTree) []*ParseTree {
+	if len(list) == 0 {
+		return nil
+	}
+	trees := make([]*ParseTree, len(list))
+	for i, t := range list {
+		trees[i] = fromJSONTree(t)
+	}
+	return trees
+}
@@ -0,0 +1,44 @@
+package peg
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTreeJSON(t *testing.T) {
+	lang, err := NewParser(strings.NewReader("%skip _\nlist <- item (',' item)* end\nitem <- ~'[a-z]*'\nend <- !~'.'\n_ <- ~'[ \\n]+'"), Lossless())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString(" a, ,b \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *ParseTree
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tree) {
+		t.Errorf("round trip through %s changed the tree:\n%s", data, got.SExpr())
+	}
+
+	leaf := &ParseTree{Type: "x", Data: []byte{}, Start: 3, End: 3}
+	data, err = json.Marshal([]*ParseTree{leaf, {Type: "y\"", Children: []*ParseTree{leaf}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `[{"type":"x","text":"","start":3,"end":3},{"type":"y\"","start":0,"end":0,"children":[{"type":"x","text":"","start":3,"end":3}]}]`
+	if string(data) != exp {
+		t.Errorf("got %s, expected %s", data, exp)
+	}
+
+	if err := json.Unmarshal([]byte(`{"type": 1}`), new(ParseTree)); err == nil {
+		t.Error("expected error for a numeric type")
+	}
+}
@@ -1,6 +1,7 @@
 package peg
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,26 +12,33 @@ import (
 type Lexeme struct {
 	Name         string
 	Dependencies []*Lexeme
-	isResolved   bool // whether the deps are resolved.
 	// Lexer returns the parse tree, an error and the number of input bytes consumed.
 	Lexer func(*Source, int) (*ParseTree, error, int)
-}
-
-func (l *Lexeme) dumpTree(indent string) string {
-	s := fmt.Sprintln(indent, l.Name, l.isResolved)
-	for _, child := range l.Dependencies {
-		s += child.dumpTree(indent + " ")
-	}
-	return s
-}
 
-func (l *Lexeme) String() string {
-	return l.dumpTree("")
+	// match is Lexer for the lexemes built by this package, building
+	// its trees in the arena of the Source instead of as ParseTrees.
+	match matchFunc
+	kind  lexemeKind // which constructor built the lexeme, for printing
+	text  string     // the literal, regexp or rule matched by terminals and references
 }
 
 // Language defines lexing and parsing capabilities for a peg defined language.
+//
+// A Language is safe for concurrent use by multiple goroutines. It is
+// not modified after it has been compiled: each parse keeps its state
+// in a Source of its own, and the rules are shared read-only. Copies
+// made by WithTracer and WithLimits share the rules too. A Tracer
+// given to a Language parsing on several goroutines at once is called
+// from all of them, and so must be safe for concurrent use itself.
 type Language struct {
-	root *Lexeme
+	root       *Lexeme
+	rules      *ruleTable
+	skip       *Lexeme // trivia rule declared with %skip, if any
+	keepTrivia bool
+	lossless   bool
+	grammar    *Grammar // the grammar compiled, for printing
+	tracer     Tracer
+	limits     Limits
 }
 
 // ParseString is identical to Parse, but operates on string input.
@@ -39,183 +47,441 @@ func (l *Language) ParseString(source string) (*ParseTree, error) {
 }
 
 // Parse attemps to turn the input reader into a valid parse tree.
+// Rules nest at most DefaultMaxDepth deep unless the language was given
+// other Limits; the number of steps and nodes is unbounded, so input
+// from untrusted sources should be parsed by ParseContext on a language
+// returned by WithLimits.
 func (l *Language) Parse(source io.Reader) (*ParseTree, error) {
+	return l.parse(context.Background(), l.root, source)
+}
+
+// ParseRuleString is identical to ParseRule, but operates on string input.
+func (l *Language) ParseRuleString(name, source string) (*ParseTree, error) {
+	return l.ParseRule(name, strings.NewReader(source))
+}
+
+// ParseRule is like Parse, but uses the named rule as the entry point
+// instead of the language's start rule.
+func (l *Language) ParseRule(name string, source io.Reader) (*ParseTree, error) {
+	i, ok := l.rules.index[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no such rule: %s", name))
+	}
+	return l.parse(context.Background(), l.rules.lexemes[i], source)
+}
+
+func (l *Language) parse(ctx context.Context, lex *Lexeme, source io.Reader) (*ParseTree, error) {
 	s, err := NewSource(source)
 	if err != nil {
 		return nil, err
 	}
-	tree, err, _ := l.root.Lexer(s, 0)
+	return l.parseTree(ctx, lex, s)
+}
+
+// parseTree parses s, which must be new, into ParseTrees. The arena
+// the trees are first built in is reused by later parses.
+func (l *Language) parseTree(ctx context.Context, lex *Lexeme, s *Source) (*ParseTree, error) {
+	arena := arenas.Get().(*[]flatNode)
+	s.arena = (*arena)[:0]
+	root, err := l.parseSource(ctx, lex, s)
+	var tree *ParseTree
+	if err == nil {
+		tree = s.tree(root)
+	}
+	if cap(s.arena) <= maxPooledArena {
+		*arena = s.arena
+		arenas.Put(arena)
+	}
 	return tree, err
 }
 
+// parseSource matches lex against the whole of s, which must be new,
+// returning the index of the tree in the arena of s.
+func (l *Language) parseSource(ctx context.Context, lex *Lexeme, s *Source) (int32, error) {
+	if max := s.maxFlat(); len(s.buf) > max {
+		return 0, errors.New(fmt.Sprintf("input of %d bytes exceeds the maximum of %d", len(s.buf), max))
+	}
+	s.rules = l.rules
+	s.skip = l.skip
+	s.keepTrivia = l.keepTrivia
+	s.lossless = l.lossless
+	s.tracer = l.tracer
+	s.limits = l.limits.withDefaults()
+	s.ctx, s.done = ctx, ctx.Done()
+	tree, err, n := s.match(lex, 0)
+	if s.abort != nil {
+		return 0, s.abort
+	}
+	if err != nil {
+		return 0, err
+	}
+	var children childList
+	children.add(s, tree, lex.Name, 0, n)
+	trailing, m := s.skipTrivia(n)
+	if s.lossless && n+m < len(s.buf) {
+		trailing = s.join(trailing, s.leaf("", n+m, len(s.buf), 0))
+	}
+	if trees, count, trivia := children.finish(s); count > 0 {
+		tree = trees
+	} else if trivia != 0 {
+		tree = s.inner(lex.Name, n, 0, trivia)
+	}
+	if tree != 0 && trailing != 0 {
+		s.arena[tree].trailing = s.join(s.arena[tree].trailing, trailing)
+	}
+	return tree, nil
+}
+
+// A matchError reports that a lexeme did not match. Most are dropped
+// by backtracking, so the message is only formatted when asked for.
+type matchError struct {
+	format string // taking what was expected and the input near the failure
+	want   string
+	near   []byte
+}
+
+func (e *matchError) Error() string {
+	return fmt.Sprintf(e.format, e.want, e.near)
+}
+
+// errNoMatch stands for the errors of attempts whose errors are
+// dropped, so that they are not built at all.
+var errNoMatch = errors.New("no match")
+
+// mismatch returns the error of a lexeme expecting want at pos. The
+// input near pos is copied, as the error may outlive the buffer.
+func (s *Source) mismatch(format, want string, pos int) error {
+	if s.quiet > 0 && s.tracer == nil {
+		return errNoMatch
+	}
+	end := pos + 10
+	if end > len(s.buf) {
+		end = len(s.buf)
+	}
+	return &matchError{format: format, want: want, near: append([]byte(nil), s.buf[pos:end]...)}
+}
+
+// try is match for attempts whose error is dropped, as by
+// alternatives and repetitions: errors within them are never seen,
+// unless by a tracer.
+func (s *Source) try(lex *Lexeme, pos int) (int32, error, int) {
+	s.quiet++
+	tree, err, n := s.match(lex, pos)
+	s.quiet--
+	return tree, err, n
+}
+
+// A matchFunc returns the index of the tree it built in the arena of
+// the Source, or 0 for none, an error and the number of input bytes
+// consumed.
+type matchFunc func(s *Source, pos int) (int32, error, int)
+
+// built completes a lexeme built by this package, which matches with
+// match. Its Lexer converts the trees match builds into ParseTrees.
+func built(l *Lexeme, match matchFunc) *Lexeme {
+	l.match = match
+	l.Lexer = func(s *Source, pos int) (*ParseTree, error, int) {
+		tree, err, n := match(s, pos)
+		return s.tree(tree), err, n
+	}
+	return l
+}
+
 func NewLiteralLexer(typ, valid string) *Lexeme {
 	vbytes := []byte(valid)
-	return &Lexeme{
+	return built(&Lexeme{
+		kind: literalKind,
+		text: valid,
 		Name: typ,
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			match := s.ConsumeLiteral(vbytes, pos)
-			if match == nil {
-				neighborhood := pos
-				neighborEnd := pos + 10
-				if neighborEnd > len(s.buf) {
-					neighborEnd = len(s.buf)
-				}
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		trivia, skipped := s.skipTrivia(pos)
+		pos += skipped
+		match := s.ConsumeLiteral(vbytes, pos)
+		if match == nil {
+			s.release(mark)
+			return 0, s.mismatch("expected literal: %q at %q", valid, pos), 0
+		} else {
+			s.nodes++
+			return s.leaf(typ, pos, pos+len(match), trivia), nil, skipped + len(match)
+		}
+	})
+}
 
-				return nil, errors.New(fmt.Sprintf("expected literal: %q at %q", valid, s.buf[neighborhood:neighborEnd])), 0
-			} else {
-				return &ParseTree{
-					Type: typ,
-					Data: vbytes,
-				}, nil, len(match)
-			}
-		},
-	}
+// NewFoldLiteralLexer is like NewLiteralLexer, but matches valid
+// ignoring case. The resulting tree holds the text as it appeared
+// in the source.
+func NewFoldLiteralLexer(typ, valid string) *Lexeme {
+	vbytes := []byte(valid)
+	return built(&Lexeme{
+		kind: foldKind,
+		text: valid,
+		Name: typ,
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		trivia, skipped := s.skipTrivia(pos)
+		pos += skipped
+		match := s.ConsumeLiteralFold(vbytes, pos)
+		if match == nil {
+			s.release(mark)
+			return 0, s.mismatch("expected literal: %q (ignoring case) at %q", valid, pos), 0
+		} else {
+			s.nodes++
+			return s.leaf(typ, pos, pos+len(match), trivia), nil, skipped + len(match)
+		}
+	})
 }
 
 func NewRegexpLexer(typ string, valid *regexp.Regexp) *Lexeme {
-	return &Lexeme{
+	pattern := valid.String()
+	return built(&Lexeme{
+		kind: regexpKind,
+		text: pattern,
 		Name: typ,
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			match := s.Consume(valid, pos)
-			if match == nil {
-				neighborhood := pos
-				neighborEnd := pos + 10
-				if neighborEnd > len(s.buf) {
-					neighborEnd = len(s.buf)
-				}
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		trivia, skipped := s.skipTrivia(pos)
+		pos += skipped
+		match := s.Consume(valid, pos)
+		if match == nil {
+			s.release(mark)
+			return 0, s.mismatch("expected regex match: %q at %q", pattern, pos), 0
+		} else {
+			s.nodes++
+			return s.leaf(typ, pos, pos+len(match), trivia), nil, skipped + len(match)
+		}
+	})
+}
 
-				return nil, errors.New(fmt.Sprintf("expected regex match: %q at %q", valid.String(), s.buf[neighborhood:neighborEnd])), 0
-			} else {
-				return &ParseTree{
-					Type: typ,
-					Data: match,
-				}, nil, len(match)
-			}
-		},
-	}
+// newRuleBoundary marks where the lexeme implementing a rule is
+// entered, to enforce the parse's limits and report to its tracer.
+func newRuleBoundary(rule string, lex *Lexeme) *Lexeme {
+	return built(&Lexeme{
+		kind:         boundaryKind,
+		Name:         lex.Name,
+		Dependencies: []*Lexeme{lex},
+	}, func(s *Source, pos int) (int32, error, int) {
+		if err := s.enterRule(pos); err != nil {
+			return 0, err, 0
+		}
+		if s.tracer != nil {
+			s.tracer.Enter(rule, pos, s.depth)
+		}
+		s.depth++
+		tree, err, n := s.match(lex, pos)
+		s.depth--
+		if s.tracer != nil {
+			s.tracer.Exit(rule, pos, s.depth, n, err)
+		}
+		return tree, err, n
+	})
 }
 
+// A ruleTable holds the compiled rules of a Language, in definition
+// order. It is built once by Compile and never modified afterwards,
+// so it is shared by the Languages derived from one another and
+// references into it are plain indexes.
+type ruleTable struct {
+	lexemes []*Lexeme
+	index   map[string]int // rule name to index in lexemes
+}
+
+// NewRuleLexer matches the named rule of the Language being parsed.
+// The rule is looked up when the parse reaches it, so the lexeme may
+// be used in any number of Languages.
 func NewRuleLexer(rule string) *Lexeme {
-	return &Lexeme{
-		Name:  "~" + rule,
-		Lexer: nil,
-	}
+	return built(&Lexeme{
+		kind: ruleKind,
+		text: rule,
+		Name: rule,
+	}, func(s *Source, pos int) (int32, error, int) {
+		if s.rules != nil {
+			if i, ok := s.rules.index[rule]; ok {
+				return s.match(s.rules.lexemes[i], pos)
+			}
+		}
+		return 0, errors.New(fmt.Sprintf("undefined rule %s", rule)), 0
+	})
+}
+
+// newRefLexeme matches rule number i of the rule table, named rule.
+// Its Name is that of the rule's lexeme, which trees built for the
+// reference are named after.
+func newRefLexeme(rule string, i int, name string) *Lexeme {
+	return built(&Lexeme{
+		kind: ruleKind,
+		text: rule,
+		Name: name,
+	}, func(s *Source, pos int) (int32, error, int) {
+		return s.match(s.rules.lexemes[i], pos)
+	})
 }
 
 func NewConcatLexer(name string, deps []*Lexeme) *Lexeme {
-	return &Lexeme{
+	return built(&Lexeme{
+		kind:         concatKind,
 		Name:         name,
 		Dependencies: deps,
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			children := make([]*ParseTree, 0, len(deps))
-			offset := 0
-			for _, dep := range deps {
-				tree, err, l := dep.Lexer(s, pos+offset)
-				if err != nil {
-					return nil, err, 0
-				} else {
-					if tree != nil {
-						children = append(children, tree)
-					}
-					offset += l
-				}
-			}
-			if len(children) == 1 {
-				return children[0], nil, offset
+	}, func(s *Source, pos int) (int32, error, int) {
+		var children childList
+		offset := 0
+		for _, dep := range deps {
+			tree, err, l := s.match(dep, pos+offset)
+			if err != nil {
+				return 0, err, 0
+			} else {
+				children.add(s, tree, dep.Name, pos+offset, l)
+				offset += l
 			}
-			return &ParseTree{Type: name, Data: nil, Children: children}, nil, offset
-		},
-	}
+		}
+		trees, count, trivia := children.finish(s)
+		if count == 1 {
+			return trees, nil, offset
+		}
+		s.nodes++
+		return s.inner(name, pos+offset, trees, trivia), nil, offset
+	})
 }
 
 func NewPlusClosure(lex *Lexeme) *Lexeme {
-	return &Lexeme{
-		Name:         lex.Name + "+",
+	typ := lex.Name + "+"
+	return built(&Lexeme{
+		kind:         plusKind,
+		Name:         typ,
 		Dependencies: []*Lexeme{lex},
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			start := pos
-			resp := &ParseTree{Type: lex.Name + "+"}
-			next, err, off := lex.Lexer(s, pos)
-			if err != nil {
-				return nil, err, 0
-			} else {
-				resp.Children = append(resp.Children, next)
-				pos += off
-				for {
-					next, err, off = lex.Lexer(s, pos)
-					if err != nil {
-						break
-					}
-					resp.Children = append(resp.Children, next)
-					pos += off
+	}, func(s *Source, pos int) (int32, error, int) {
+		start := pos
+		s.nodes++
+		var children childList
+		next, err, off := s.match(lex, pos)
+		if err != nil {
+			return 0, err, 0
+		} else {
+			children.add(s, next, lex.Name, pos, off)
+			pos += off
+			for {
+				mark := s.mark()
+				next, err, off = s.try(lex, pos)
+				if err != nil {
+					s.release(mark)
+					break
 				}
+				children.add(s, next, lex.Name, pos, off)
+				pos += off
 			}
+		}
 
-			return resp, nil, pos - start
-		},
-	}
+		trees, _, trivia := children.finish(s)
+		return s.inner(typ, pos, trees, trivia), nil, pos - start
+	})
 }
 
 func NewStarClosure(lex *Lexeme) *Lexeme {
-	return &Lexeme{
-		Name:         lex.Name + "*",
+	typ := lex.Name + "*"
+	return built(&Lexeme{
+		kind:         starKind,
+		Name:         typ,
 		Dependencies: []*Lexeme{lex},
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			start := pos
-			resp := &ParseTree{Type: lex.Name + "*"}
-			var next *ParseTree
-			var err error
-			var off int
-			for {
-				next, err, off = lex.Lexer(s, pos)
-				if err != nil {
-					break
-				}
-				resp.Children = append(resp.Children, next)
-				pos += off
+	}, func(s *Source, pos int) (int32, error, int) {
+		start := pos
+		s.nodes++
+		var children childList
+		for {
+			mark := s.mark()
+			next, err, off := s.try(lex, pos)
+			if err != nil {
+				s.release(mark)
+				break
 			}
-			return resp, nil, pos - start
-		},
-	}
+			children.add(s, next, lex.Name, pos, off)
+			pos += off
+		}
+		trees, _, trivia := children.finish(s)
+		return s.inner(typ, pos, trees, trivia), nil, pos - start
+	})
 }
 
 func NewOptionClosure(lex *Lexeme) *Lexeme {
-	return &Lexeme{
+	return built(&Lexeme{
+		kind:         optionKind,
 		Name:         lex.Name + "?",
 		Dependencies: []*Lexeme{lex},
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			tree, _, offset := lex.Lexer(s, pos)
-			return tree, nil, offset
-		},
-	}
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		tree, err, offset := s.try(lex, pos)
+		if err != nil {
+			s.release(mark)
+		}
+		return tree, nil, offset
+	})
 }
 
 func NewAlternateLexer(name string, lhs, rhs *Lexeme) *Lexeme {
-	return &Lexeme{
+	return built(&Lexeme{
+		kind:         alternateKind,
 		Name:         name,
 		Dependencies: []*Lexeme{lhs, rhs},
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			tree, err, off := lhs.Lexer(s, pos)
-			if err == nil {
-				return tree, nil, off
-			} else {
-				tree, err, off = rhs.Lexer(s, pos)
-				if err != nil {
-					return nil, err, 0
-				}
-				return tree, nil, off
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		tree, err, off := s.try(lhs, pos)
+		if err == nil {
+			return tree, nil, off
+		} else {
+			s.release(mark)
+			tree, err, off = s.match(rhs, pos)
+			if err != nil {
+				return 0, err, 0
 			}
-		},
-	}
+			return tree, nil, off
+		}
+	})
 }
 
 func NewDiscardLexer(lex *Lexeme) *Lexeme {
-	return &Lexeme{
+	return built(&Lexeme{
+		kind:         discardKind,
 		Name:         lex.Name + "^",
 		Dependencies: []*Lexeme{lex},
-		Lexer: func(s *Source, pos int) (*ParseTree, error, int) {
-			_, _, offset := lex.Lexer(s, pos)
-			return nil, nil, offset
-		},
-	}
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		_, _, offset := s.try(lex, pos)
+		s.release(mark)
+		return 0, nil, offset
+	})
+}
+
+// NewAndPredicate matches wherever lex does, but consumes no input
+// and adds nothing to the parse tree.
+func NewAndPredicate(lex *Lexeme) *Lexeme {
+	return built(&Lexeme{
+		kind:         andKind,
+		Name:         "&" + lex.Name,
+		Dependencies: []*Lexeme{lex},
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		_, err, _ := s.match(lex, pos)
+		s.release(mark)
+		if err != nil {
+			return 0, err, 0
+		}
+		return 0, nil, 0
+	})
+}
+
+// NewNotPredicate matches wherever lex does not, consuming no input
+// and adding nothing to the parse tree.
+func NewNotPredicate(lex *Lexeme) *Lexeme {
+	return built(&Lexeme{
+		kind:         notKind,
+		Name:         "!" + lex.Name,
+		Dependencies: []*Lexeme{lex},
+	}, func(s *Source, pos int) (int32, error, int) {
+		mark := s.mark()
+		_, err, _ := s.try(lex, pos)
+		s.release(mark)
+		if err != nil {
+			return 0, nil, 0
+		}
+		return 0, s.mismatch("unexpected %s at %q", lex.Name, pos), 0
+	})
 }
@@ -1,6 +1,10 @@
 package peg
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -19,3 +23,108 @@ func TestSimpleLanguage(t *testing.T) {
 		t.Errorf("Incorrect type parsed: %s", tree.Type)
 	}
 }
+
+func TestParseRule(t *testing.T) {
+	l, err := NewParser(strings.NewReader("prgm <- name '=' number\nname <- ~'[a-z]+'\nnumber <- digit+\ndigit <- ~'\\d'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := l.ParseRuleString("number", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Type != "digit+" || len(tree.Children) != 2 {
+		t.Errorf("Incorrect tree parsed: %v", tree)
+	}
+
+	if _, err := l.ParseRuleString("name", "42"); err == nil {
+		t.Error("expected name not to match digits")
+	}
+
+	if _, err := l.ParseRuleString("missing", "42"); err == nil {
+		t.Error("expected error for undefined rule")
+	}
+}
+
+func TestStartDirective(t *testing.T) {
+	l, err := NewParser(strings.NewReader("%start number\n\nprgm <- name '=' number\nname <- ~'[a-z]+'\nnumber <- ~'\\d+'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := l.ParseString("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Type != "number" {
+		t.Errorf("Incorrect type parsed: %s", tree.Type)
+	}
+
+	tree, err = l.ParseRuleString("prgm", "a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Type != "prgm" {
+		t.Errorf("Incorrect type parsed: %s", tree.Type)
+	}
+
+	if _, err := NewParser(strings.NewReader("%start nope\nprgm <- 'a'")); err == nil {
+		t.Error("expected error for undefined start rule")
+	}
+}
+
+// TestConcurrentParse is meant to be run with the race detector. It
+// parses the same inputs on many goroutines at once, through a
+// Language and the copies sharing its rules, and checks that the
+// trees match those of parsing one input at a time.
+func TestConcurrentParse(t *testing.T) {
+	base, err := NewParser(strings.NewReader("%skip _\nlist <- item (','^ item)*\nitem <- ~'[a-z]+' / ('(' list ')')\n_ <- ~'\\s+'"), Lossless())
+	if err != nil {
+		t.Fatal(err)
+	}
+	langs := []*Language{
+		base,
+		base.WithLimits(Limits{MaxDepth: 50, MaxSteps: 10000}),
+		base.WithTracer(TraceRules(NewTextTracer(ioutil.Discard), "list")),
+	}
+
+	inputs := make([]string, 3000)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("a, (b%s, c) ,%s d", strings.Repeat(", (x)", i%7), strings.Repeat(" ", i%3))
+		if i%10 == 0 {
+			inputs[i] += ",,"
+		}
+	}
+	exp := make([]*ParseTree, len(inputs))
+	for i, input := range inputs {
+		exp[i], _ = base.ParseString(input)
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(lang *Language) {
+			defer wg.Done()
+			for i := range work {
+				tree, err := lang.ParseString(inputs[i])
+				if err != nil {
+					t.Errorf("%q: %v", inputs[i], err)
+					continue
+				}
+				if err := treeCompare(tree, exp[i]); err != nil {
+					t.Errorf("%q: %v", inputs[i], err)
+				}
+				if got := string(tree.Bytes()); got != inputs[i] {
+					t.Errorf("lossless round trip failed: got %q exp %q", got, inputs[i])
+				}
+			}
+		}(langs[g%len(langs)])
+	}
+	for i := range inputs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
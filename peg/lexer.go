@@ -11,9 +11,11 @@ import (
 )
 
 type item struct {
-	typ itemType
-	pos int
-	val string
+	typ  itemType
+	pos  int
+	val  string
+	line int // line of the first byte of the token, from 1
+	col  int // byte column of the first byte of the token, from 1
 }
 
 func (i item) String() string {
@@ -26,6 +28,38 @@ func (i item) String() string {
 	return fmt.Sprintf("%s:%q", i.typ, i.val)
 }
 
+// text returns the item as it would be written in a grammar.
+func (i item) text() string {
+	switch i.typ {
+	case itemLiteral:
+		return "'" + i.val + "'"
+	case itemFoldLiteral:
+		return "'" + i.val + "'i"
+	case itemRegexp:
+		return "~'" + i.val + "'"
+	case itemString:
+		return "\"" + i.val + "\""
+	case itemDirective:
+		return "%" + i.val
+	case itemLabel:
+		return i.val + ":"
+	}
+	return i.val
+}
+
+// describe names the item for error messages.
+func (i item) describe() string {
+	switch i.typ {
+	case itemEOF:
+		return "end of grammar"
+	case itemNewline:
+		return "end of line"
+	case itemError:
+		return i.val
+	}
+	return fmt.Sprintf("%q", i.text())
+}
+
 type itemType int
 
 const (
@@ -34,6 +68,8 @@ const (
 	itemAssignment
 	itemQuote
 	itemLiteral
+	itemFoldLiteral
+	itemString
 	itemWhitespace
 	itemNewline
 	itemIdentifier
@@ -43,6 +79,15 @@ const (
 	itemAlternate
 	itemOptional
 	itemDiscard
+	itemDirective
+	itemCall
+	itemOpenParen
+	itemCloseParen
+	itemComma
+	itemComment
+	itemAnd
+	itemNot
+	itemLabel
 	itemEOF
 )
 
@@ -56,6 +101,10 @@ func (i itemType) String() string {
 		return "itemQuote"
 	case itemLiteral:
 		return "itemLiteral"
+	case itemFoldLiteral:
+		return "itemFoldLiteral"
+	case itemString:
+		return "itemString"
 	case itemWhitespace:
 		return "itemWhitespace"
 	case itemNewline:
@@ -76,6 +125,24 @@ func (i itemType) String() string {
 		return "itemOptional"
 	case itemDiscard:
 		return "itemDiscard"
+	case itemDirective:
+		return "itemDirective"
+	case itemCall:
+		return "itemCall"
+	case itemOpenParen:
+		return "itemOpenParen"
+	case itemCloseParen:
+		return "itemCloseParen"
+	case itemComma:
+		return "itemComma"
+	case itemComment:
+		return "itemComment"
+	case itemAnd:
+		return "itemAnd"
+	case itemNot:
+		return "itemNot"
+	case itemLabel:
+		return "itemLabel"
 	}
 	return "UNKNOWN"
 }
@@ -84,34 +151,44 @@ const eof = -1
 
 type stateFn func(*lexer) stateFn
 
+// lexer produces the tokens of a grammar on demand. It runs its
+// state functions only when the parser asks for a token, so a parse
+// that stops early leaves nothing behind.
 type lexer struct {
 	input  *bufio.Reader
 	buffer bytes.Buffer
 	state  stateFn
 	pos    int
 	start  int
-	items  chan item
-}
+	items  []item // emitted but not yet read
 
-func (l *lexer) nextItem() item {
-	item := <-l.items
-	return item
+	line, col           int // position of pos
+	startLine, startCol int // position of start
 }
 
-func lex(input io.Reader) *lexer {
-	l := &lexer{
-		input: bufio.NewReader(input),
-		items: make(chan item, 1),
+// nextItem returns the next token, running the lexer until it emits
+// one. It returns false once the lexer has stopped.
+func (l *lexer) nextItem() (item, bool) {
+	for len(l.items) == 0 {
+		if l.state == nil {
+			return item{}, false
+		}
+		l.state = l.state(l)
 	}
-	go l.run()
-	return l
+	next := l.items[0]
+	l.items = l.items[1:]
+	return next, true
 }
 
-func (l *lexer) run() {
-	for l.state = lexPeg; l.state != nil; {
-		l.state = l.state(l)
+func lex(input io.Reader) *lexer {
+	return &lexer{
+		input:     bufio.NewReader(input),
+		state:     lexPeg,
+		line:      1,
+		col:       1,
+		startLine: 1,
+		startCol:  1,
 	}
-	close(l.items)
 }
 
 func (l *lexer) next() rune {
@@ -120,6 +197,12 @@ func (l *lexer) next() rune {
 		return eof
 	}
 	l.pos += w
+	if r == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col += w
+	}
 	l.buffer.WriteRune(r)
 	return r
 }
@@ -165,8 +248,15 @@ func (l *lexer) emit(t itemType) {
 // and emits that.
 func (l *lexer) emitInner(t itemType, left, right int) {
 	token := l.buffer.String()
-	l.items <- item{t, l.start + left, token[left : len(token)-right]}
+	l.items = append(l.items, item{
+		typ:  t,
+		pos:  l.start + left,
+		val:  token[left : len(token)-right],
+		line: l.startLine,
+		col:  l.startCol,
+	})
 	l.start = l.pos
+	l.startLine, l.startCol = l.line, l.col
 	l.buffer.Truncate(0)
 }
 
@@ -185,7 +275,13 @@ func (l *lexer) acceptRun(valid string) {
 }
 
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...)}
+	l.items = append(l.items, item{
+		typ:  itemError,
+		pos:  l.start,
+		val:  fmt.Sprintf(format, args...),
+		line: l.startLine,
+		col:  l.startCol,
+	})
 	return nil
 }
 
@@ -200,6 +296,20 @@ func (l *lexer) hasPrefix(prefix string) bool {
 	return string(p) == prefix
 }
 
+// hasModifier reports whether the next rune is the single letter mod,
+// standing alone rather than starting an identifier.
+func (l *lexer) hasModifier(mod byte) bool {
+	p, _ := l.input.Peek(1 + utf8.UTFMax)
+	if len(p) == 0 || p[0] != mod {
+		return false
+	}
+	if len(p) == 1 {
+		return true
+	}
+	r, _ := utf8.DecodeRune(p[1:])
+	return !isIdentRune(r)
+}
+
 // Accept next count runes. Normally called after hasPrefix().
 func (l *lexer) nextRuneCount(count int) {
 	for i := 0; i < count; i++ {
@@ -212,7 +322,8 @@ func isIdentRune(r rune) bool {
 }
 
 func lexPeg(l *lexer) stateFn {
-	switch r := l.peek(); {
+	r := l.peek()
+	switch {
 	case isIdentRune(r):
 		return lexIdentifier
 	case unicode.IsSpace(r) && r != '\n':
@@ -223,6 +334,8 @@ func lexPeg(l *lexer) stateFn {
 		return lexAssignment
 	case r == '\'':
 		return lexLiteral
+	case r == '"':
+		return lexString
 	case r == '~':
 		return lexRegex
 	case r == '*':
@@ -235,12 +348,26 @@ func lexPeg(l *lexer) stateFn {
 		return lexOption
 	case r == '^':
 		return lexDiscard
+	case r == '%':
+		return lexDirective
+	case r == '(':
+		return lexOpenParen
+	case r == ')':
+		return lexCloseParen
+	case r == ',':
+		return lexComma
+	case r == '#':
+		return lexComment
+	case r == '&':
+		return lexAnd
+	case r == '!':
+		return lexNot
 	case r == eof:
 		l.emit(itemEOF)
 		return nil
 	}
-
-	return nil
+	l.next()
+	return l.errorf("unexpected character %q", r)
 }
 
 func lexPlus(l *lexer) stateFn {
@@ -267,20 +394,101 @@ func lexDiscard(l *lexer) stateFn {
 	return lexPeg
 }
 
+func lexOpenParen(l *lexer) stateFn {
+	l.next()
+	l.emit(itemOpenParen)
+	return lexPeg
+}
+
+func lexCloseParen(l *lexer) stateFn {
+	l.next()
+	l.emit(itemCloseParen)
+	return lexPeg
+}
+
+func lexComma(l *lexer) stateFn {
+	l.next()
+	l.emit(itemComma)
+	return lexPeg
+}
+
+func lexAnd(l *lexer) stateFn {
+	l.next()
+	l.emit(itemAnd)
+	return lexPeg
+}
+
+func lexNot(l *lexer) stateFn {
+	l.next()
+	l.emit(itemNot)
+	return lexPeg
+}
+
+// lexComment lexes a comment running to the end of the line.
+func lexComment(l *lexer) stateFn {
+	for r := l.peek(); r != '\n' && r != eof; r = l.peek() {
+		l.next()
+	}
+	l.emit(itemComment)
+	return lexPeg
+}
+
 func lexClosure(l *lexer) stateFn {
 	l.next()
 	l.emit(itemClosure)
 	return lexPeg
 }
 
-func lexIdentifier(l *lexer) stateFn {
+func lexDirective(l *lexer) stateFn {
+	l.next() // consume %
+	if !isIdentRune(l.peek()) {
+		l.errorf("expected directive name after %%")
+		return nil
+	}
 	for isIdentRune(l.peek()) {
 		l.next()
 	}
-	l.emit(itemIdentifier)
+	l.emitInner(itemDirective, 1, 0)
 	return lexPeg
 }
 
+// lexIdentifier lexes a plain or qualified identifier such as
+// 'number' or 'c.number'. An identifier directly followed by '('
+// names a macro and is emitted as itemCall; one directly followed by
+// ':' is a label, emitted without the colon as itemLabel.
+func lexIdentifier(l *lexer) stateFn {
+	for {
+		for isIdentRune(l.peek()) {
+			l.next()
+		}
+		if !l.hasQualifier() {
+			break
+		}
+		l.next() // consume .
+	}
+	switch l.peek() {
+	case '(':
+		l.emit(itemCall)
+	case ':':
+		l.next()
+		l.emitInner(itemLabel, 0, 1)
+	default:
+		l.emit(itemIdentifier)
+	}
+	return lexPeg
+}
+
+// hasQualifier reports whether the input continues with a '.'
+// followed by another identifier.
+func (l *lexer) hasQualifier() bool {
+	p, _ := l.input.Peek(1 + utf8.UTFMax)
+	if len(p) < 2 || p[0] != '.' {
+		return false
+	}
+	r, _ := utf8.DecodeRune(p[1:])
+	return isIdentRune(r)
+}
+
 func lexWhitespace(l *lexer) stateFn {
 	for {
 		r := l.peek()
@@ -319,7 +527,12 @@ func lexLiteral(l *lexer) stateFn {
 		if r == '\\' && l.peek() == '\'' {
 			l.next()
 		} else if r == '\'' {
-			l.emitInner(itemLiteral, 1, 1)
+			if l.hasModifier('i') {
+				l.next()
+				l.emitInner(itemFoldLiteral, 1, 2)
+			} else {
+				l.emitInner(itemLiteral, 1, 1)
+			}
 			return lexPeg
 		} else if r == eof {
 			l.errorf("eof while parsing literal")
@@ -351,3 +564,18 @@ func lexRegex(l *lexer) stateFn {
 		}
 	}
 }
+
+func lexString(l *lexer) stateFn {
+	l.next() // consume "
+
+	for {
+		r := l.next()
+		if r == '"' {
+			l.emitInner(itemString, 1, 1)
+			return lexPeg
+		} else if r == '\n' || r == eof {
+			l.errorf("unterminated string")
+			return nil
+		}
+	}
+}
@@ -104,13 +104,71 @@ var lexTestTable = []LexTest{
 			item{typ: itemEOF, val: ""},
 		},
 	},
+	LexTest{
+		"kw <- 'select'i 'a'id",
+		[]item{
+			item{typ: itemIdentifier, val: "kw"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemAssignment, val: "<-"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemFoldLiteral, val: "select"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemLiteral, val: "a"},
+			item{typ: itemIdentifier, val: "id"},
+			item{typ: itemEOF, val: ""},
+		},
+	},
+	LexTest{
+		"%start prgm\nprgm <- 'a'",
+		[]item{
+			item{typ: itemDirective, val: "start"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemIdentifier, val: "prgm"},
+			item{typ: itemNewline, val: "\n"},
+			item{typ: itemIdentifier, val: "prgm"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemAssignment, val: "<-"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemLiteral, val: "a"},
+			item{typ: itemEOF, val: ""},
+		},
+	},
+	LexTest{
+		"prgm <- x:a c.y",
+		[]item{
+			item{typ: itemIdentifier, val: "prgm"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemAssignment, val: "<-"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemLabel, val: "x"},
+			item{typ: itemIdentifier, val: "a"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemIdentifier, val: "c.y"},
+			item{typ: itemEOF, val: ""},
+		},
+	},
+	LexTest{
+		"prgm <- !'a' &b",
+		[]item{
+			item{typ: itemIdentifier, val: "prgm"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemAssignment, val: "<-"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemNot, val: "!"},
+			item{typ: itemLiteral, val: "a"},
+			item{typ: itemWhitespace, val: " "},
+			item{typ: itemAnd, val: "&"},
+			item{typ: itemIdentifier, val: "b"},
+			item{typ: itemEOF, val: ""},
+		},
+	},
 }
 
 func TestLexerTable(t *testing.T) {
 	for _, tc := range lexTestTable {
 		l := lex(strings.NewReader(tc.input))
 		for i, it := range tc.exp {
-			ot, ok := <-l.items
+			ot, ok := l.nextItem()
 			if !ok {
 				t.Errorf("No more items after: %v", tc.exp[:i])
 				t.Errorf("Expected %v", tc.exp[i])
@@ -126,9 +184,9 @@ func TestLexerTable(t *testing.T) {
 			}
 		}
 
-		x, ok := <-l.items
+		x, ok := l.nextItem()
 		if ok {
-			t.Errorf("There are extra items on the channel: %v", x)
+			t.Errorf("There are extra items: %v", x)
 		}
 	}
 }
@@ -0,0 +1,111 @@
+package peg
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Limits bound the work done by a single parse. A zero MaxNodes or
+// MaxSteps means no limit; a zero MaxDepth means DefaultMaxDepth, and
+// a negative one no limit. Limits are checked each time a rule is tried, so input
+// matched without entering a rule, such as a run of 'a'*, can go
+// over MaxNodes by the length of the run.
+type Limits struct {
+	// MaxDepth bounds the nesting of rules being tried, and so the
+	// stack used by recursive rules.
+	MaxDepth int
+	// MaxNodes bounds the parse tree nodes built by terminals,
+	// sequences and repetitions, including those later abandoned by
+	// backtracking.
+	MaxNodes int
+	// MaxSteps bounds the number of times rules are tried.
+	MaxSteps int
+}
+
+// DefaultMaxDepth bounds the nesting of rules of parses whose Limits
+// leave MaxDepth zero, including those of Parse and ParseString, so
+// that deeply nested input fails with a LimitError instead of
+// exhausting the stack.
+const DefaultMaxDepth = 10000
+
+// WithLimits returns a copy of l whose parses are bounded by lim.
+// The copy shares the compiled rules of l.
+func (l *Language) WithLimits(lim Limits) *Language {
+	c := *l
+	c.limits = lim
+	return &c
+}
+
+// withDefaults returns lim with DefaultMaxDepth in place of a zero
+// MaxDepth.
+func (lim Limits) withDefaults() Limits {
+	if lim.MaxDepth == 0 {
+		lim.MaxDepth = DefaultMaxDepth
+	}
+	return lim
+}
+
+// ParseContext is like Parse, but gives up with the context's error
+// once ctx is done.
+func (l *Language) ParseContext(ctx context.Context, source io.Reader) (*ParseTree, error) {
+	return l.parse(ctx, l.root, source)
+}
+
+// LimitKind identifies one of the Limits.
+type LimitKind int
+
+const (
+	DepthLimit LimitKind = iota
+	NodeLimit
+	StepLimit
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case DepthLimit:
+		return "depth"
+	case NodeLimit:
+		return "nodes"
+	case StepLimit:
+		return "steps"
+	}
+	return "UNKNOWN"
+}
+
+// LimitError is returned by a parse that exceeded one of its Limits.
+type LimitError struct {
+	Kind LimitKind
+	Max  int
+	Pos  int // offset of the rule being tried when the limit was hit
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("parse exceeded the limit of %d %s at offset %d", e.Max, e.Kind, e.Pos)
+}
+
+// enterRule accounts for a rule about to be tried at pos. Once a
+// limit has been exceeded or the context is done, the parse is
+// aborted: every later rule fails with the same error, so that
+// alternatives and repetitions cannot carry on.
+func (s *Source) enterRule(pos int) error {
+	if s.abort != nil {
+		return s.abort
+	}
+	s.steps++
+	switch lim := s.limits; {
+	case lim.MaxDepth > 0 && s.depth >= lim.MaxDepth:
+		s.abort = &LimitError{Kind: DepthLimit, Max: lim.MaxDepth, Pos: pos}
+	case lim.MaxSteps > 0 && s.steps > lim.MaxSteps:
+		s.abort = &LimitError{Kind: StepLimit, Max: lim.MaxSteps, Pos: pos}
+	case lim.MaxNodes > 0 && s.nodes > lim.MaxNodes:
+		s.abort = &LimitError{Kind: NodeLimit, Max: lim.MaxNodes, Pos: pos}
+	case s.done != nil:
+		select {
+		case <-s.done:
+			s.abort = s.ctx.Err()
+		default:
+		}
+	}
+	return s.abort
+}
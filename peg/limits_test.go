@@ -0,0 +1,81 @@
+package peg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const nestGrammar = "e <- ('(' e ')') / 'x'"
+
+func TestLimits(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(nestGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep := strings.Repeat("(", 100000) + "x" + strings.Repeat(")", 100000)
+
+	table := []struct {
+		limits Limits
+		input  string
+		kind   LimitKind
+	}{
+		{Limits{MaxDepth: 1000}, deep, DepthLimit},
+		{Limits{MaxSteps: 50}, deep, StepLimit},
+		{Limits{MaxNodes: 50}, deep, NodeLimit},
+	}
+	for _, tc := range table {
+		_, err := lang.WithLimits(tc.limits).ParseString(tc.input)
+		lerr, ok := err.(*LimitError)
+		if !ok {
+			t.Errorf("%+v: expected a LimitError, got %v", tc.limits, err)
+			continue
+		}
+		if lerr.Kind != tc.kind {
+			t.Errorf("%+v: exceeded %s, expected %s", tc.limits, lerr.Kind, tc.kind)
+		}
+	}
+
+	shallow := "((x))"
+	if _, err := lang.WithLimits(Limits{MaxDepth: 3, MaxSteps: 5, MaxNodes: 9}).ParseString(shallow); err != nil {
+		t.Errorf("parse within limits failed: %v", err)
+	}
+	if _, err := lang.WithLimits(Limits{MaxDepth: 2}).ParseString(shallow); err == nil {
+		t.Error("expected depth limit to be exceeded")
+	}
+}
+
+func TestDefaultMaxDepth(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(nestGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nest := func(n int) string {
+		return strings.Repeat("(", n) + "x" + strings.Repeat(")", n)
+	}
+	_, err = lang.ParseString(nest(DefaultMaxDepth))
+	if lerr, ok := err.(*LimitError); !ok || lerr.Kind != DepthLimit || lerr.Max != DefaultMaxDepth {
+		t.Errorf("expected the default depth limit to be exceeded, got %v", err)
+	}
+	if _, err := lang.ParseString(nest(DefaultMaxDepth - 1)); err != nil {
+		t.Errorf("parse within the default depth failed: %v", err)
+	}
+	if _, err := lang.WithLimits(Limits{MaxDepth: -1}).ParseString(nest(DefaultMaxDepth)); err != nil {
+		t.Errorf("parse with no depth limit failed: %v", err)
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(nestGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := lang.ParseContext(ctx, strings.NewReader("(x)")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := lang.ParseContext(ctx, strings.NewReader("(x)")); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,359 @@
+package peg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// WarningKind classifies the problems found by Lint.
+type WarningKind int
+
+const (
+	// DuplicateRule: a rule is defined more than once, and all but
+	// the last definition are ignored.
+	DuplicateRule WarningKind = iota
+	// UndefinedRule: a rule refers to a rule that is not defined.
+	UndefinedRule
+	// UnreachableRule: a rule cannot be reached from the start rule
+	// or the skip rule.
+	UnreachableRule
+	// ShadowedAlternative: an alternative can never match, because
+	// an earlier alternative matches wherever it would.
+	ShadowedAlternative
+)
+
+func (k WarningKind) String() string {
+	switch k {
+	case DuplicateRule:
+		return "duplicate"
+	case UndefinedRule:
+		return "undefined"
+	case UnreachableRule:
+		return "unreachable"
+	case ShadowedAlternative:
+		return "shadowed"
+	}
+	return "UNKNOWN"
+}
+
+// A Warning is a likely mistake in a grammar that does not prevent
+// it from being compiled, or is found before compiling.
+type Warning struct {
+	Kind WarningKind
+	Rule string // the rule in which the problem was found
+	Msg  string
+	// File, Line and Col locate the problem in the grammar text, as in
+	// a GrammarError: the reference for UndefinedRule, and otherwise
+	// the definition of Rule. Line is 0 if the position is unknown, as
+	// it is for warnings from Lint.
+	File      string
+	Line, Col int
+}
+
+func (w Warning) String() string {
+	msg := fmt.Sprintf("rule %s: %s", w.Rule, w.Msg)
+	switch {
+	case w.Line == 0:
+		return msg
+	case w.File != "":
+		return fmt.Sprintf("%s:%d:%d: %s", w.File, w.Line, w.Col, msg)
+	}
+	return fmt.Sprintf("%d:%d: %s", w.Line, w.Col, msg)
+}
+
+// LintGrammar reads grammar text as ParseGrammar does and lints the
+// result. References to undefined rules are reported as warnings
+// rather than errors, and each warning gives its position in the text.
+func LintGrammar(input io.Reader, opts ...ParserOption) ([]Warning, error) {
+	p := newGrammarParser(input, opts)
+	p.allowUndefined = true
+	g, err := p.prepare()
+	if err != nil {
+		return nil, err
+	}
+	l := newLinter(g)
+	for _, part := range *p.parts {
+		l.defs[part.def] = part.at
+		for _, ref := range part.refs {
+			l.refs[ref.expr] = ref.at
+		}
+	}
+	return l.lint(), nil
+}
+
+// Lint checks g for duplicate definitions, undefined references,
+// rules unreachable from the start rule and alternatives shadowed by
+// earlier ones. Shadowing is found conservatively: an alternative is
+// reported only if an earlier one never fails, is the same, or is a
+// literal that the later alternative must start with.
+func Lint(g *Grammar) []Warning {
+	return newLinter(g).lint()
+}
+
+func newLinter(g *Grammar) *linter {
+	return &linter{
+		g:     g,
+		rules: make(map[string]*Rule),
+		defs:  make(map[*Rule]position),
+		refs:  make(map[*Ref]position),
+	}
+}
+
+func (l *linter) lint() []Warning {
+	g := l.g
+	count := make(map[string]int)
+	for _, r := range g.Rules {
+		l.rules[r.Name] = r
+		count[r.Name]++
+	}
+
+	reported := make(map[string]bool)
+	for _, r := range g.Rules {
+		if count[r.Name] > 1 && !reported[r.Name] {
+			reported[r.Name] = true
+			l.warn(DuplicateRule, r.Name, l.defs[r],
+				"defined %d times; only the last definition is used", count[r.Name])
+		}
+	}
+
+	for _, r := range l.live() {
+		walkExpr(r.Expr, func(e Expr) {
+			switch e := e.(type) {
+			case *Ref:
+				if l.rules[e.Name] == nil {
+					l.warn(UndefinedRule, r.Name, l.refs[e], "undefined rule %s", e.Name)
+				}
+			case *Choice:
+				for i, alt := range e.Alternatives {
+					if why := l.shadowed(e.Alternatives[:i], alt); why != "" {
+						l.warn(ShadowedAlternative, r.Name, l.defs[r],
+							"alternative %s can never match: %s", alt, why)
+					}
+				}
+			}
+		})
+	}
+
+	if len(g.Rules) == 0 {
+		return l.warnings
+	}
+	start := g.Start
+	if start == "" {
+		start = g.Rules[0].Name
+	}
+	reachable := make(map[string]bool)
+	l.reach(start, reachable)
+	if g.Skip != "" {
+		l.reach(g.Skip, reachable)
+	}
+	for _, r := range l.live() {
+		if !reachable[r.Name] {
+			l.warn(UnreachableRule, r.Name, l.defs[r], "not reachable from start rule %s", start)
+		}
+	}
+	return l.warnings
+}
+
+type linter struct {
+	g        *Grammar
+	rules    map[string]*Rule   // the definition in effect for each name
+	defs     map[*Rule]position // where rules were defined, if known
+	refs     map[*Ref]position  // where references were made, if known
+	warnings []Warning
+}
+
+func (l *linter) warn(kind WarningKind, rule string, at position, format string, args ...interface{}) {
+	l.warnings = append(l.warnings, Warning{
+		Kind: kind,
+		Rule: rule,
+		Msg:  fmt.Sprintf(format, args...),
+		File: at.file,
+		Line: at.line,
+		Col:  at.col,
+	})
+}
+
+// live returns the rules in effect, in definition order.
+func (l *linter) live() []*Rule {
+	var rules []*Rule
+	seen := make(map[string]bool)
+	for _, r := range l.g.Rules {
+		if !seen[r.Name] {
+			seen[r.Name] = true
+			rules = append(rules, l.rules[r.Name])
+		}
+	}
+	return rules
+}
+
+func (l *linter) reach(name string, reachable map[string]bool) {
+	r := l.rules[name]
+	if r == nil || reachable[name] {
+		return
+	}
+	reachable[name] = true
+	walkExpr(r.Expr, func(e Expr) {
+		if ref, ok := e.(*Ref); ok {
+			l.reach(ref.Name, reachable)
+		}
+	})
+}
+
+// shadowed explains why alt cannot match after the alternatives
+// before it, or returns "".
+func (l *linter) shadowed(before []Expr, alt Expr) string {
+	for _, prev := range before {
+		switch {
+		case !l.canFail(prev, nil):
+			return fmt.Sprintf("%s always succeeds", prev)
+		case prev.String() == alt.String():
+			return fmt.Sprintf("%s is already an alternative", prev)
+		}
+		p, ok := l.literal(prev, nil)
+		if !ok {
+			continue
+		}
+		if first, ok := l.firstLiteral(alt, nil); ok && literalPrefix(p, first) {
+			return fmt.Sprintf("%s matches first", prev)
+		}
+	}
+	return ""
+}
+
+// canFail reports whether e may fail to match. It errs on the side
+// of true. Rules being examined are listed in visiting, to cut off
+// recursion.
+func (l *linter) canFail(e Expr, visiting map[string]bool) bool {
+	switch e := e.(type) {
+	case *Repetition:
+		return e.Kind == OneOrMore && l.canFail(e.Expr, visiting)
+	case *Sequence:
+		for _, part := range e.Exprs {
+			if l.canFail(part, visiting) {
+				return true
+			}
+		}
+		return false
+	case *Choice:
+		for _, alt := range e.Alternatives {
+			if !l.canFail(alt, visiting) {
+				return false
+			}
+		}
+		return true
+	case *Discard:
+		return l.canFail(e.Expr, visiting)
+	case *Label:
+		return l.canFail(e.Expr, visiting)
+	case *Predicate:
+		return e.Not || l.canFail(e.Expr, visiting)
+	case *Literal:
+		return e.Text != ""
+	case *Ref:
+		r := l.rules[e.Name]
+		if r == nil || visiting[e.Name] {
+			return true
+		}
+		return l.canFail(r.Expr, visit(visiting, e.Name))
+	}
+	return true
+}
+
+// literal returns the literal that e consists of, if any.
+func (l *linter) literal(e Expr, visiting map[string]bool) (*Literal, bool) {
+	switch e := e.(type) {
+	case *Literal:
+		return e, true
+	case *Discard:
+		return l.literal(e.Expr, visiting)
+	case *Label:
+		return l.literal(e.Expr, visiting)
+	case *Ref:
+		r := l.rules[e.Name]
+		if r == nil || visiting[e.Name] {
+			return nil, false
+		}
+		return l.literal(r.Expr, visit(visiting, e.Name))
+	}
+	return nil, false
+}
+
+// firstLiteral returns the literal that every match of e starts
+// with, if any.
+func (l *linter) firstLiteral(e Expr, visiting map[string]bool) (*Literal, bool) {
+	switch e := e.(type) {
+	case *Literal:
+		return e, true
+	case *Sequence:
+		if len(e.Exprs) > 0 {
+			return l.firstLiteral(e.Exprs[0], visiting)
+		}
+	case *Repetition:
+		if e.Kind == OneOrMore {
+			return l.firstLiteral(e.Expr, visiting)
+		}
+	case *Discard:
+		return l.firstLiteral(e.Expr, visiting)
+	case *Label:
+		return l.firstLiteral(e.Expr, visiting)
+	case *Ref:
+		r := l.rules[e.Name]
+		if r == nil || visiting[e.Name] {
+			return nil, false
+		}
+		return l.firstLiteral(r.Expr, visit(visiting, e.Name))
+	}
+	return nil, false
+}
+
+// literalPrefix reports whether prev matches at the start of any
+// text matching next.
+func literalPrefix(prev, next *Literal) bool {
+	if !prev.IgnoreCase {
+		return !next.IgnoreCase && strings.HasPrefix(next.Text, prev.Text)
+	}
+	n := utf8.RuneCountInString(prev.Text)
+	head := next.Text
+	for i := range next.Text {
+		if n == 0 {
+			head = next.Text[:i]
+			break
+		}
+		n--
+	}
+	return n == 0 && strings.EqualFold(head, prev.Text)
+}
+
+func visit(visiting map[string]bool, name string) map[string]bool {
+	v := make(map[string]bool, len(visiting)+1)
+	for k := range visiting {
+		v[k] = true
+	}
+	v[name] = true
+	return v
+}
+
+// walkExpr calls fn for e and each expression within it.
+func walkExpr(e Expr, fn func(Expr)) {
+	fn(e)
+	switch e := e.(type) {
+	case *Sequence:
+		for _, part := range e.Exprs {
+			walkExpr(part, fn)
+		}
+	case *Choice:
+		for _, alt := range e.Alternatives {
+			walkExpr(alt, fn)
+		}
+	case *Repetition:
+		walkExpr(e.Expr, fn)
+	case *Predicate:
+		walkExpr(e.Expr, fn)
+	case *Discard:
+		walkExpr(e.Expr, fn)
+	case *Label:
+		walkExpr(e.Expr, fn)
+	}
+}
@@ -0,0 +1,75 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	warnings, err := LintGrammar(strings.NewReader(`%skip _
+prgm <- stmt+
+stmt <- kw / 'iffy' / ident
+kw <- 'if'i / 'IF'
+ident <- ~'[a-z]+' / ident
+stmt <- 'a' / ('a'^ 'b') / (x*) / 'c'
+x <- 'x'
+_ <- ~'\s+'
+orphan <- helper
+helper <- 'h'
+dangling <- nowhere
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []Warning{
+		{DuplicateRule, "stmt", "defined 2 times; only the last definition is used", "", 3, 1},
+		{ShadowedAlternative, "stmt", "alternative 'a'^ 'b' can never match: 'a' matches first", "", 6, 1},
+		{ShadowedAlternative, "stmt", "alternative 'c' can never match: x* always succeeds", "", 6, 1},
+		{ShadowedAlternative, "kw", "alternative 'IF' can never match: 'if'i matches first", "", 4, 1},
+		{UndefinedRule, "dangling", "undefined rule nowhere", "", 11, 13},
+		{UnreachableRule, "kw", "not reachable from start rule prgm", "", 4, 1},
+		{UnreachableRule, "ident", "not reachable from start rule prgm", "", 5, 1},
+		{UnreachableRule, "orphan", "not reachable from start rule prgm", "", 9, 1},
+		{UnreachableRule, "helper", "not reachable from start rule prgm", "", 10, 1},
+		{UnreachableRule, "dangling", "not reachable from start rule prgm", "", 11, 1},
+	}
+	for i := 0; i < len(warnings) || i < len(exp); i++ {
+		switch {
+		case i >= len(warnings):
+			t.Errorf("missing warning: %v", exp[i])
+		case i >= len(exp):
+			t.Errorf("unexpected warning: %v", warnings[i])
+		case warnings[i] != exp[i]:
+			t.Errorf("got %s warning %v, expected %s warning %v", warnings[i].Kind, warnings[i], exp[i].Kind, exp[i])
+		}
+	}
+}
+
+func TestLintImport(t *testing.T) {
+	imp := MapImporter{"common.peg": "digit <- ~'[0-9]'\nnumber <- digit+ / sign digit+"}
+	warnings, err := LintGrammar(strings.NewReader("import \"common.peg\" as c\nnum <- c.number"), WithImporter(imp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "common.peg:2:20: rule c.number: undefined rule c.sign"
+	if len(warnings) != 1 || warnings[0].String() != exp {
+		t.Errorf("got %v, expected [%s]", warnings, exp)
+	}
+
+	// Without positions, warnings name only the rule.
+	g := &Grammar{Rules: []*Rule{{Name: "a", Expr: &Ref{Name: "b"}}}}
+	if warnings := Lint(g); len(warnings) != 1 || warnings[0].String() != "rule a: undefined rule b" {
+		t.Errorf("got %v for a grammar built in code", warnings)
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	g, err := ParseGrammar(strings.NewReader("sum <- number ('+' number)*\nnumber <- '10' / '1' / ~'[0-9]'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings := Lint(g); len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
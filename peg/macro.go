@@ -0,0 +1,342 @@
+package peg
+
+import (
+	"bytes"
+	"strings"
+)
+
+// maxExpansionDepth bounds how deeply macro invocations may nest
+// during expansion. It catches macros that recurse on ever larger
+// arguments, which would otherwise expand forever.
+const maxExpansionDepth = 32
+
+// maxInvocationSize bounds the length of an invocation's canonical
+// text, catching macros whose arguments grow exponentially.
+const maxInvocationSize = 4096
+
+// A macro is a parameterized rule such as
+//
+//	sep_by(item, sep) <- item (sep item)*
+//
+// Its body is kept as tokens and expanded into an ordinary rule for
+// every distinct list of arguments it is invoked with.
+type macro struct {
+	name   string
+	params []string
+	body   []item
+}
+
+// macroCall is an invocation waiting to be expanded. Its key is the
+// canonical text of the invocation, which doubles as the name of the
+// rule the expansion defines.
+type macroCall struct {
+	key   string
+	name  string
+	args  [][]item
+	depth int
+	at    position
+}
+
+type macroTable struct {
+	defs     map[string]*macro
+	calls    []macroCall
+	expanded map[string]bool
+}
+
+func newMacroTable() *macroTable {
+	return &macroTable{
+		defs:     make(map[string]*macro),
+		expanded: make(map[string]bool),
+	}
+}
+
+// substitute returns the body of m with every parameter replaced by
+// the corresponding argument. Arguments of more than one token are
+// parenthesized so they bind as a unit.
+func (m *macro) substitute(args [][]item) []item {
+	var out []item
+	for _, tok := range m.body {
+		i := m.param(tok)
+		switch {
+		case i < 0:
+			out = append(out, tok)
+		case len(args[i]) == 1:
+			out = append(out, args[i][0])
+		default:
+			out = append(out, item{typ: itemOpenParen, val: "("})
+			out = append(out, args[i]...)
+			out = append(out, item{typ: itemCloseParen, val: ")"})
+		}
+	}
+	return out
+}
+
+// param returns the index of the parameter named by tok, or -1.
+func (m *macro) param(tok item) int {
+	if tok.typ != itemIdentifier {
+		return -1
+	}
+	for i, param := range m.params {
+		if param == tok.val {
+			return i
+		}
+	}
+	return -1
+}
+
+// expandMacros turns every macro invocation made by the grammar
+// into a rule. Expansions may invoke further macros, which are
+// expanded in turn; identical invocations share a single rule.
+func (p *parser) expandMacros() {
+	t := p.macros
+	for i := 0; i < len(t.calls); i++ {
+		call := t.calls[i]
+		if t.expanded[call.key] {
+			continue
+		}
+		t.expanded[call.key] = true
+
+		m, ok := t.defs[call.name]
+		if !ok {
+			p.lastErr = call.at.errorf("undefined macro %s", call.name)
+			return
+		}
+		if len(call.args) != len(m.params) {
+			p.lastErr = call.at.errorf("macro %s expects %d arguments, got %d in %s", m.name, len(m.params), len(call.args), call.key)
+			return
+		}
+		if call.depth > maxExpansionDepth {
+			p.lastErr = call.at.errorf("expansion of %s exceeds the maximum depth of %d", call.key, maxExpansionDepth)
+			return
+		}
+		if len(call.key) > maxInvocationSize {
+			p.lastErr = call.at.errorf("expansion of macro %s exceeds the maximum size of %d bytes", call.name, maxInvocationSize)
+			return
+		}
+
+		sub := &parser{
+			pending:   append(m.substitute(call.args), item{typ: itemEOF}),
+			parts:     p.parts,
+			macros:    t,
+			expandAs:  call.key,
+			expandAt:  call.at,
+			expansion: call.depth,
+		}
+		sub.run(parseRuleBody(m.name, nil))
+		if err, ok := sub.lastErr.(*GrammarError); ok {
+			p.lastErr = call.at.errorf("in expansion of %s: %s", call.key, err.Msg)
+			return
+		}
+	}
+}
+
+// qualify applies the grammar's import prefix to the names in tok.
+func (p *parser) qualify(tok item) item {
+	if tok.typ == itemIdentifier || tok.typ == itemCall {
+		tok.val = p.prefix + tok.val
+	}
+	return tok
+}
+
+// parseMacroDef handles the parameter list of a macro definition.
+func parseMacroDef(name string) parseStateFn {
+	return func(p *parser) parseStateFn {
+		next, ok := p.next()
+		if !ok || next.typ != itemOpenParen {
+			p.Errorf("expected '(' after macro name %s", name)
+			return nil
+		}
+		return parseMacroParams(&macro{name: p.prefix + name}, true)
+	}
+}
+
+func parseMacroParams(m *macro, wantParam bool) parseStateFn {
+	return func(p *parser) parseStateFn {
+		next, ok := p.next()
+		if !ok {
+			p.Errorf("unexpected end of grammar in parameters of macro %s", m.name)
+			return nil
+		}
+		switch {
+		case next.typ == itemWhitespace:
+			return parseMacroParams(m, wantParam)
+		case next.typ == itemIdentifier && wantParam && !strings.Contains(next.val, "."):
+			for _, param := range m.params {
+				if param == next.val {
+					p.Errorf("duplicate parameter %s in macro %s", param, m.name)
+					return nil
+				}
+			}
+			m.params = append(m.params, next.val)
+			return parseMacroParams(m, false)
+		case next.typ == itemComma && !wantParam:
+			return parseMacroParams(m, true)
+		case next.typ == itemCloseParen && !wantParam:
+			return parseMacroAssignment(m)
+		}
+		p.Errorf("unexpected %s in parameters of macro %s", next.describe(), m.name)
+		return nil
+	}
+}
+
+func parseMacroAssignment(m *macro) parseStateFn {
+	return func(p *parser) parseStateFn {
+		next, ok := p.next()
+		if !ok {
+			p.Errorf("unexpected end of grammar after parameters of macro %s", m.name)
+			return nil
+		}
+		switch next.typ {
+		case itemWhitespace:
+			return parseMacroAssignment(m)
+		case itemAssignment:
+			return parseMacroBody(m)
+		}
+		p.Errorf("expected <- after parameters of macro %s, got %s", m.name, next.describe())
+		return nil
+	}
+}
+
+// parseMacroBody collects the tokens of a macro body. Names other
+// than the parameters are qualified now, so the body means the same
+// thing wherever it is expanded.
+func parseMacroBody(m *macro) parseStateFn {
+	return func(p *parser) parseStateFn {
+		next, ok := p.next()
+		if !ok {
+			p.Errorf("unexpected end of grammar in macro %s", m.name)
+			return nil
+		}
+		switch next.typ {
+		case itemWhitespace:
+			return parseMacroBody(m)
+		case itemNewline, itemEOF:
+			if len(m.body) == 0 {
+				p.Errorf("macro %s has an empty body", m.name)
+				return nil
+			}
+			if _, ok := p.macros.defs[m.name]; ok {
+				p.Errorf("macro %s defined twice", m.name)
+				return nil
+			}
+			p.macros.defs[m.name] = m
+			if next.typ == itemEOF {
+				return nil
+			}
+			return parseLexeme
+		}
+		if m.param(next) < 0 {
+			next = p.qualify(next)
+		}
+		m.body = append(m.body, next)
+		return parseMacroBody(m)
+	}
+}
+
+// parseCall handles the argument list of a macro invocation, then
+// continues with a reference to the rule its expansion will define.
+func parseCall(name item, then func(Expr) parseStateFn) parseStateFn {
+	return func(p *parser) parseStateFn {
+		at := p.at(name)
+		next, ok := p.next()
+		if !ok || next.typ != itemOpenParen {
+			p.Errorf("expected '(' after macro name %s", name.val)
+			return nil
+		}
+		call := &macroCall{name: p.prefix + name.val, depth: p.expansion + 1, at: at}
+		return parseCallArgs(call, nil, 0, then)
+	}
+}
+
+func parseCallArgs(call *macroCall, arg []item, nesting int, then func(Expr) parseStateFn) parseStateFn {
+	return func(p *parser) parseStateFn {
+		next, ok := p.next()
+		if !ok {
+			p.Errorf("unexpected end of grammar in invocation of macro %s", call.name)
+			return nil
+		}
+		switch {
+		case next.typ == itemWhitespace:
+			return parseCallArgs(call, arg, nesting, then)
+		case next.typ == itemNewline || next.typ == itemEOF:
+			p.Errorf("expected ')' to close invocation of macro %s", call.name)
+			return nil
+		case nesting == 0 && (next.typ == itemComma || next.typ == itemCloseParen):
+			arg = stripParens(arg)
+			if len(arg) == 0 {
+				p.Errorf("empty argument in invocation of macro %s", call.name)
+				return nil
+			}
+			call.args = append(call.args, arg)
+			if next.typ == itemComma {
+				return parseCallArgs(call, nil, 0, then)
+			}
+			call.key = callKey(call.name, call.args)
+			p.macros.calls = append(p.macros.calls, *call)
+			return then(&Ref{Name: call.key})
+		case next.typ == itemOpenParen:
+			nesting++
+		case next.typ == itemCloseParen:
+			nesting--
+		}
+		return parseCallArgs(call, append(arg, p.qualify(next)), nesting, then)
+	}
+}
+
+// stripParens removes parentheses enclosing the whole of toks.
+func stripParens(toks []item) []item {
+	for len(toks) >= 2 && toks[0].typ == itemOpenParen && toks[len(toks)-1].typ == itemCloseParen {
+		nesting := 0
+		for i, tok := range toks {
+			if tok.typ == itemOpenParen {
+				nesting++
+			} else if tok.typ == itemCloseParen {
+				nesting--
+			}
+			if nesting == 0 && i < len(toks)-1 {
+				return toks
+			}
+		}
+		toks = toks[1 : len(toks)-1]
+	}
+	return toks
+}
+
+// callKey returns the canonical text of an invocation.
+func callKey(name string, args [][]item) string {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte('(')
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(tokensText(arg))
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// tokensText joins toks back into grammar text.
+func tokensText(toks []item) string {
+	var buf bytes.Buffer
+	for i, tok := range toks {
+		if i > 0 && spaceBetween(toks[i-1], tok) {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(tok.text())
+	}
+	return buf.String()
+}
+
+func spaceBetween(prev, next item) bool {
+	switch prev.typ {
+	case itemCall, itemOpenParen, itemAnd, itemNot, itemLabel:
+		return false
+	}
+	switch next.typ {
+	case itemCloseParen, itemComma, itemPlus, itemClosure, itemOptional, itemDiscard:
+		return false
+	}
+	return true
+}
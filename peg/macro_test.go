@@ -0,0 +1,124 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+var macroTestTable = []ParseTest{
+	ParseTest{
+		"prgm <- ('a' 'b')+",
+		"abab",
+		&ParseTree{Type: "prgm+", Children: []*ParseTree{
+			&ParseTree{Type: "prgm", Children: []*ParseTree{
+				&ParseTree{Type: "prgm", Data: []byte("a")},
+				&ParseTree{Type: "prgm", Data: []byte("b")},
+			}},
+			&ParseTree{Type: "prgm", Children: []*ParseTree{
+				&ParseTree{Type: "prgm", Data: []byte("a")},
+				&ParseTree{Type: "prgm", Data: []byte("b")},
+			}},
+		}},
+	},
+	ParseTest{
+		"prgm <- 'x' / ('a' 'b')",
+		"ab",
+		&ParseTree{Type: "prgm", Children: []*ParseTree{
+			&ParseTree{Type: "prgm", Data: []byte("a")},
+			&ParseTree{Type: "prgm", Data: []byte("b")},
+		}},
+	},
+	ParseTest{
+		"list <- sep_by(item, ',')\nitem <- ~'[a-z]+'\nsep_by(x, sep) <- x (sep x)*",
+		"a,b,c",
+		&ParseTree{Type: "sep_by", Children: []*ParseTree{
+			&ParseTree{Type: "item", Data: []byte("a")},
+			&ParseTree{Type: "sep_by*", Children: []*ParseTree{
+				&ParseTree{Type: "sep_by", Children: []*ParseTree{
+					&ParseTree{Type: "sep_by", Data: []byte(",")},
+					&ParseTree{Type: "item", Data: []byte("b")},
+				}},
+				&ParseTree{Type: "sep_by", Children: []*ParseTree{
+					&ParseTree{Type: "sep_by", Data: []byte(",")},
+					&ParseTree{Type: "item", Data: []byte("c")},
+				}},
+			}},
+		}},
+	},
+	ParseTest{
+		"prgm <- many('a' '.'^)\nmany(x) <- x many(x)?",
+		"a.a.",
+		&ParseTree{Type: "many", Children: []*ParseTree{
+			&ParseTree{Type: "many", Data: []byte("a")},
+			&ParseTree{Type: "many", Data: []byte("a")},
+		}},
+	},
+	ParseTest{
+		"prgm <- pair(pair('a', 'b'), 'c')\npair(l, r) <- l r",
+		"abc",
+		&ParseTree{Type: "pair", Children: []*ParseTree{
+			&ParseTree{Type: "pair", Children: []*ParseTree{
+				&ParseTree{Type: "pair", Data: []byte("a")},
+				&ParseTree{Type: "pair", Data: []byte("b")},
+			}},
+			&ParseTree{Type: "pair", Data: []byte("c")},
+		}},
+	},
+}
+
+func TestMacroTable(t *testing.T) {
+	for _, tc := range macroTestTable {
+		lang, err := NewParser(strings.NewReader(tc.language))
+		if err != nil {
+			t.Error(tc.language)
+			t.Error(err)
+			continue
+		}
+
+		tree, err := lang.ParseString(tc.input)
+		if err != nil {
+			t.Error(tc.language)
+			t.Error(err)
+			continue
+		}
+
+		if err := treeCompare(tree, tc.exp); err != nil {
+			t.Error(tc.language)
+			t.Error(err)
+		}
+	}
+}
+
+func TestImportedMacro(t *testing.T) {
+	imp := MapImporter{"list.peg": "sep_by(x, s) <- x (s x)*\ncomma <- ','"}
+	lang, err := NewParser(strings.NewReader("import \"list.peg\" as l\nprgm <- l.sep_by(digit, l.comma)\ndigit <- ~'\\d'"), WithImporter(imp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString("1,2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Type != "l.sep_by" || len(tree.Children) != 2 {
+		t.Errorf("Incorrect tree parsed: %v", tree)
+	}
+}
+
+var macroErrorTable = []string{
+	"prgm <- pair('a')\npair(l, r) <- l r",
+	"prgm <- missing('a')",
+	"prgm <- grow('a')\ngrow(x) <- x / grow(x x)",
+	"prgm <- m('a')\nm(x, x) <- x",
+	"prgm <- m('a')\nm(x) <- x\nm(y) <- y",
+	"prgm <- m('a'\nm(x) <- x",
+	"prgm <- ('a' 'b'",
+	"prgm <- 'a')",
+}
+
+func TestMacroErrors(t *testing.T) {
+	for _, grammar := range macroErrorTable {
+		if _, err := NewParser(strings.NewReader(grammar)); err == nil {
+			t.Errorf("expected error for grammar:\n%s", grammar)
+		}
+	}
+}
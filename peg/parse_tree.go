@@ -1,13 +1,70 @@
 package peg
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 )
 
 type ParseTree struct {
 	Type     string
 	Data     []byte
 	Children []*ParseTree
+
+	// Start and End are the offsets in the parsed text of the first
+	// byte of the tree and of the byte after its last, not counting
+	// trivia. A tree that matched nothing has Start == End.
+	Start, End int
+
+	// Trivia holds the text skipped by the language's %skip rule
+	// directly before this node, if the language keeps trivia.
+	Trivia []*ParseTree
+	// Trailing holds trivia following this node that no later node
+	// claims, such as the trivia after the last token of the input.
+	Trailing []*ParseTree
+}
+
+// Bytes returns the text covered by the tree: the trivia, data,
+// children and trailing trivia of each node, in order. For a tree
+// produced by a Lossless language this is exactly the parsed input.
+func (p *ParseTree) Bytes() []byte {
+	var buf bytes.Buffer
+	p.writeText(&buf)
+	return buf.Bytes()
+}
+
+// Text returns the data of the leaves of the tree, in order, leaving
+// out trivia.
+func (p *ParseTree) Text() string {
+	if len(p.Children) == 0 {
+		return string(p.Data)
+	}
+	var b strings.Builder
+	p.writeLeaves(&b)
+	return b.String()
+}
+
+func (p *ParseTree) writeLeaves(b *strings.Builder) {
+	if p == nil {
+		return
+	}
+	b.Write(p.Data)
+	for _, child := range p.Children {
+		child.writeLeaves(b)
+	}
+}
+
+func (p *ParseTree) writeText(buf *bytes.Buffer) {
+	for _, trivia := range p.Trivia {
+		trivia.writeText(buf)
+	}
+	buf.Write(p.Data)
+	for _, child := range p.Children {
+		child.writeText(buf)
+	}
+	for _, trivia := range p.Trailing {
+		trivia.writeText(buf)
+	}
 }
 
 func (p *ParseTree) prettyPrint(indent string) string {
@@ -1 +1,41 @@
 package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPositions(t *testing.T) {
+	lang, err := NewParser(strings.NewReader("%skip _\nsum <- num ('+' num)* rest\nnum <- ~'[0-9]+'\nrest <- ~'x*'\n_ <- ~' +'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString(" 1 + 23 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spans []string
+	var walk func(*ParseTree)
+	walk = func(tree *ParseTree) {
+		spans = append(spans, tree.Type+" "+string(" 1 + 23 "[tree.Start:tree.End]))
+		for _, child := range tree.Children {
+			walk(child)
+		}
+	}
+	walk(tree)
+	exp := []string{"sum 1 + 23", "num 1", "sum* + 23", "sum + 23", "sum +", "num 23", "rest "}
+	if strings.Join(spans, "|") != strings.Join(exp, "|") {
+		t.Errorf("got spans %q, expected %q", spans, exp)
+	}
+	if rest := tree.Children[2]; rest.Start != 8 || rest.End != 8 {
+		t.Errorf("empty tree at %d:%d, expected 8:8", rest.Start, rest.End)
+	}
+
+	flat, err := lang.ParseFlat(strings.NewReader(" 1 + 23 "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := flat.Root(); root.Start() != tree.Start || root.End() != tree.End {
+		t.Errorf("flat tree at %d:%d, expected %d:%d", root.Start(), root.End(), tree.Start, tree.End)
+	}
+}
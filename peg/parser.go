@@ -13,227 +13,775 @@ type parseStateFn func(*parser) parseStateFn
 type parser struct {
 	lex     *lexer
 	state   parseStateFn
-	parts   chan *Lexeme
+	parts   *[]rule // definitions of every grammar of the language
+	start   string
 	lastErr error
+	last    item // the token read most recently
+
+	importer  Importer
+	prefix    string          // qualifies every rule name defined or referenced
+	file      string          // import path of the grammar being parsed
+	depth     int             // import nesting depth, 0 for the main grammar
+	importing []string        // chain of files being imported, for cycle detection
+	aliases   map[string]bool // import aliases used by this grammar
+
+	pending   []item      // tokens to read before consulting lex
+	groups    []group     // enclosing parenthesized groups
+	macros    *macroTable // shared by all grammars of one language
+	expandAs  string      // rule name for the body of a macro expansion
+	expandAt  position    // invocation being expanded, to which errors are reported
+	expansion int         // nesting depth of macro expansion
+
+	ruleAt position // name of the rule being parsed
+	refs   []ref    // references made by the rule being parsed
+
+	startAt, skipAt position
+	skip            string              // trivia rule declared with %skip
+	lexical         map[string]position // rules declared with %lexical
+	types           map[string]typeDecl // tree types declared with %type
+
+	allowUndefined bool // leave references to undefined rules to Lint
 }
 
-func NewParser(input io.Reader) (*Language, error) {
-	l := lex(input)
-	p := &parser{lex: l}
-	return p.prepare()
+// typeDecl is a tree type declared with %type.
+type typeDecl struct {
+	typ string
+	at  position
 }
 
-func (p *parser) Errorf(format string, args ...interface{}) {
-	s := fmt.Sprintf(format, args...)
-	p.lastErr = errors.New(s)
+// group records the state of a rule body around a '('.
+type group struct {
+	parts []Expr
+	lhs   Expr // left side of an alternation awaiting the group
+}
+
+// rule is a named top level definition produced by the parser.
+type rule struct {
+	def      *Rule
+	at       position
+	refs     []ref
+	file     string
+	depth    int
+	override bool // defined with a qualified name, replacing an imported rule
 }
 
-func (p *parser) prepare() (*Language, error) {
-	p.parts = make(chan *Lexeme)
-	in := make(chan *Language, 1)
-	err := make(chan error, 1)
-	go constructLanguage(p.parts, in, err)
+// ref is a reference to a rule, checked once all rules are known.
+type ref struct {
+	name string
+	at   position
+	expr *Ref
+}
 
-	for p.state = parseLexeme; p.state != nil; {
-		p.state = p.state(p)
+// GrammarError reports a malformed grammar.
+type GrammarError struct {
+	File string // import path of the grammar, empty for the main grammar
+	Line int    // from 1
+	Col  int    // byte offset in the line, from 1
+	Msg  string
+}
+
+func (e *GrammarError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Msg)
 	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
 
-	close(p.parts)
+// position locates a token in the grammars of a language.
+type position struct {
+	file      string
+	line, col int
+}
 
-	if p.lastErr != nil {
-		return nil, p.lastErr
+func (pos position) errorf(format string, args ...interface{}) *GrammarError {
+	return &GrammarError{File: pos.file, Line: pos.line, Col: pos.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ParserOption configures optional behaviour of NewParser,
+// ParseGrammar and Compile.
+type ParserOption func(*config)
+
+type config struct {
+	importer   Importer
+	keepTrivia bool
+	lossless   bool
+}
+
+func newConfig(opts []ParserOption) *config {
+	cfg := &config{}
+	for _, opt := range opts {
+		opt(cfg)
 	}
+	return cfg
+}
 
-	select {
-	case lang := <-in:
-		return lang, nil
-	case err := <-err:
+// NewParser parses and compiles a grammar. It is equivalent to
+// calling ParseGrammar and then Compile with the same options.
+func NewParser(input io.Reader, opts ...ParserOption) (*Language, error) {
+	g, err := ParseGrammar(input, opts...)
+	if err != nil {
 		return nil, err
 	}
+	return Compile(g, opts...)
 }
 
-func constructLanguage(parts chan *Lexeme, success chan *Language, failure chan error) {
-	var lexemes = make(map[string]*Lexeme)
-	first, ok := <-parts
-	if !ok {
-		failure <- errors.New("Parts channel was empty.")
-		return
+// ParseGrammar reads grammar text into a Grammar. Imports are
+// resolved and merged and macro invocations expanded, so the result
+// is self contained. A malformed grammar, including one referring to
+// undefined rules, is reported as a *GrammarError.
+func ParseGrammar(input io.Reader, opts ...ParserOption) (*Grammar, error) {
+	return newGrammarParser(input, opts).prepare()
+}
+
+func newGrammarParser(input io.Reader, opts []ParserOption) *parser {
+	cfg := newConfig(opts)
+	return &parser{
+		lex:      lex(input),
+		importer: cfg.importer,
+		macros:   newMacroTable(),
+		lexical:  make(map[string]position),
+		types:    make(map[string]typeDecl),
 	}
-	lexemes[first.Name] = first
-	for part := range parts {
-		lexemes[part.Name] = part
+}
+
+// Errorf reports an error at the last token read, unless an error
+// has already been reported.
+func (p *parser) Errorf(format string, args ...interface{}) {
+	if p.lastErr == nil {
+		p.lastErr = p.at(p.last).errorf(format, args...)
+	}
+}
+
+// at returns the position of tok. Errors in macro expansions are
+// reported at the invocation.
+func (p *parser) at(tok item) position {
+	if p.expandAs != "" {
+		return p.expandAt
+	}
+	return position{file: p.file, line: tok.line, col: tok.col}
+}
+
+func (p *parser) prepare() (*Grammar, error) {
+	p.parts = new([]rule)
+	p.run(parseLexeme)
+	if p.lastErr == nil {
+		p.expandMacros()
+	}
+	if p.lastErr != nil {
+		return nil, p.lastErr
+	}
+	if len(*p.parts) == 0 {
+		return nil, p.at(p.last).errorf("grammar defines no rules")
 	}
 
-	lex, err := resolveDependencies(first, lexemes)
+	g, err := constructGrammar(*p.parts, !p.allowUndefined)
 	if err != nil {
-		failure <- err
-		return
-	} else {
-		success <- &Language{
-			root: lex,
+		return nil, err
+	}
+	if p.start != "" {
+		g.Start = p.start
+	}
+	g.Skip = p.skip
+	defined := make(map[string]bool)
+	for _, r := range g.Rules {
+		defined[r.Name] = true
+		_, r.Lexical = p.lexical[r.Name]
+	}
+	if p.start != "" && !defined[p.start] {
+		return nil, p.startAt.errorf("start rule %s is not defined", p.start)
+	}
+	if p.skip != "" && !defined[p.skip] {
+		return nil, p.skipAt.errorf("skip rule %s is not defined", p.skip)
+	}
+	for name, at := range p.lexical {
+		if !defined[name] {
+			return nil, at.errorf("lexical rule %s is not defined", name)
 		}
-		return
 	}
+	for name, d := range p.types {
+		if !defined[name] {
+			return nil, d.at.errorf("typed rule %s is not defined", name)
+		}
+	}
+	for _, r := range g.Rules {
+		if d, ok := p.types[r.Name]; ok {
+			r.Type = d.typ
+		}
+	}
+	return g, nil
 }
 
-func resolveDependencies(lex *Lexeme, env map[string]*Lexeme) (*Lexeme, error) {
-	if lex.isResolved {
-		return lex, nil
+func (p *parser) run(start parseStateFn) {
+	for p.state = start; p.state != nil; {
+		p.state = p.state(p)
 	}
-	old := lex
-	if lex.Lexer == nil {
-		p, ok := env[lex.Name[1:]]
+}
+
+// next returns the next token of the grammar, skipping comments.
+// Macro expansions have no lexer, and read only their pending tokens.
+// Lex errors are reported here, after which there are no more tokens.
+func (p *parser) next() (item, bool) {
+	for {
+		next, ok := p.nextToken()
 		if !ok {
-			return nil, errors.New(fmt.Sprintf("Cannot resolve dependency %s\n Available are: %v", lex.Name[1:], env))
-		} else {
-			lex = p
+			return next, false
+		}
+		p.last = next
+		if next.typ == itemError {
+			p.Errorf("%s", next.val)
+			return next, false
 		}
+		if next.typ != itemComment {
+			return next, true
+		}
+	}
+}
+
+func (p *parser) nextToken() (item, bool) {
+	if len(p.pending) > 0 {
+		next := p.pending[0]
+		p.pending = p.pending[1:]
+		return next, true
+	}
+	if p.lex == nil {
+		return item{typ: itemEOF}, true
 	}
-	lex.isResolved = true
+	return p.lex.nextItem()
+}
 
-	for i, dep := range lex.Dependencies {
-		var err error
-		lex.Dependencies[i], err = resolveDependencies(dep, env)
-		if err != nil {
-			return nil, err
+// importGrammar parses the grammar at path, sending its rules to
+// the same parts list as p. Rule names are qualified with alias.
+func (p *parser) importGrammar(path, alias string) error {
+	if p.importer == nil {
+		return errors.New(fmt.Sprintf("cannot import %q: no Importer configured", path))
+	}
+	if alias != "" {
+		if p.aliases[alias] {
+			return errors.New(fmt.Sprintf("import alias %s used twice", alias))
+		}
+		if p.aliases == nil {
+			p.aliases = make(map[string]bool)
+		}
+		p.aliases[alias] = true
+	}
+	chain := append(append([]string(nil), p.importing...), p.file)
+	for _, f := range chain {
+		if f == path {
+			return errors.New(fmt.Sprintf("import cycle: %s -> %s", strings.Join(chain[1:], " -> "), path))
 		}
 	}
 
-	(*old) = (*lex)
+	r, err := p.importer.Import(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	sub := &parser{
+		lex:       lex(r),
+		parts:     p.parts,
+		importer:  p.importer,
+		prefix:    p.prefix,
+		file:      path,
+		depth:     p.depth + 1,
+		importing: chain,
+		macros:    p.macros,
+		lexical:   p.lexical,
+		types:     p.types,
+	}
+	if alias != "" {
+		sub.prefix += alias + "."
+	}
+	sub.run(parseLexeme)
+	return sub.lastErr
+}
+
+// emit records a completed rule definition. The
+// body of a macro expansion is named after the invocation, but
+// builds trees named after the macro.
+func (p *parser) emit(name string, e Expr) {
+	if p.expandAs != "" {
+		*p.parts = append(*p.parts, rule{
+			def:  &Rule{Name: p.expandAs, Type: name, Expr: e},
+			at:   p.expandAt,
+			refs: p.refs,
+		})
+		return
+	}
+	*p.parts = append(*p.parts, rule{
+		def:      &Rule{Name: name, Expr: e},
+		at:       p.ruleAt,
+		refs:     p.refs,
+		file:     p.file,
+		depth:    p.depth,
+		override: strings.Contains(name[len(p.prefix):], "."),
+	})
+}
+
+// constructGrammar merges the rules defined by all grammars. A rule defined
+// by a grammar replaces rules of the same name from the grammars it
+// imports; a grammar defining a rule twice keeps both definitions,
+// of which the later takes effect. The first rule of the main
+// grammar becomes the start rule. If checkRefs is set, every reference
+// made by the rules kept must be to a rule that is defined.
+func constructGrammar(parts []rule, checkRefs bool) (*Grammar, error) {
+	var defs = make(map[string][]rule)
+	var overridden = make(map[string]bool)
+	var order []string
+	var root string
+	var firstErr *GrammarError
+	for _, part := range parts {
+		name := part.def.Name
+		if root == "" && part.depth == 0 {
+			root = name
+		}
+		prev, ok := defs[name]
+		switch {
+		case !ok:
+			order = append(order, name)
+			defs[name] = []rule{part}
+		case part.depth < prev[0].depth:
+			defs[name] = []rule{part}
+			overridden[name] = true
+		case part.depth > prev[0].depth:
+			overridden[name] = true
+		case part.file == prev[0].file:
+			defs[name] = append(prev, part)
+		case firstErr == nil:
+			firstErr = part.at.errorf("rule %s is also defined by %s", name, prev[0].file)
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
 
-	return lex, nil
+	g := &Grammar{}
+	for _, name := range order {
+		if def := defs[name][0]; def.override && !overridden[name] {
+			return nil, def.at.errorf("rule %s does not override an imported rule", name)
+		}
+		for _, def := range defs[name] {
+			g.Rules = append(g.Rules, def.def)
+		}
+	}
+	for _, name := range order {
+		for _, def := range defs[name] {
+			for _, ref := range def.refs {
+				if _, ok := defs[ref.name]; !ok && checkRefs {
+					return nil, ref.at.errorf("undefined rule %s", ref.name)
+				}
+			}
+		}
+	}
+	if root != "" && root != order[0] {
+		g.Start = root
+	}
+	return g, nil
 }
 
 func parseLexeme(p *parser) parseStateFn {
-	next, ok := <-p.lex.items
+	next, ok := p.next()
 	if !ok {
 		return nil
 	}
 	switch next.typ {
 	case itemIdentifier:
-		return parseRule(next.val)
-	case itemWhitespace:
+		return parseRule(next)
+	case itemDirective:
+		return parseDirective(next)
+	case itemCall:
+		return parseMacroDef(next.val)
+	case itemWhitespace, itemNewline:
 		return parseLexeme
-	case itemError:
-		p.Errorf("lex error: %s", next.String())
-	default:
-		panic(next.typ.String())
+	case itemEOF:
+		return nil
 	}
+	p.Errorf("expected a rule, directive or import, got %s", next.describe())
 	return nil
 }
 
-func parseRule(name string) parseStateFn {
+func parseRule(name item) parseStateFn {
 	return func(p *parser) parseStateFn {
-		next, ok := <-p.lex.items
+		next, ok := p.next()
 		if !ok {
-			p.Errorf("item channel drained unexpectedly in parseRule")
+			p.Errorf("unexpected end of grammar after %s", name.val)
 			return nil
 		}
 		switch next.typ {
 		case itemWhitespace:
 			return parseRule(name)
 		case itemAssignment:
-			return parseRuleBody(name, nil)
+			p.ruleAt = p.at(name)
+			p.refs = nil
+			return parseRuleBody(p.prefix+name.val, nil)
+		case itemString:
+			if name.val == "import" {
+				return parseImport(next, "", false)
+			}
 		}
+		p.Errorf("expected <- after rule name %s, got %s", name.val, next.describe())
 		return nil
 	}
 }
 
-func parseRuleBody(name string, parts []*Lexeme) parseStateFn {
-	quoteResolver := strings.NewReplacer("\\'", "'")
+// parseImport handles the remainder of 'import "path" [as alias]'.
+func parseImport(path item, alias string, sawAs bool) parseStateFn {
+	return func(p *parser) parseStateFn {
+		next, ok := p.next()
+		if !ok {
+			p.Errorf("unexpected end of grammar in import")
+			return nil
+		}
+		switch {
+		case next.typ == itemWhitespace:
+			return parseImport(path, alias, sawAs)
+		case next.typ == itemIdentifier && !sawAs && next.val == "as":
+			return parseImport(path, alias, true)
+		case next.typ == itemIdentifier && sawAs && alias == "" && !strings.Contains(next.val, "."):
+			return parseImport(path, next.val, sawAs)
+		case (next.typ == itemNewline || next.typ == itemEOF) && sawAs == (alias != ""):
+			if err := p.importGrammar(path.val, alias); err != nil {
+				if _, ok := err.(*GrammarError); !ok {
+					err = p.at(path).errorf("%s", err)
+				}
+				p.lastErr = err
+				return nil
+			}
+			if next.typ == itemEOF {
+				return nil
+			}
+			return parseLexeme
+		}
+		p.Errorf("expected 'import \"path\" [as alias]', got %s", next.describe())
+		return nil
+	}
+}
+
+func parseDirective(name item) parseStateFn {
+	return parseDirectiveArgs(name, nil)
+}
+
+// parseDirectiveArgs collects the rule names following a directive
+// up to the end of the line, and the quoted type ending a %type.
+func parseDirectiveArgs(name item, args []item) parseStateFn {
 	return func(p *parser) parseStateFn {
-		next, ok := <-p.lex.items
+		next, ok := p.next()
 		if !ok {
-			p.Errorf("item channel drained unexpectedly in parseRuleBody")
+			p.Errorf("unexpected end of grammar in %%%s", name.val)
 			return nil
 		}
 		switch next.typ {
 		case itemWhitespace:
-			return parseRuleBody(name, parts)
-		case itemLiteral:
-			next.val = quoteResolver.Replace(next.val)
-			return parseRuleBody(name, append(parts, NewLiteralLexer(name, next.val)))
-		case itemRegexp:
-			return parseRuleBody(name, append(parts, NewRegexpLexer(name, regexp.MustCompile(next.val))))
+			return parseDirectiveArgs(name, args)
 		case itemIdentifier:
-			return parseRuleBody(name, append(parts, NewRuleLexer(next.val)))
-		case itemPlus:
-			if len(parts) == 0 {
-				p.Errorf("expected lexeme definition before '+'")
+			return parseDirectiveArgs(name, append(args, next))
+		case itemLiteral:
+			if name.val == "type" {
+				return parseDirectiveArgs(name, append(args, next))
+			}
+		case itemNewline, itemEOF:
+			if err := p.directive(name.val, args, p.at(name)); err != nil {
+				p.lastErr = p.at(name).errorf("%s", err)
 				return nil
 			}
-			lex := parts[len(parts)-1]
-			parts := parts[:len(parts)-1]
-			return parseRuleBody(name, append(parts, NewPlusClosure(lex)))
-		case itemClosure:
-			if len(parts) == 0 {
-				p.Errorf("expected lexeme definition before '*'")
+			if next.typ == itemEOF {
 				return nil
 			}
-			lex := parts[len(parts)-1]
-			parts := parts[:len(parts)-1]
-			return parseRuleBody(name, append(parts, NewStarClosure(lex)))
-		case itemOptional:
-			if len(parts) == 0 {
-				p.Errorf("expected lexeme definition before '?'")
+			return parseLexeme
+		}
+		p.Errorf("expected rule names after %%%s, got %s", name.val, next.describe())
+		return nil
+	}
+}
+
+// directive applies a directive to the grammar. %start and %skip
+// describe the language as a whole, and are ignored in imported
+// grammars; %lexical and %type apply wherever they appear.
+func (p *parser) directive(name string, args []item, at position) error {
+	var rules []string
+	for _, arg := range args {
+		if arg.typ == itemIdentifier {
+			rules = append(rules, p.prefix+arg.val)
+		}
+	}
+	switch name {
+	case "start", "skip":
+		if len(args) != 1 {
+			return errors.New(fmt.Sprintf("expected '%%%s rule'", name))
+		}
+		target, targetAt := &p.start, &p.startAt
+		if name == "skip" {
+			target, targetAt = &p.skip, &p.skipAt
+		}
+		if *target != "" {
+			return errors.New(fmt.Sprintf("%s rule declared twice: %s and %s", name, *target, rules[0]))
+		}
+		*target, *targetAt = rules[0], at
+	case "lexical":
+		if len(args) == 0 {
+			return errors.New("expected '%lexical rule...'")
+		}
+		for _, rule := range rules {
+			p.lexical[rule] = at
+		}
+	case "type":
+		if len(args) != 2 || len(rules) != 1 || args[1].typ != itemLiteral {
+			return errors.New("expected '%type rule' followed by a quoted type")
+		}
+		if _, ok := p.types[rules[0]]; ok {
+			return errors.New(fmt.Sprintf("type of rule %s declared twice", rules[0]))
+		}
+		p.types[rules[0]] = typeDecl{typ: quoteResolver.Replace(args[1].val), at: at}
+	default:
+		return errors.New(fmt.Sprintf("unknown directive %%%s", name))
+	}
+	return nil
+}
+
+func parseRuleBody(name string, parts []Expr) parseStateFn {
+	return func(p *parser) parseStateFn {
+		next, ok := p.next()
+		if !ok {
+			p.Errorf("unexpected end of grammar in rule %s", name)
+			return nil
+		}
+		switch next.typ {
+		case itemWhitespace:
+			return parseRuleBody(name, parts)
+		case itemLiteral, itemFoldLiteral, itemRegexp, itemIdentifier:
+			e := p.terminal(next)
+			if e == nil {
+				return nil
+			}
+			return parseRuleBody(name, append(parts, e))
+		case itemCall:
+			return parseCall(next, func(call Expr) parseStateFn {
+				return parseRuleBody(name, append(parts, call))
+			})
+		case itemAnd, itemNot:
+			return parseRuleBody(name, append(parts, &predicateMark{not: next.typ == itemNot}))
+		case itemLabel:
+			if strings.Contains(next.val, ".") {
+				p.Errorf("label %s cannot be qualified", next.val)
+				return nil
+			}
+			return parseRuleBody(name, append(parts, &labelMark{name: next.val}))
+		case itemOpenParen:
+			p.groups = append(p.groups, group{parts: parts})
+			return parseRuleBody(name, nil)
+		case itemCloseParen:
+			if len(p.groups) == 0 {
+				p.Errorf("unexpected ')'")
 				return nil
 			}
-			lex := parts[len(parts)-1]
-			parts := parts[:len(parts)-1]
-			return parseRuleBody(name, append(parts, NewOptionClosure(lex)))
-		case itemDiscard:
 			if len(parts) == 0 {
-				p.Errorf("expected lexeme definition before '^'")
+				p.Errorf("expected an expression before ')'")
+				return nil
+			}
+			g := p.groups[len(p.groups)-1]
+			p.groups = p.groups[:len(p.groups)-1]
+			e, err := sequence(parts)
+			if err != nil {
+				p.Errorf("%s", err)
+				return nil
+			}
+			if g.lhs != nil {
+				e = choice(g.lhs, e)
+			}
+			return parseRuleBody(name, append(g.parts, e))
+		case itemPlus, itemClosure, itemOptional, itemDiscard:
+			if !hasOperand(parts) {
+				p.Errorf("expected an expression before '%s'", next.val)
 				return nil
 			}
-			lex := parts[len(parts)-1]
+			operand := parts[len(parts)-1]
 			parts := parts[:len(parts)-1]
-			return parseRuleBody(name, append(parts, NewDiscardLexer(lex)))
+			return parseRuleBody(name, append(parts, postfix(next.typ, operand)))
 		case itemAlternate:
+			if !hasOperand(parts) {
+				p.Errorf("expected an expression before '/'")
+				return nil
+			}
 			return parseAlternateRHS(name, parts)
 
 		case itemNewline, itemEOF:
+			if len(p.groups) > 0 {
+				p.Errorf("expected ')' before end of rule %s", name)
+				return nil
+			}
 			if len(parts) == 0 {
+				p.Errorf("expected an expression in rule %s", name)
+				return nil
+			}
+			e, err := sequence(parts)
+			if err != nil {
+				p.Errorf("%s", err)
+				return nil
+			}
+			p.emit(name, e)
+			if next.typ == itemEOF {
 				return nil
-			} else if len(parts) == 1 { // Prevent single literals from being stuck in an array.
-				p.parts <- parts[0]
-			} else {
-				p.parts <- NewConcatLexer(name, parts)
 			}
 			return parseLexeme
 		default:
-			p.Errorf("unexpected token : %v", next)
+			p.Errorf("unexpected %s in rule %s", next.describe(), name)
 			return nil
 		}
-		return nil
 	}
 }
 
-func parseAlternateRHS(name string, parts []*Lexeme) parseStateFn {
+func parseAlternateRHS(name string, parts []Expr) parseStateFn {
 	return func(p *parser) parseStateFn {
-		next, ok := <-p.lex.items
+		next, ok := p.next()
 		if !ok {
-			p.Errorf("expected lexeme after '/'")
+			p.Errorf("unexpected end of grammar after '/'")
 			return nil
 		}
-		var rhs *Lexeme
+		lhs := parts[len(parts)-1]
+		parts := parts[:len(parts)-1]
 		switch next.typ {
 		case itemWhitespace:
-			return parseAlternateRHS(name, parts)
-		case itemLiteral:
-			rhs = NewLiteralLexer(name, next.val)
-		case itemRegexp:
-			rhs = NewRegexpLexer(name, regexp.MustCompile(next.val))
-		case itemIdentifier:
-			rhs = NewRuleLexer(next.val)
+			return parseAlternateRHS(name, append(parts, lhs))
+		case itemLiteral, itemFoldLiteral, itemRegexp, itemIdentifier:
+			rhs := p.terminal(next)
+			if rhs == nil {
+				return nil
+			}
+			return parseRuleBody(name, append(parts, choice(lhs, rhs)))
+		case itemCall:
+			return parseCall(next, func(rhs Expr) parseStateFn {
+				return parseRuleBody(name, append(parts, choice(lhs, rhs)))
+			})
+		case itemOpenParen:
+			p.groups = append(p.groups, group{parts: parts, lhs: lhs})
+			return parseRuleBody(name, nil)
+		case itemAnd, itemNot:
+			p.Errorf("a predicate after '/' must be parenthesized: %s(%s...)", lhs, next.val)
+			return nil
+		case itemLabel:
+			p.Errorf("a label after '/' must be parenthesized: %s(%s...)", lhs, next.text())
+			return nil
 		default:
-			p.Errorf("unexpected token : %v", next)
+			p.Errorf("expected an expression after '/', got %s", next.describe())
 			return nil
 		}
+	}
+}
 
-		lhs := parts[len(parts)-1]
-		parts := parts[:len(parts)-1]
+var quoteResolver = strings.NewReplacer("\\'", "'")
 
-		return parseRuleBody(name, append(parts, NewAlternateLexer(name, lhs, rhs)))
+// terminal returns the expression for a literal, regexp or rule
+// reference token, or nil if the token is invalid.
+func (p *parser) terminal(tok item) Expr {
+	switch tok.typ {
+	case itemLiteral:
+		return &Literal{Text: quoteResolver.Replace(tok.val)}
+	case itemFoldLiteral:
+		return &Literal{Text: quoteResolver.Replace(tok.val), IgnoreCase: true}
+	case itemRegexp:
+		if _, err := regexp.Compile(tok.val); err != nil {
+			p.Errorf("invalid regexp: %s", err)
+			return nil
+		}
+		return &Regexp{Pattern: tok.val}
+	}
+	e := &Ref{Name: p.prefix + tok.val}
+	p.refs = append(p.refs, ref{name: e.Name, at: p.at(tok), expr: e})
+	return e
+}
+
+func postfix(typ itemType, operand Expr) Expr {
+	switch typ {
+	case itemPlus:
+		return &Repetition{Expr: operand, Kind: OneOrMore}
+	case itemClosure:
+		return &Repetition{Expr: operand, Kind: ZeroOrMore}
+	case itemOptional:
+		return &Repetition{Expr: operand, Kind: Optional}
+	}
+	return &Discard{Expr: operand}
+}
+
+// choice adds rhs as the last alternative of lhs.
+func choice(lhs, rhs Expr) Expr {
+	if c, ok := lhs.(*Choice); ok {
+		alts := append(c.Alternatives[:len(c.Alternatives):len(c.Alternatives)], rhs)
+		return &Choice{Alternatives: alts}
+	}
+	return &Choice{Alternatives: []Expr{lhs, rhs}}
+}
+
+// A prefixMark is a prefix operator waiting for the rest of its
+// sequence to be parsed. It applies to the whole of the expression
+// that follows it, postfix operators and alternatives included.
+type prefixMark interface {
+	Expr
+	apply(e Expr) Expr
+}
+
+// predicateMark is a pending '&' or '!'.
+type predicateMark struct {
+	not bool
+}
+
+func (m *predicateMark) String() string {
+	if m.not {
+		return "!"
+	}
+	return "&"
+}
+
+func (*predicateMark) expr() {}
+
+func (m *predicateMark) apply(e Expr) Expr {
+	return &Predicate{Expr: e, Not: m.not}
+}
+
+// labelMark is a pending 'name:'.
+type labelMark struct {
+	name string
+}
+
+func (m *labelMark) String() string {
+	return m.name + ":"
+}
+
+func (*labelMark) expr() {}
+
+func (m *labelMark) apply(e Expr) Expr {
+	return &Label{Name: m.name, Expr: e}
+}
+
+// hasOperand reports whether parts ends with an expression that an
+// operator can apply to.
+func hasOperand(parts []Expr) bool {
+	if len(parts) == 0 {
+		return false
+	}
+	_, mark := parts[len(parts)-1].(prefixMark)
+	return !mark
+}
+
+// sequence applies pending prefix operators and returns the
+// expression matching parts in turn.
+func sequence(parts []Expr) (Expr, error) {
+	var folded []Expr
+	for i := len(parts) - 1; i >= 0; i-- {
+		mark, ok := parts[i].(prefixMark)
+		if !ok {
+			folded = append(folded, parts[i])
+			continue
+		}
+		if len(folded) == 0 {
+			return nil, errors.New(fmt.Sprintf("expected expression after '%s'", mark))
+		}
+		folded[len(folded)-1] = mark.apply(folded[len(folded)-1])
+	}
+	for i, j := 0, len(folded)-1; i < j; i, j = i+1, j-1 {
+		folded[i], folded[j] = folded[j], folded[i]
+	}
+	if len(folded) == 1 {
+		return folded[0], nil
 	}
+	return &Sequence{Exprs: folded}, nil
 }
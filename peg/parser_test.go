@@ -1,11 +1,12 @@
 package peg
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 type ParseTest struct {
@@ -18,201 +19,166 @@ var parseTestTable = []ParseTest{
 	ParseTest{
 		"prgm <- 'a'",
 		"a",
-		&ParseTree{"prgm", []byte("a"), nil},
+		&ParseTree{Type: "prgm", Data: []byte("a")},
 	},
 	ParseTest{
 		"prgm <- ~'\\d+'",
 		"74538",
-		&ParseTree{"prgm", []byte("74538"), nil},
+		&ParseTree{Type: "prgm", Data: []byte("74538")},
 	},
 	ParseTest{
 		"prgm <- 'a'_'b' \n _ <- ~'\\s+'",
 		"a b",
-		&ParseTree{
-			"prgm",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"prgm", []byte("a"), nil},
-				&ParseTree{"_", []byte(" "), nil},
-				&ParseTree{"prgm", []byte("b"), nil},
-			},
-		},
+		&ParseTree{Type: "prgm", Children: []*ParseTree{
+			&ParseTree{Type: "prgm", Data: []byte("a")},
+			&ParseTree{Type: "_", Data: []byte(" ")},
+			&ParseTree{Type: "prgm", Data: []byte("b")},
+		}},
 	},
 	ParseTest{
 		"prgm <- name '=' number \n name <- ~'[a-zA-Z]+' \n number <- ~'\\d+'",
 		"variableName=432",
-		&ParseTree{
-			"prgm",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"name", []byte("variableName"), nil},
-				&ParseTree{"prgm", []byte("="), nil},
-				&ParseTree{"number", []byte("432"), nil},
-			},
-		},
+		&ParseTree{Type: "prgm", Children: []*ParseTree{
+			&ParseTree{Type: "name", Data: []byte("variableName")},
+			&ParseTree{Type: "prgm", Data: []byte("=")},
+			&ParseTree{Type: "number", Data: []byte("432")},
+		}},
 	},
 	ParseTest{
 		"prgm <- a+\na <- 'a'",
 		"aaa",
-		&ParseTree{
-			"a+",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"a", []byte("a"), nil},
-			},
-		},
+		&ParseTree{Type: "a+", Children: []*ParseTree{
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "a", Data: []byte("a")},
+		}},
 	},
 	ParseTest{
 		"prgm <- a+\na <- 'a' _?\n_ <- ~'\\s'",
 		"aa a",
-		&ParseTree{
-			"a+",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"a", nil, []*ParseTree{
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"_", []byte(" "), nil},
-				}},
-				&ParseTree{"a", []byte("a"), nil},
-			},
-		},
+		&ParseTree{Type: "a+", Children: []*ParseTree{
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "a", Children: []*ParseTree{
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "_", Data: []byte(" ")},
+			}},
+			&ParseTree{Type: "a", Data: []byte("a")},
+		}},
 	},
 	ParseTest{
 		"prgm <- a*\na <- 'a' _?^\n_ <- ~'\\s+'",
 		"aa \ta",
-		&ParseTree{
-			"a*",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"a", []byte("a"), nil},
-			},
-		},
+		&ParseTree{Type: "a*", Children: []*ParseTree{
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "a", Data: []byte("a")},
+		}},
 	},
 	ParseTest{
 		"prgm <- a*\na <- 'a' _?^ '\\''\n_ <- ~'\\s+'",
 		"a'a \t'a'",
-		&ParseTree{
-			"a*",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a", nil, []*ParseTree{
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"a", []byte("'"), nil},
-				}},
-				&ParseTree{"a", nil, []*ParseTree{
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"a", []byte("'"), nil},
-				}},
-				&ParseTree{"a", nil, []*ParseTree{
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"a", []byte("'"), nil},
-				}},
-			},
-		},
+		&ParseTree{Type: "a*", Children: []*ParseTree{
+			&ParseTree{Type: "a", Children: []*ParseTree{
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "a", Data: []byte("'")},
+			}},
+			&ParseTree{Type: "a", Children: []*ParseTree{
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "a", Data: []byte("'")},
+			}},
+			&ParseTree{Type: "a", Children: []*ParseTree{
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "a", Data: []byte("'")},
+			}},
+		}},
 	},
 	ParseTest{
 		"prgm <- a*\na <- 'a' _?\n_ <- ~'\\s+'",
 		"aa \ta",
-		&ParseTree{
-			"a*",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"a", nil, []*ParseTree{
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"_", []byte(" \t"), nil},
-				}},
-				&ParseTree{"a", []byte("a"), nil},
-			},
-		},
+		&ParseTree{Type: "a*", Children: []*ParseTree{
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "a", Children: []*ParseTree{
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "_", Data: []byte(" \t")},
+			}},
+			&ParseTree{Type: "a", Data: []byte("a")},
+		}},
 	},
 	ParseTest{
 		"prgm <- a* b\na <- 'a'\nb <- 'b'",
 		"aaab",
-		&ParseTree{
-			"prgm",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a*", nil, []*ParseTree{
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"a", []byte("a"), nil},
-				}},
-				&ParseTree{"b", []byte("b"), nil},
-			},
-		},
+		&ParseTree{Type: "prgm", Children: []*ParseTree{
+			&ParseTree{Type: "a*", Children: []*ParseTree{
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "a", Data: []byte("a")},
+			}},
+			&ParseTree{Type: "b", Data: []byte("b")},
+		}},
 	},
 	ParseTest{
 		"prgm <- a+ b\na <- 'a'\nb <- 'b'",
 		"aaab",
-		&ParseTree{
-			"prgm",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a+", nil, []*ParseTree{
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"a", []byte("a"), nil},
-					&ParseTree{"a", []byte("a"), nil},
-				}},
-				&ParseTree{"b", []byte("b"), nil},
-			},
-		},
+		&ParseTree{Type: "prgm", Children: []*ParseTree{
+			&ParseTree{Type: "a+", Children: []*ParseTree{
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "a", Data: []byte("a")},
+				&ParseTree{Type: "a", Data: []byte("a")},
+			}},
+			&ParseTree{Type: "b", Data: []byte("b")},
+		}},
 	},
 	ParseTest{
 		"prgm <- item+\nitem <- a/ b\na <- 'a'\n b <- 'b'",
 		"abaabba",
-		&ParseTree{
-			"item+",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"b", []byte("b"), nil},
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"a", []byte("a"), nil},
-				&ParseTree{"b", []byte("b"), nil},
-				&ParseTree{"b", []byte("b"), nil},
-				&ParseTree{"a", []byte("a"), nil},
-			},
-		},
+		&ParseTree{Type: "item+", Children: []*ParseTree{
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "b", Data: []byte("b")},
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "a", Data: []byte("a")},
+			&ParseTree{Type: "b", Data: []byte("b")},
+			&ParseTree{Type: "b", Data: []byte("b")},
+			&ParseTree{Type: "a", Data: []byte("a")},
+		}},
 	},
 	ParseTest{
 		"prgm <- list+\nlist <- 'c' a+ 'd'\na <- 'a' / list",
 		"cacaaacaaddd",
-		&ParseTree{
-			"list+",
-			nil,
-			[]*ParseTree{
-				&ParseTree{"list", nil, []*ParseTree{
-					&ParseTree{"list", []byte("c"), nil},
-					&ParseTree{"a+", nil, []*ParseTree{
-						&ParseTree{"a", []byte("a"), nil},
-						&ParseTree{"list", nil, []*ParseTree{
-							&ParseTree{"list", []byte("c"), nil},
-							&ParseTree{"a+", nil, []*ParseTree{
-								&ParseTree{"a", []byte("a"), nil},
-								&ParseTree{"a", []byte("a"), nil},
-								&ParseTree{"a", []byte("a"), nil},
-								&ParseTree{"list", nil, []*ParseTree{
-									&ParseTree{"list", []byte("c"), nil},
-									&ParseTree{"a+", nil, []*ParseTree{
-										&ParseTree{"a", []byte("a"), nil},
-										&ParseTree{"a", []byte("a"), nil},
-									}},
-									&ParseTree{"list", []byte("d"), nil},
+		&ParseTree{Type: "list+", Children: []*ParseTree{
+			&ParseTree{Type: "list", Children: []*ParseTree{
+				&ParseTree{Type: "list", Data: []byte("c")},
+				&ParseTree{Type: "a+", Children: []*ParseTree{
+					&ParseTree{Type: "a", Data: []byte("a")},
+					&ParseTree{Type: "list", Children: []*ParseTree{
+						&ParseTree{Type: "list", Data: []byte("c")},
+						&ParseTree{Type: "a+", Children: []*ParseTree{
+							&ParseTree{Type: "a", Data: []byte("a")},
+							&ParseTree{Type: "a", Data: []byte("a")},
+							&ParseTree{Type: "a", Data: []byte("a")},
+							&ParseTree{Type: "list", Children: []*ParseTree{
+								&ParseTree{Type: "list", Data: []byte("c")},
+								&ParseTree{Type: "a+", Children: []*ParseTree{
+									&ParseTree{Type: "a", Data: []byte("a")},
+									&ParseTree{Type: "a", Data: []byte("a")},
 								}},
+								&ParseTree{Type: "list", Data: []byte("d")},
 							}},
-							&ParseTree{"list", []byte("d"), nil},
 						}},
+						&ParseTree{Type: "list", Data: []byte("d")},
 					}},
-					&ParseTree{"list", []byte("d"), nil},
 				}},
-			},
-		},
+				&ParseTree{Type: "list", Data: []byte("d")},
+			}},
+		}},
+	},
+	ParseTest{
+		"prgm <- kw _ kw\nkw <- 'select'i / 'from'i\n_ <- ~'\\s+'",
+		"SeLeCt from",
+		&ParseTree{Type: "prgm", Children: []*ParseTree{
+			&ParseTree{Type: "kw", Data: []byte("SeLeCt")},
+			&ParseTree{Type: "_", Data: []byte(" ")},
+			&ParseTree{Type: "kw", Data: []byte("from")},
+		}},
 	},
 }
 
@@ -244,29 +210,99 @@ func TestParseTable(t *testing.T) {
 	}
 }
 
-func treeCompare(a, b *ParseTree) error {
-	if a == b {
-		return nil
-	} else if a == nil || b == nil {
-		return errors.New(fmt.Sprintf("a or b is nil %v %v", a, b))
-	}
-	if a.Type != b.Type {
-		return errors.New(fmt.Sprintf("tree type mismatch: %q exp: %q", a.Type, b.Type))
+var malformedGrammars = []string{
+	"prgm <- 'a' $ 'b'\nb <- 'b'",
+	"prgm 'a'\nb <- 'b'",
+	"prgm <- ('a'\nb <- 'b'",
+	"prgm <- 'a')\nb <- 'b'",
+	"prgm <- 'unterminated\nb <- 'b'",
+	"%bogus prgm\nprgm <- 'a'",
+	"import \"x.peg\"\nprgm <- 'a'",
+	"prgm <- m(\nb <- 'b'",
+	"prgm <- undefined",
+}
+
+func TestMalformedGrammarsDoNotLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for _, grammar := range malformedGrammars {
+		if _, err := NewParser(strings.NewReader(grammar)); err == nil {
+			t.Errorf("expected error for %q", grammar)
+		}
+		Format([]byte(grammar))
 	}
-	if !bytes.Equal(a.Data, b.Data) {
-		return errors.New(fmt.Sprintf("tree data mismatch: %q exp: %q", string(a.Data), string(b.Data)))
+	// Give any stray goroutines a chance to show up.
+	time.Sleep(10 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before parsing malformed grammars, %d after", before, after)
 	}
+}
 
-	if len(a.Children) != len(b.Children) {
-		return errors.New(fmt.Sprintf("trees have different number of chidren: %d exp: %d", len(a.Children), len(b.Children)))
+var grammarErrorTable = []struct {
+	grammar   string
+	line, col int
+	msg       string
+}{
+	{"prgm <- 'a' $ 'b'", 1, 13, "unexpected character '$'"},
+	{"prgm 'a'", 1, 6, "expected <- after rule name prgm, got \"'a'\""},
+	{"prgm <- ('a'\nb <- 'b'", 1, 13, "expected ')' before end of rule prgm"},
+	{"prgm <- 'a'\n<- 'b'", 2, 1, "expected a rule, directive or import, got \"<-\""},
+	{"prgm <-\nb <- 'b'", 1, 8, "expected an expression in rule prgm"},
+	{"prgm <- 'a'\nb <- ~'('", 2, 6, "invalid regexp: error parsing regexp: missing closing ): `(`"},
+	{"prgm <- a\na <- b", 2, 6, "undefined rule b"},
+	{"prgm <- 'a' / / 'b'", 1, 15, "expected an expression after '/', got \"/\""},
+	{"# comment\n%start q\nprgm <- 'a'", 2, 1, "start rule q is not defined"},
+	{"prgm <- m(x)\nm(y) <- y", 1, 9, "undefined rule x"},
+	{"", 1, 1, "grammar defines no rules"},
+	{"prgm <- 'a' / x:'b'", 1, 15, "a label after '/' must be parenthesized: 'a'(x:...)"},
+	{"prgm <- c.x:'a'", 1, 9, "label c.x cannot be qualified"},
+	{"prgm <- 'a' x:", 1, 15, "expected expression after 'x:'"},
+	{"%type prgm\nprgm <- 'a'", 1, 1, "expected '%type rule' followed by a quoted type"},
+	{"%type prgm 'p'\n%type prgm 'q'\nprgm <- 'a'", 2, 1, "type of rule prgm declared twice"},
+	{"%type q 'p'\nprgm <- 'a'", 1, 1, "typed rule q is not defined"},
+	{"%start 'p'\nprgm <- 'a'", 1, 8, "expected rule names after %start, got \"'p'\""},
+}
+
+func TestGrammarErrors(t *testing.T) {
+	for _, tc := range grammarErrorTable {
+		_, err := NewParser(strings.NewReader(tc.grammar))
+		gerr, ok := err.(*GrammarError)
+		if !ok {
+			t.Errorf("%q: expected a GrammarError, got %v", tc.grammar, err)
+			continue
+		}
+		if gerr.Line != tc.line || gerr.Col != tc.col || gerr.Msg != tc.msg {
+			t.Errorf("%q: got %v, expected %d:%d: %s", tc.grammar, gerr, tc.line, tc.col, tc.msg)
+		}
 	}
+}
 
-	for i, child := range a.Children {
-		if err := treeCompare(child, b.Children[i]); err != nil {
-			return err
+// TestMalformedGrammarsDoNotPanic feeds NewParser every prefix of a
+// grammar using all of the syntax, with and without a stray byte
+// appended.
+func TestMalformedGrammarsDoNotPanic(t *testing.T) {
+	const grammar = "import \"x\" as c\n%start a\n%skip _\na <- !b &c.d ('x'i / ~'y'+)* l:b? c^ # comment\nm(p, q) <- p (q p)*\nb <- m(a, 'z')\n"
+	imp := WithImporter(MapImporter{"x": "d <- 'd'"})
+	for i := 0; i <= len(grammar); i++ {
+		for _, extra := range []string{"", "$", "(", ")", "/", "<", "'", "~", "%", ","} {
+			src := grammar[:i] + extra
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%q: panic: %v", src, r)
+					}
+				}()
+				NewParser(strings.NewReader(src), imp)
+			}()
 		}
 	}
+}
 
+// treeCompare compares a parsed tree with one written by hand, which
+// has no positions or trivia.
+func treeCompare(a, b *ParseTree) error {
+	if diffs := Diff(a, b, IgnorePositions(), IgnoreTrivia()); len(diffs) > 0 {
+		return errors.New(strings.Join(diffs, "\n"))
+	}
 	return nil
 }
 
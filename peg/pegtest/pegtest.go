@@ -0,0 +1,151 @@
+// Package pegtest tests grammars against golden files.
+//
+// Run walks a directory for grammar.peg files. Each grammar is used to
+// parse the *.input files beside it, and every tree is compared with
+// the S-expression, as written by ParseTree.SExpr, in the .golden file
+// of the same name. An input that fails to parse is compared with its
+// error instead, written as "error: " and the message. A layout such as
+//
+//	testdata/
+//		arith/
+//			grammar.peg
+//			sum.input
+//			sum.golden
+//		json/
+//			grammar.peg
+//			...
+//
+// is tested by
+//
+//	var update = flag.Bool("update", false, "rewrite golden files")
+//
+//	func TestGrammars(t *testing.T) {
+//		pegtest.Run(t, "testdata", *update)
+//	}
+//
+// with one subtest per grammar and input. When update is set, Run
+// rewrites the golden files from the trees produced instead, for new
+// inputs and after intended changes to a grammar. The package defines
+// no flags of its own, so that tests choose how update is set.
+package pegtest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+// GrammarFile is the name of the grammar files Run looks for.
+const GrammarFile = "grammar.peg"
+
+// Run tests the grammars found in dir and its subdirectories against
+// their golden files, or rewrites the golden files if update is set.
+// The grammars are compiled with opts, after an importer resolving
+// imports relative to the grammar's directory.
+func Run(t *testing.T, dir string, update bool, opts ...peg.ParserOption) {
+	t.Helper()
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Name() == GrammarFile {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatalf("no %s found in %s", GrammarFile, dir)
+	}
+	for _, d := range dirs {
+		name, err := filepath.Rel(dir, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := d
+		t.Run(filepath.ToSlash(name), func(t *testing.T) {
+			runGrammar(t, d, update, opts)
+		})
+	}
+}
+
+func runGrammar(t *testing.T, dir string, update bool, opts []peg.ParserOption) {
+	src, err := ioutil.ReadFile(filepath.Join(dir, GrammarFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]peg.ParserOption{peg.WithImporter(peg.DirImporter(dir))}, opts...)
+	lang, err := peg.NewParser(strings.NewReader(string(src)), opts...)
+	if err != nil {
+		t.Fatalf("%s: %v", filepath.Join(dir, GrammarFile), err)
+	}
+	inputs, err := filepath.Glob(filepath.Join(dir, "*.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(inputs)
+	for _, input := range inputs {
+		input := input
+		t.Run(strings.TrimSuffix(filepath.Base(input), ".input"), func(t *testing.T) {
+			if err := Check(lang, input, update); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Check parses the file input with lang and compares the result with
+// the golden file beside it, returning an error describing any
+// difference. If update is set, it writes the golden file instead.
+func Check(lang *peg.Language, input string, update bool) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tree, parseErr := lang.Parse(f)
+	got := Dump(tree, parseErr)
+
+	golden := strings.TrimSuffix(input, ".input") + ".golden"
+	if update {
+		return ioutil.WriteFile(golden, []byte(got), 0644)
+	}
+	want, err := ioutil.ReadFile(golden)
+	if os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("%s is missing; run the test with -update to create it", golden))
+	} else if err != nil {
+		return err
+	}
+	if got == string(want) {
+		return nil
+	}
+	if parseErr == nil && !strings.HasPrefix(string(want), "error: ") {
+		wantTree, err := peg.ParseSExpr(strings.NewReader(string(want)))
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %v", golden, err))
+		}
+		if diffs := peg.Diff(tree, wantTree, peg.IgnorePositions()); len(diffs) > 0 {
+			return errors.New(fmt.Sprintf("%s: tree differs from %s:\n\t%s", input, golden, strings.Join(diffs, "\n\t")))
+		}
+	}
+	return errors.New(fmt.Sprintf("%s: got:\n%s\nexpected, from %s:\n%s", input, got, golden, want))
+}
+
+// Dump returns what a golden file holds for the result of a parse: the
+// tree as an S-expression, or the error.
+func Dump(tree *peg.ParseTree, err error) string {
+	if err != nil {
+		return "error: " + err.Error() + "\n"
+	}
+	return tree.SExpr()
+}
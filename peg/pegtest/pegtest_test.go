@@ -0,0 +1,81 @@
+package pegtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Logiraptor/chicken/peg"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pegtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lang, err := peg.NewParser(strings.NewReader("list <- word (',' word)* !~'.'\nword <- ~'[a-z]+'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "a.input")
+	golden := filepath.Join(dir, "a.golden")
+	if err := ioutil.WriteFile(input, []byte("ab,c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Check(lang, input, false); err == nil || !strings.Contains(err.Error(), "-update") {
+		t.Errorf("expected missing golden file error, got %v", err)
+	}
+	if err := Check(lang, input, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(lang, input, false); err != nil {
+		t.Errorf("check after update failed: %v", err)
+	}
+
+	table := []struct {
+		golden string
+		exp    []string
+	}{
+		{"(list\n  (word \"ab\")\n  (list*\n    (list\n      (list \",\")\n      (word \"d\"))))\n", []string{
+			`list/list*[1]/list[0]/word[1]: got data "c", expected "d"`,
+		}},
+		{"(list\n  (word \"ab\")\n  (list*))\n", []string{
+			`list/list*[1]/list[0]: unexpected (list ...)`,
+		}},
+		{"(list\n  (name \"ab\")\n  (list*)\n  (end))\n", []string{
+			`list/name[0]: got (word "ab"), expected (name "ab")`,
+			`list/list*[1]/list[0]: unexpected (list ...)`,
+			`list/end[2]: missing (end)`,
+		}},
+		{"error: no match\n", nil},
+	}
+	for _, tc := range table {
+		if err := ioutil.WriteFile(golden, []byte(tc.golden), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := Check(lang, input, false)
+		if err == nil {
+			t.Errorf("expected %s to differ", tc.golden)
+			continue
+		}
+		for _, diff := range tc.exp {
+			if !strings.Contains(err.Error(), "\t"+diff+"\n") && !strings.HasSuffix(err.Error(), "\t"+diff) {
+				t.Errorf("expected %q in error:\n%v", diff, err)
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(input, []byte("ab,"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(lang, input, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(golden); err != nil || !strings.HasPrefix(string(got), "error: ") {
+		t.Errorf("expected parse error in golden file, got %q, %v", got, err)
+	}
+}
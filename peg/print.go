@@ -0,0 +1,117 @@
+package peg
+
+import (
+	"bytes"
+	"strings"
+)
+
+type lexemeKind int
+
+const (
+	customKind lexemeKind = iota // built outside this package
+	literalKind
+	foldKind
+	regexpKind
+	ruleKind
+	concatKind
+	plusKind
+	starKind
+	optionKind
+	alternateKind
+	discardKind
+	lexicalKind
+	andKind
+	notKind
+	boundaryKind
+)
+
+// String returns the expression matched by l in grammar syntax.
+// References to other rules are printed by name.
+func (l *Lexeme) String() string {
+	return l.toExpr().String()
+}
+
+// toExpr returns the expression matched by l. Lexemes built outside
+// this package are printed by name, in angle brackets.
+func (l *Lexeme) toExpr() Expr {
+	switch l.kind {
+	case literalKind:
+		return &Literal{Text: l.text}
+	case foldKind:
+		return &Literal{Text: l.text, IgnoreCase: true}
+	case regexpKind:
+		return &Regexp{Pattern: l.text}
+	case ruleKind:
+		return &Ref{Name: l.text}
+	case concatKind:
+		exprs := make([]Expr, len(l.Dependencies))
+		for i, dep := range l.Dependencies {
+			exprs[i] = dep.toExpr()
+		}
+		return &Sequence{Exprs: exprs}
+	case alternateKind:
+		return choice(l.Dependencies[0].toExpr(), l.Dependencies[1].toExpr())
+	case plusKind:
+		return &Repetition{Expr: l.Dependencies[0].toExpr(), Kind: OneOrMore}
+	case starKind:
+		return &Repetition{Expr: l.Dependencies[0].toExpr(), Kind: ZeroOrMore}
+	case optionKind:
+		return &Repetition{Expr: l.Dependencies[0].toExpr(), Kind: Optional}
+	case discardKind:
+		return &Discard{Expr: l.Dependencies[0].toExpr()}
+	case andKind, notKind:
+		return &Predicate{Expr: l.Dependencies[0].toExpr(), Not: l.kind == notKind}
+	case lexicalKind, boundaryKind:
+		return l.Dependencies[0].toExpr()
+	}
+	return &custom{name: l.Name}
+}
+
+// custom stands for a lexeme built outside this package.
+type custom struct {
+	name string
+}
+
+func (c *custom) String() string { return "<" + c.name + ">" }
+
+func (*custom) expr() {}
+
+// quote returns s as a single quoted grammar literal.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "\\'", -1) + "'"
+}
+
+// String returns the grammar of the language in canonical form, as
+// printed by Grammar.String. Rules are printed in definition order
+// after imports and macros have been resolved, so the text stands on
+// its own: imported rules and each distinct macro invocation appear as
+// ordinary rules, typed with %type like the trees they build.
+func (l *Language) String() string {
+	if l.grammar == nil {
+		return ""
+	}
+	return l.grammar.String()
+}
+
+// ruleLine is a formatted rule definition.
+type ruleLine struct {
+	name string
+	body string
+}
+
+// writeRules writes a block of rules with their arrows aligned.
+func writeRules(buf *bytes.Buffer, rules []ruleLine) {
+	width := 0
+	for _, r := range rules {
+		if len(r.name) > width {
+			width = len(r.name)
+		}
+	}
+	for _, r := range rules {
+		buf.WriteString(r.name)
+		buf.WriteString(strings.Repeat(" ", width-len(r.name)))
+		buf.WriteString(" <- ")
+		buf.WriteString(r.body)
+		buf.WriteByte('\n')
+	}
+}
@@ -0,0 +1,125 @@
+package peg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var printTestTable = []FormatTest{
+	FormatTest{
+		"prgm <- 'a'",
+		"prgm <- 'a'\n",
+	},
+	FormatTest{
+		"prgm <- name '=' number\nname <- ~'[a-z]+'\nnumber <- digit+ / 'it\\'s'i\ndigit <- ~'\\d'",
+		"prgm   <- name '=' number\nname   <- ~'[a-z]+'\nnumber <- digit+ / 'it\\'s'i\ndigit  <- ~'\\d'\n",
+	},
+	FormatTest{
+		"prgm <- (a b)* (a / (b c)) (a / b)? a / (b*) a^\na <- 'a'\nb <- 'b'\nc <- 'c'",
+		"prgm <- (a b)* a / (b c) (a / b)? a / (b*) a^\na    <- 'a'\nb    <- 'b'\nc    <- 'c'\n",
+	},
+	FormatTest{
+		"%start sum\n%skip _\n%lexical number\n# comment\n_ <- ~'\\s+'\nsum <- number ('+' number)*\nnumber <- ~'\\d+'",
+		"%start sum\n%skip _\n%lexical number\n_      <- ~'\\s+'\nsum    <- number ('+' number)*\nnumber <- ~'\\d+'\n",
+	},
+	FormatTest{
+		"prgm <- other\nother <- 'x'",
+		"prgm  <- other\nother <- 'x'\n",
+	},
+}
+
+func TestLanguageString(t *testing.T) {
+	for _, tc := range printTestTable {
+		lang, err := NewParser(strings.NewReader(tc.input))
+		if err != nil {
+			t.Error(tc.input)
+			t.Error(err)
+			continue
+		}
+		printed := lang.String()
+		if printed != tc.exp {
+			t.Errorf("String() of %q:\ngot:\n%s\nexp:\n%s", tc.input, printed, tc.exp)
+			continue
+		}
+
+		again, err := NewParser(strings.NewReader(printed))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if again.String() != printed {
+			t.Errorf("printed grammar does not round trip:\n%s\n%s", printed, again.String())
+		}
+	}
+}
+
+// TestGrammarStringRoundTrip checks that ParseGrammar reads the text
+// of Grammar.String back into the grammar printed.
+func TestGrammarStringRoundTrip(t *testing.T) {
+	for _, c := range corpus {
+		src, err := ioutil.ReadFile(filepath.Join("testdata", "corpus", c.name+".peg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := ParseGrammar(strings.NewReader(string(src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := ParseGrammar(strings.NewReader(g.String()))
+		if err != nil {
+			t.Errorf("%s: %v in:\n%s", c.name, err, g)
+			continue
+		}
+		if !reflect.DeepEqual(again, g) {
+			t.Errorf("%s: got:\n%s\nexpected:\n%s", c.name, again, g)
+		}
+	}
+
+	// Imported rules and macro expansions are renamed, keeping the
+	// types of their trees.
+	imp := WithImporter(MapImporter{"common.peg": "%lexical num\nnum <- ~'[0-9]+'\nsep_by(x, s) <- x (s x)*\n"})
+	g, err := ParseGrammar(strings.NewReader("import \"common.peg\" as c\nlist <- c.sep_by(c.num, ',') ';' c.sep_by(c.num, ';')\nsep_by <- 'x'"), imp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := g.String()
+	exp := "%start list\n%lexical c_num\n%type c_num 'c.num'\n%type c_sep_by_c_num 'c.sep_by'\n%type c_sep_by_c_num_ 'c.sep_by'\n" +
+		"c_num           <- ~'[0-9]+'\n" +
+		"list            <- c_sep_by_c_num ';' c_sep_by_c_num_\n" +
+		"sep_by          <- 'x'\n" +
+		"c_sep_by_c_num  <- c_num (',' c_num)*\n" +
+		"c_sep_by_c_num_ <- c_num (';' c_num)*\n"
+	if printed != exp {
+		t.Errorf("got:\n%s\nexpected:\n%s", printed, exp)
+	}
+	again, err := ParseGrammar(strings.NewReader(printed))
+	if err != nil {
+		t.Fatalf("%v in:\n%s", err, printed)
+	}
+	if again.String() != printed {
+		t.Errorf("printed grammar does not round trip:\n%s\n%s", printed, again)
+	}
+	lang, err := Compile(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	langAgain, err := Compile(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const input = "1,2;3;4"
+	want, err := lang.ParseString(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := langAgain.ParseString(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := Diff(got, want); len(diff) > 0 {
+		t.Errorf("trees differ: %s", strings.Join(diff, "; "))
+	}
+}
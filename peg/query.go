@@ -0,0 +1,395 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Query selects trees from a ParseTree, much as a CSS selector
+// selects elements from a document. A query is a list of selectors
+// separated by commas, and each selector a list of steps, every one
+// selecting among the descendants of what the step before it
+// selected, or with > between them among its children:
+//
+//	assign > name              names that are children of assignments
+//	call[name="print"] arg     args somewhere inside calls of print
+//	func > name@fn, call@c     function names and calls, captured
+//
+// A step is a tree type, or * for any type, which may be followed by
+//
+//	="text"     the text of the tree must be text
+//	~="re"      the text of the tree must match the regexp re
+//	[t]         the tree must have a child of type t
+//	[t="text"]  ... of type t whose text is text
+//	[t~="re"]   ... of type t whose text matches re
+//	@name       the tree is captured under name, see Matches
+//
+// The text of a tree is the Data of its leaves, without trivia. Types
+// containing spaces or the characters of the syntax are written as Go
+// string literals. A Query is compiled once and may be run on any
+// number of trees, from any number of goroutines.
+type Query struct {
+	src       string
+	selectors [][]*queryStep
+}
+
+type queryStep struct {
+	child   bool   // whether the step selects among children only
+	typ     string // "" for any type
+	text    *textTest
+	attrs   []queryAttr
+	capture string
+}
+
+type queryAttr struct {
+	typ  string
+	text *textTest // nil if any child of typ will do
+}
+
+type textTest struct {
+	text string
+	re   *regexp.Regexp // if not nil, used instead of text
+}
+
+func (t *textTest) match(tree *ParseTree) bool {
+	text := tree.Text()
+	if t.re != nil {
+		return t.re.MatchString(text)
+	}
+	return text == t.text
+}
+
+// A QueryMatch is a tree selected by a Query, with the trees captured
+// on the way to it.
+type QueryMatch struct {
+	Tree     *ParseTree
+	Captures map[string]*ParseTree
+}
+
+// CompileQuery parses a query.
+func CompileQuery(src string) (*Query, error) {
+	p := &queryParser{src: src}
+	q := &Query{src: src}
+	for {
+		sel, err := p.selector()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("query %q: %s", src, err))
+		}
+		q.selectors = append(q.selectors, sel)
+		if p.pos == len(src) {
+			return q, nil
+		}
+		p.pos++ // the comma ending the selector
+	}
+}
+
+// MustCompileQuery is like CompileQuery but panics if the query cannot
+// be parsed, for queries fixed in the program.
+func MustCompileQuery(src string) *Query {
+	q, err := CompileQuery(src)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// String returns the source of the query.
+func (q *Query) String() string {
+	return q.src
+}
+
+// All returns the trees under tree, tree itself included, selected by
+// q, in the order of a depth first walk.
+func (q *Query) All(tree *ParseTree) []*ParseTree {
+	var trees []*ParseTree
+	q.walk(tree, nil, func(t *ParseTree, _ map[string]*ParseTree) bool {
+		trees = append(trees, t)
+		return true
+	})
+	return trees
+}
+
+// First returns the first tree All would, or nil if there is none.
+func (q *Query) First(tree *ParseTree) *ParseTree {
+	var first *ParseTree
+	q.walk(tree, nil, func(t *ParseTree, _ map[string]*ParseTree) bool {
+		first = t
+		return false
+	})
+	return first
+}
+
+// Matches is like All, but also returns the captures of each match: the
+// trees matched by the steps marked with @name, by name. Where a tree
+// can be selected in several ways, the captures are those of the first
+// selector that selects it, matching its steps to the nearest
+// ancestors they can.
+func (q *Query) Matches(tree *ParseTree) []QueryMatch {
+	var matches []QueryMatch
+	q.walk(tree, nil, func(t *ParseTree, caps map[string]*ParseTree) bool {
+		matches = append(matches, QueryMatch{Tree: t, Captures: caps})
+		return true
+	})
+	return matches
+}
+
+// walk calls fn on every tree selected, until it returns false, and
+// reports whether it did not. Ancestors holds the trees from the root
+// to the parent of tree.
+func (q *Query) walk(tree *ParseTree, ancestors []*ParseTree, fn func(*ParseTree, map[string]*ParseTree) bool) bool {
+	if tree == nil {
+		return true
+	}
+	if caps, ok := q.selects(tree, ancestors); ok && !fn(tree, caps) {
+		return false
+	}
+	ancestors = append(ancestors, tree)
+	for _, child := range tree.Children {
+		if !q.walk(child, ancestors, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// selects reports whether q selects tree, below ancestors, returning
+// the captures of the first selector that does.
+func (q *Query) selects(tree *ParseTree, ancestors []*ParseTree) (map[string]*ParseTree, bool) {
+	for _, sel := range q.selectors {
+		caps := make(map[string]*ParseTree)
+		if matchSteps(sel, len(sel)-1, tree, ancestors, caps) {
+			return caps, true
+		}
+	}
+	return nil, false
+}
+
+// matchSteps reports whether tree, below ancestors, is selected by
+// steps[:k+1], recording the captures of the match in caps.
+func matchSteps(steps []*queryStep, k int, tree *ParseTree, ancestors []*ParseTree, caps map[string]*ParseTree) bool {
+	step := steps[k]
+	if !step.match(tree) {
+		return false
+	}
+	matched := k == 0
+	switch {
+	case matched:
+	case step.child:
+		if n := len(ancestors); n > 0 {
+			matched = matchSteps(steps, k-1, ancestors[n-1], ancestors[:n-1], caps)
+		}
+	default:
+		for i := len(ancestors) - 1; i >= 0 && !matched; i-- {
+			matched = matchSteps(steps, k-1, ancestors[i], ancestors[:i], caps)
+		}
+	}
+	if matched && step.capture != "" {
+		caps[step.capture] = tree
+	}
+	return matched
+}
+
+func (s *queryStep) match(tree *ParseTree) bool {
+	if s.typ != "" && tree.Type != s.typ {
+		return false
+	}
+	if s.text != nil && !s.text.match(tree) {
+		return false
+	}
+	for _, attr := range s.attrs {
+		found := false
+		for _, child := range tree.Children {
+			if child != nil && child.Type == attr.typ && (attr.text == nil || attr.text.match(child)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type queryParser struct {
+	src string
+	pos int
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("at offset %d: %s", p.pos, fmt.Sprintf(format, args...)))
+}
+
+// space skips white space, reporting whether there was any.
+func (p *queryParser) space() bool {
+	start := p.pos
+	for p.pos < len(p.src) {
+		r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		p.pos += n
+	}
+	return p.pos > start
+}
+
+func (p *queryParser) peek() byte {
+	if p.pos == len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// selector parses a selector, up to the end of the query or the comma
+// ending it.
+func (p *queryParser) selector() ([]*queryStep, error) {
+	p.space()
+	var steps []*queryStep
+	child := false
+	for {
+		step, err := p.step()
+		if err != nil {
+			return nil, err
+		}
+		step.child = child
+		steps = append(steps, step)
+		spaced := p.space()
+		switch c := p.peek(); {
+		case c == 0 || c == ',':
+			return steps, nil
+		case c == '>':
+			p.pos++
+			p.space()
+			child = true
+		case spaced:
+			child = false
+		default:
+			return nil, p.errorf("unexpected %q", c)
+		}
+	}
+}
+
+func (p *queryParser) step() (*queryStep, error) {
+	step := &queryStep{}
+	if p.peek() == '*' && (p.pos+1 == len(p.src) || isQuerySyntax(rune(p.src[p.pos+1]))) {
+		p.pos++
+	} else {
+		typ, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		step.typ = typ
+	}
+	text, err := p.textTest()
+	if err != nil {
+		return nil, err
+	}
+	step.text = text
+	for p.peek() == '[' {
+		p.pos++
+		p.space()
+		typ, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		p.space()
+		attr := queryAttr{typ: typ}
+		if attr.text, err = p.textTest(); err != nil {
+			return nil, err
+		}
+		p.space()
+		if p.peek() != ']' {
+			return nil, p.errorf("expected ]")
+		}
+		p.pos++
+		step.attrs = append(step.attrs, attr)
+	}
+	if p.peek() == '@' {
+		p.pos++
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		step.capture = name
+	}
+	return step, nil
+}
+
+// textTest parses an optional ="text" or ~="re", with spaces allowed
+// around the operator.
+func (p *queryParser) textTest() (*textTest, error) {
+	start := p.pos
+	p.space()
+	isRegexp := strings.HasPrefix(p.src[p.pos:], "~=")
+	if !isRegexp && p.peek() != '=' {
+		p.pos = start
+		return nil, nil
+	}
+	if isRegexp {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+	p.space()
+	if p.peek() != '"' {
+		return nil, p.errorf("expected string")
+	}
+	text, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if !isRegexp {
+		return &textTest{text: text}, nil
+	}
+	re, err := regexp.Compile(text)
+	if err != nil {
+		return nil, p.errorf("%s", err)
+	}
+	return &textTest{re: re}, nil
+}
+
+// name parses a bare name or a string literal.
+func (p *queryParser) name() (string, error) {
+	if p.peek() == '"' {
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			if p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			return "", p.errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(p.src[p.pos : end+1])
+		if err != nil {
+			return "", p.errorf("invalid string %s", p.src[p.pos:end+1])
+		}
+		p.pos = end + 1
+		return s, nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) {
+		r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+		if isQuerySyntax(r) {
+			break
+		}
+		p.pos += n
+	}
+	if p.pos == start {
+		if p.pos == len(p.src) {
+			return "", p.errorf("unexpected end of query")
+		}
+		return "", p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return p.src[start:p.pos], nil
+}
+
+func isQuerySyntax(r rune) bool {
+	return strings.ContainsRune(`>[]=~@,"`, r) || unicode.IsSpace(r)
+}
@@ -0,0 +1,110 @@
+package peg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const queryGrammar = `%skip _
+prgm   <- stmt+
+stmt   <- assign / (call ';')
+assign <- name '=' expr ';'
+expr   <- call / name / number
+call   <- name '(' args? ')'
+args   <- expr (',' expr)*
+name   <- ~'[a-z]+'
+number <- ~'[0-9]+'
+_      <- ~'\s+'
+`
+
+func TestQuery(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(queryGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString("x = 1; print(x, f(y)); y = g(2);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		query string
+		exp   []string
+	}{
+		{"assign > name", []string{"x", "y"}},
+		{`call[name="print"] name`, []string{"print", "x", "f", "y"}},
+		{`call[name = "print"] args name`, []string{"x", "f", "y"}},
+		{"call > name", []string{"print", "f", "g"}},
+		{"call call > name", []string{"f"}},
+		{`name~="^[fg]$"`, []string{"f", "g"}},
+		{`name="x"`, []string{"x", "x"}},
+		{"* > number", []string{"1", "2"}},
+		{"args > args* > args > call", []string{"f(y)"}},
+		{`"stmt+" > assign[name="x"]`, []string{"x=1;"}},
+		{"number, assign[name]", []string{"x=1;", "1", "y=g(2);", "2"}},
+		{"call[name][args] > name", []string{"print", "f", "g"}},
+		{`call[name~="^p"][args]`, []string{"print(x,f(y))"}},
+		{"prgm", nil},
+		{"assign > call > args > name", nil},
+	}
+	for _, tc := range table {
+		q, err := CompileQuery(tc.query)
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+			continue
+		}
+		var got []string
+		for _, match := range q.All(tree) {
+			got = append(got, match.Text())
+		}
+		if !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("%s: got %q, expected %q", tc.query, got, tc.exp)
+		}
+		if first := q.First(tree); (first == nil) != (tc.exp == nil) || first != nil && first.Text() != tc.exp[0] {
+			t.Errorf("%s: First returned %v", tc.query, first)
+		}
+	}
+}
+
+func TestQueryCaptures(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(queryGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString("y = g(2); print(f(h(3)));")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := MustCompileQuery("assign[name]@a call > name@fn, call@outer call@inner > args > number")
+	var got []string
+	for _, m := range q.Matches(tree) {
+		var caps []string
+		for _, name := range []string{"a", "fn", "outer", "inner"} {
+			if c, ok := m.Captures[name]; ok {
+				caps = append(caps, name+"="+c.Text())
+			}
+		}
+		got = append(got, m.Tree.Text()+" "+strings.Join(caps, " "))
+	}
+	exp := []string{
+		"g a=y=g(2); fn=g",
+		"3 outer=f(h(3)) inner=h(3)",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	for _, bad := range []string{"", " ", "a >", "> a", "a[b", "a[]", `a="x`, `a~="("`, "a,", "a@", "a=b", "a b >", "a [b]", `a[b="\q"]`, "a]"} {
+		if q, err := CompileQuery(bad); err == nil {
+			t.Errorf("%q: expected error, got %#v", bad, q)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("MustCompileQuery did not panic")
+		}
+	}()
+	MustCompileQuery("a >")
+}
@@ -0,0 +1,242 @@
+package peg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// A RewriteFunc returns the tree to put in place of the tree it is
+// given, and whether to replace it at all. Returning a nil tree drops
+// the tree from the children of its parent.
+type RewriteFunc func(m QueryMatch) (*ParseTree, bool)
+
+// A Rewriter transforms parse trees by rules, each a Query selecting
+// the trees to rewrite and a RewriteFunc rewriting them, to normalize
+// trees after parsing: flattening nested operators, dropping
+// parentheses, desugaring. The zero Rewriter has no rules.
+type Rewriter struct {
+	// MaxRewrites, if not 0, is the most rewrites one call to Rewrite
+	// may make before failing, to stop rules that grow trees forever.
+	MaxRewrites int
+	// KeepPositions makes replacements keep the Start and End they
+	// were built with, for rules that set them.
+	KeepPositions bool
+
+	rules []rewriteRule
+}
+
+type rewriteRule struct {
+	query *Query
+	fn    RewriteFunc
+}
+
+// Rule adds a rule rewriting the trees selected by q with fn. Rules
+// are tried in the order they were added, and the first to replace a
+// tree wins.
+func (r *Rewriter) Rule(q *Query, fn RewriteFunc) {
+	r.rules = append(r.rules, rewriteRule{query: q, fn: fn})
+}
+
+// Rewrite applies the rules to tree, bottom up: the children of a tree
+// are rewritten before it, and a tree replaced by a rule is rewritten
+// again, children first, until no rule applies to it. Queries see the
+// ancestors of a tree as they are when it is rewritten. As rewriting a
+// tree can make rules apply to the trees around it, the whole tree is
+// rewritten again until it stops changing.
+//
+// Rewrite fails if rewriting goes around in a cycle, returning a tree
+// to a shape it had before, or makes more than MaxRewrites rewrites.
+//
+// The tree passed in is not modified: trees on the way to rewritten
+// trees are copied. A replacement taken from the tree being rewritten
+// keeps its Start and End; any other is given those of the tree it
+// replaces, so that rewritten trees keep their place in the source,
+// unless KeepPositions is set.
+func (r *Rewriter) Rewrite(tree *ParseTree) (*ParseTree, error) {
+	rw := &rewriting{r: r, forms: newTreeForms()}
+	if !r.KeepPositions {
+		rw.placed = make(map[*ParseTree]bool)
+		rw.place(tree)
+	}
+	rw.forms.add(tree)
+	for {
+		next, changed, err := rw.tree(tree, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return tree, nil
+		}
+		if rw.forms.add(next) {
+			return nil, errors.New(fmt.Sprintf("rewrite cycle: %s is rewritten back to a previous form", tree.short()))
+		}
+		tree = next
+	}
+}
+
+type rewriting struct {
+	r      *Rewriter
+	count  int
+	forms  *treeForms
+	placed map[*ParseTree]bool // trees whose positions are kept, nil if all are
+}
+
+// place records t and the trees within it as having their positions.
+func (rw *rewriting) place(t *ParseTree) {
+	if t == nil || rw.placed[t] {
+		return
+	}
+	rw.placed[t] = true
+	for _, list := range [][]*ParseTree{t.Trivia, t.Children, t.Trailing} {
+		for _, c := range list {
+			rw.place(c)
+		}
+	}
+}
+
+// tree rewrites t, below ancestors, reporting whether it changed.
+func (rw *rewriting) tree(t *ParseTree, ancestors []*ParseTree) (*ParseTree, bool, error) {
+	changed := false
+	var seen *treeForms // the forms t has taken, once it is rewritten
+	for t != nil {
+		children, ok, err := rw.children(t, ancestors)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			copied := *t
+			copied.Children = children
+			t = &copied
+			changed = true
+			if rw.placed != nil {
+				rw.placed[t] = true
+			}
+		}
+		next, ok := rw.apply(t, ancestors)
+		if !ok {
+			break
+		}
+		rw.count++
+		if rw.r.MaxRewrites > 0 && rw.count > rw.r.MaxRewrites {
+			return nil, false, errors.New(fmt.Sprintf("rewrite of %s exceeds the maximum of %d rewrites", t.short(), rw.r.MaxRewrites))
+		}
+		if seen == nil {
+			seen = newTreeForms()
+			seen.hashes = rw.forms.hashes
+			seen.add(t)
+		}
+		if seen.add(next) {
+			return nil, false, errors.New(fmt.Sprintf("rewrite cycle: %s is rewritten back to a previous form", t.short()))
+		}
+		t = next
+		changed = true
+	}
+	return t, changed, nil
+}
+
+// children rewrites the children of t, returning a new list if any
+// of them changed.
+func (rw *rewriting) children(t *ParseTree, ancestors []*ParseTree) ([]*ParseTree, bool, error) {
+	ancestors = append(ancestors[:len(ancestors):len(ancestors)], t)
+	var children []*ParseTree
+	changed := false
+	for i, child := range t.Children {
+		next, ok, err := rw.tree(child, ancestors)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok && !changed {
+			children = append(children, t.Children[:i]...)
+			changed = true
+		}
+		if changed && (next != nil || child == nil) {
+			children = append(children, next)
+		}
+	}
+	return children, changed, nil
+}
+
+// apply returns the replacement of t by the first rule that replaces
+// it, if any.
+func (rw *rewriting) apply(t *ParseTree, ancestors []*ParseTree) (*ParseTree, bool) {
+	for _, rule := range rw.r.rules {
+		caps, ok := rule.query.selects(t, ancestors)
+		if !ok {
+			continue
+		}
+		next, ok := rule.fn(QueryMatch{Tree: t, Captures: caps})
+		if !ok {
+			continue
+		}
+		if next != nil && rw.placed != nil && !rw.placed[next] {
+			placed := *next
+			placed.Start, placed.End = t.Start, t.End
+			next = &placed
+			rw.placed[next] = true
+		}
+		return next, true
+	}
+	return nil, false
+}
+
+// treeForms records the forms trees have taken, to detect cycles.
+// Forms are compared as by Equal, regardless of positions, and found
+// by a hash of each tree. Rewritten trees share most of their subtrees
+// with earlier forms, whose hashes are kept rather than computed again.
+type treeForms struct {
+	hashes map[*ParseTree]uint64
+	seen   map[uint64][]*ParseTree
+}
+
+func newTreeForms() *treeForms {
+	return &treeForms{
+		hashes: make(map[*ParseTree]uint64),
+		seen:   make(map[uint64][]*ParseTree),
+	}
+}
+
+// add records the form of t, reporting whether it was seen before.
+func (f *treeForms) add(t *ParseTree) bool {
+	h := f.hash(t)
+	for _, prev := range f.seen[h] {
+		if prev.Equal(t, IgnorePositions()) {
+			return true
+		}
+	}
+	f.seen[h] = append(f.seen[h], t)
+	return false
+}
+
+func (f *treeForms) hash(t *ParseTree) uint64 {
+	if t == nil {
+		return 0
+	}
+	if h, ok := f.hashes[t]; ok {
+		return h
+	}
+	w := fnv.New64a()
+	var n [8]byte
+	write := func(x uint64) {
+		binary.LittleEndian.PutUint64(n[:], x)
+		w.Write(n[:])
+	}
+	write(uint64(len(t.Type)))
+	w.Write([]byte(t.Type))
+	if t.Data == nil {
+		write(^uint64(0))
+	} else {
+		write(uint64(len(t.Data)))
+		w.Write(t.Data)
+	}
+	for _, list := range [][]*ParseTree{t.Trivia, t.Children, t.Trailing} {
+		write(uint64(len(list)))
+		for _, c := range list {
+			write(f.hash(c))
+		}
+	}
+	h := w.Sum64()
+	f.hashes[t] = h
+	return h
+}
@@ -0,0 +1,212 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(`%skip _
+sum     <- product (('+' / '-') product)*
+product <- atom (('*' / '/') atom)*
+atom    <- number / ('(' sum ')')
+number  <- ~'[0-9]+'
+_       <- ~' +'`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := "(1 + (2)) * 3 - 4"
+	tree, err := lang.ParseString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := tree.SExpr()
+
+	var r Rewriter
+	// Drop parentheses.
+	r.Rule(MustCompileQuery(`atom[atom="("]`), func(m QueryMatch) (*ParseTree, bool) {
+		return m.Tree.Children[1], true
+	})
+	// Flatten sums and products into their operands and operators.
+	for _, typ := range []string{"sum", "product"} {
+		r.Rule(MustCompileQuery(typ+"["+typ+"*]"), func(m QueryMatch) (*ParseTree, bool) {
+			flat := &ParseTree{Type: m.Tree.Type, Children: []*ParseTree{m.Tree.Children[0]}}
+			for _, op := range m.Tree.Children[1].Children {
+				flat.Children = append(flat.Children, op.Children...)
+			}
+			return flat, true
+		})
+	}
+	// Unwrap sums and products of one operand.
+	r.Rule(MustCompileQuery("sum, product"), func(m QueryMatch) (*ParseTree, bool) {
+		if len(m.Tree.Children) != 1 {
+			return nil, false
+		}
+		return m.Tree.Children[0], true
+	})
+	got, err := r.Rewrite(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `(sum
+  (product
+    (sum
+      (number "1")
+      (sum "+")
+      (number "2"))
+    (product "*")
+    (number "3"))
+  (sum "-")
+  (number "4"))
+`
+	if got.SExpr() != exp {
+		t.Errorf("got:\n%s\nexpected:\n%s", got.SExpr(), exp)
+	}
+	if tree.SExpr() != before {
+		t.Errorf("rewriting changed the original tree:\n%s", tree.SExpr())
+	}
+	for _, tc := range []struct {
+		tree *ParseTree
+		text string
+	}{
+		{got, src},
+		{got.Children[0], "(1 + (2)) * 3"},
+		{got.Children[0].Children[0], "1 + (2)"},
+		{got.Children[0].Children[0].Children[2], "2"},
+	} {
+		if text := src[tc.tree.Start:tc.tree.End]; text != tc.text {
+			t.Errorf("%s tree at %q, expected %q", tc.tree.Type, text, tc.text)
+		}
+	}
+}
+
+func TestRewriteFixpoint(t *testing.T) {
+	leaf := func(typ string) *ParseTree {
+		return &ParseTree{Type: typ, Data: []byte(typ)}
+	}
+	tree := &ParseTree{Type: "p", Children: []*ParseTree{leaf("a"), leaf("x"), leaf("drop")}}
+
+	var r Rewriter
+	r.Rule(MustCompileQuery("a"), func(QueryMatch) (*ParseTree, bool) {
+		return leaf("b"), true
+	})
+	// Only applies once a has been rewritten, in a second pass.
+	r.Rule(MustCompileQuery("p[b] > x"), func(QueryMatch) (*ParseTree, bool) {
+		return leaf("z"), true
+	})
+	r.Rule(MustCompileQuery("drop"), func(QueryMatch) (*ParseTree, bool) {
+		return nil, true
+	})
+	got, err := r.Rewrite(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "(p\n  (b \"b\")\n  (z \"z\"))\n"; got.SExpr() != exp {
+		t.Errorf("got:\n%s\nexpected:\n%s", got.SExpr(), exp)
+	}
+
+	var none Rewriter
+	if got, err := none.Rewrite(tree); err != nil || got != tree {
+		t.Errorf("rewriter with no rules returned %v, %v", got, err)
+	}
+}
+
+func TestRewriteErrors(t *testing.T) {
+	tree := &ParseTree{Type: "p", Children: []*ParseTree{&ParseTree{Type: "x"}}}
+	rename := func(typ string) RewriteFunc {
+		return func(m QueryMatch) (*ParseTree, bool) {
+			return &ParseTree{Type: typ}, true
+		}
+	}
+
+	var cycle Rewriter
+	cycle.Rule(MustCompileQuery("x"), rename("y"))
+	cycle.Rule(MustCompileQuery("y"), rename("x"))
+	if _, err := cycle.Rewrite(tree); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+
+	// Rules that only apply in turn, one per pass.
+	var passes Rewriter
+	passes.Rule(MustCompileQuery("p[x] > x"), rename("y"))
+	passes.Rule(MustCompileQuery("p[y] > y"), rename("x"))
+	if _, err := passes.Rewrite(tree); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+
+	var same Rewriter
+	same.Rule(MustCompileQuery("x"), func(m QueryMatch) (*ParseTree, bool) {
+		return m.Tree, true
+	})
+	if _, err := same.Rewrite(tree); err == nil {
+		t.Error("expected error for a rule that does not change the tree")
+	}
+
+	grow := Rewriter{MaxRewrites: 100}
+	grow.Rule(MustCompileQuery("x"), func(m QueryMatch) (*ParseTree, bool) {
+		return &ParseTree{Type: "wrap", Children: []*ParseTree{m.Tree}}, true
+	})
+	if _, err := grow.Rewrite(tree); err == nil || !strings.Contains(err.Error(), "maximum") {
+		t.Errorf("expected error for too many rewrites, got %v", err)
+	}
+}
+
+func TestTreeForms(t *testing.T) {
+	leaf := func(typ, data string) *ParseTree {
+		return &ParseTree{Type: typ, Data: []byte(data)}
+	}
+	f := newTreeForms()
+	for _, tc := range []struct {
+		tree *ParseTree
+		seen bool
+	}{
+		{&ParseTree{Type: "p", Children: []*ParseTree{leaf("a", "x")}}, false},
+		{&ParseTree{Type: "p", Children: []*ParseTree{leaf("a", "y")}}, false},
+		{&ParseTree{Type: "p", Children: []*ParseTree{leaf("a", "x")}, Start: 3, End: 4}, true},
+		{&ParseTree{Type: "p", Children: []*ParseTree{{Type: "a"}}}, false},
+		{&ParseTree{Type: "p", Children: []*ParseTree{leaf("a", "")}}, false},
+		{&ParseTree{Type: "p", Trivia: []*ParseTree{leaf("a", "x")}}, false},
+		{&ParseTree{Type: "p", Children: []*ParseTree{leaf("a", "")}}, true},
+	} {
+		if got := f.add(tc.tree); got != tc.seen {
+			t.Errorf("add(%q) = %v, expected %v", tc.tree.SExpr(), got, tc.seen)
+		}
+	}
+}
+
+func TestRewritePositions(t *testing.T) {
+	// An empty tree at offset 0 among the input is left where it is.
+	empty := &ParseTree{Type: "e", Start: 0, End: 0}
+	inner := &ParseTree{Type: "x", Data: []byte("ab"), Start: 2, End: 4}
+	tree := &ParseTree{Type: "p", Start: 0, End: 4, Children: []*ParseTree{
+		{Type: "w", Start: 0, End: 1, Children: []*ParseTree{empty}},
+		{Type: "q", Start: 1, End: 4, Children: []*ParseTree{inner}},
+	}}
+	var r Rewriter
+	r.Rule(MustCompileQuery("w"), func(m QueryMatch) (*ParseTree, bool) {
+		return m.Tree.Children[0], true
+	})
+	r.Rule(MustCompileQuery("q"), func(m QueryMatch) (*ParseTree, bool) {
+		return &ParseTree{Type: "n", Children: m.Tree.Children, Start: 7, End: 9}, true
+	})
+	got, err := r.Rewrite(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := got.Children[0]; e.Type != "e" || e.Start != 0 || e.End != 0 {
+		t.Errorf("empty tree moved to %d-%d", e.Start, e.End)
+	}
+	// A tree built by a rule takes the place of the tree it replaces.
+	if n := got.Children[1]; n.Start != 1 || n.End != 4 || n.Children[0].Start != 2 {
+		t.Errorf("replacement at %d-%d, expected 1-4", n.Start, n.End)
+	}
+
+	r.KeepPositions = true
+	got, err = r.Rewrite(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := got.Children[1]; n.Start != 7 || n.End != 9 {
+		t.Errorf("replacement at %d-%d, expected 7-9 with KeepPositions", n.Start, n.End)
+	}
+}
@@ -0,0 +1,246 @@
+package peg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SExpr formats the tree as an S-expression with one tree per line:
+//
+//	(sum
+//	  (number "1")
+//	  (sum*
+//	    (addop "+")
+//	    (number "2")))
+//
+// A tree is written as a list of its type, its Data as a Go string
+// literal unless it has none, a list of its trivia headed :trivia, its
+// children and a list of its trailing trivia headed :trailing. Types
+// are quoted only when they would not read back as one symbol. Start
+// and End are left out, so that a tree's form does not change with
+// edits to the text around it. A nil tree is written as ().
+func (p *ParseTree) SExpr() string {
+	var buf bytes.Buffer
+	p.writeSExpr(&buf, "")
+	buf.WriteByte('\n')
+	return buf.String()
+}
+
+func (p *ParseTree) writeSExpr(buf *bytes.Buffer, indent string) {
+	if p == nil {
+		buf.WriteString("()")
+		return
+	}
+	buf.WriteByte('(')
+	buf.WriteString(sexprSymbol(p.Type))
+	if p.Data != nil {
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Quote(string(p.Data)))
+	}
+	inner := indent + "  "
+	if len(p.Trivia) > 0 {
+		buf.WriteString("\n" + inner + "(:trivia")
+		writeSExprList(buf, p.Trivia, inner+"  ")
+		buf.WriteByte(')')
+	}
+	writeSExprList(buf, p.Children, inner)
+	if len(p.Trailing) > 0 {
+		buf.WriteString("\n" + inner + "(:trailing")
+		writeSExprList(buf, p.Trailing, inner+"  ")
+		buf.WriteByte(')')
+	}
+	buf.WriteByte(')')
+}
+
+func writeSExprList(buf *bytes.Buffer, trees []*ParseTree, indent string) {
+	for _, tree := range trees {
+		buf.WriteString("\n" + indent)
+		tree.writeSExpr(buf, indent)
+	}
+}
+
+// sexprSymbol returns typ as a bare symbol if it reads back as one,
+// and quoted otherwise.
+func sexprSymbol(typ string) string {
+	if typ == "" || typ[0] == ':' || strings.IndexFunc(typ, isSExprDelim) >= 0 {
+		return strconv.Quote(typ)
+	}
+	return typ
+}
+
+func isSExprDelim(r rune) bool {
+	return r == '(' || r == ')' || r == '"' || r == utf8.RuneError || unicode.IsSpace(r) || !unicode.IsPrint(r)
+}
+
+// ParseSExpr reads a tree written by SExpr. Its Start and End are left
+// zero.
+func ParseSExpr(r io.Reader) (*ParseTree, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rd := &sexprReader{src: src}
+	tree, err := rd.tree()
+	if err != nil {
+		return nil, err
+	}
+	if rd.skipSpace(); rd.pos < len(src) {
+		return nil, rd.errorf("unexpected input after tree")
+	}
+	return tree, nil
+}
+
+type sexprReader struct {
+	src []byte
+	pos int
+}
+
+func (r *sexprReader) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("at offset %d: %s", r.pos, fmt.Sprintf(format, args...)))
+}
+
+func (r *sexprReader) skipSpace() {
+	for r.pos < len(r.src) {
+		c, n := utf8.DecodeRune(r.src[r.pos:])
+		if !unicode.IsSpace(c) {
+			return
+		}
+		r.pos += n
+	}
+}
+
+// peek skips space and returns the next byte, or 0 at the end.
+func (r *sexprReader) peek() byte {
+	r.skipSpace()
+	if r.pos == len(r.src) {
+		return 0
+	}
+	return r.src[r.pos]
+}
+
+func (r *sexprReader) expect(c byte) error {
+	if r.peek() != c {
+		return r.errorf("expected %q", c)
+	}
+	r.pos++
+	return nil
+}
+
+// atom reads a symbol or a string, reporting which it was.
+func (r *sexprReader) atom() (string, bool, error) {
+	switch r.peek() {
+	case 0, '(', ')':
+		return "", false, r.errorf("expected a symbol or string")
+	case '"':
+		end := r.pos + 1
+		for end < len(r.src) && r.src[end] != '"' {
+			if r.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(r.src) {
+			return "", false, r.errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(string(r.src[r.pos : end+1]))
+		if err != nil {
+			return "", false, r.errorf("invalid string %s", r.src[r.pos:end+1])
+		}
+		r.pos = end + 1
+		return s, true, nil
+	}
+	start := r.pos
+	for r.pos < len(r.src) {
+		c, n := utf8.DecodeRune(r.src[r.pos:])
+		if isSExprDelim(c) {
+			break
+		}
+		r.pos += n
+	}
+	if r.pos == start {
+		return "", false, r.errorf("expected a symbol or string")
+	}
+	return string(r.src[start:r.pos]), false, nil
+}
+
+func (r *sexprReader) tree() (*ParseTree, error) {
+	if err := r.expect('('); err != nil {
+		return nil, err
+	}
+	if r.peek() == ')' {
+		r.pos++
+		return nil, nil
+	}
+	typ, quoted, err := r.atom()
+	if err != nil {
+		return nil, err
+	}
+	if !quoted && typ[0] == ':' {
+		return nil, r.errorf("unexpected %s", typ)
+	}
+	tree := &ParseTree{Type: typ}
+	if r.peek() == '"' {
+		data, _, err := r.atom()
+		if err != nil {
+			return nil, err
+		}
+		tree.Data = []byte(data)
+	}
+	for r.peek() == '(' {
+		if list := r.listHead(); list != "" {
+			trees, err := r.list()
+			if err != nil {
+				return nil, err
+			}
+			if list == ":trivia" {
+				tree.Trivia = append(tree.Trivia, trees...)
+			} else {
+				tree.Trailing = append(tree.Trailing, trees...)
+			}
+			continue
+		}
+		child, err := r.tree()
+		if err != nil {
+			return nil, err
+		}
+		tree.Children = append(tree.Children, child)
+	}
+	return tree, r.expect(')')
+}
+
+// listHead returns the head of the list starting at the current
+// position if it is :trivia or :trailing.
+func (r *sexprReader) listHead() string {
+	save := r.pos
+	defer func() { r.pos = save }()
+	r.pos++
+	head, quoted, err := r.atom()
+	if err != nil || quoted || (head != ":trivia" && head != ":trailing") {
+		return ""
+	}
+	return head
+}
+
+// list reads a list of trees headed :trivia or :trailing.
+func (r *sexprReader) list() ([]*ParseTree, error) {
+	r.pos++
+	if _, _, err := r.atom(); err != nil {
+		return nil, err
+	}
+	var trees []*ParseTree
+	for r.peek() == '(' {
+		tree, err := r.tree()
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, tree)
+	}
+	return trees, r.expect(')')
+}
@@ -0,0 +1,67 @@
+package peg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSExpr(t *testing.T) {
+	tree := &ParseTree{Type: "sum", Children: []*ParseTree{
+		&ParseTree{Type: "number", Data: []byte("1"), Trivia: []*ParseTree{
+			&ParseTree{Type: "_", Data: []byte(" ")},
+		}},
+		&ParseTree{Type: "sum*", Children: []*ParseTree{
+			&ParseTree{Type: "op", Data: []byte("+\n")},
+			&ParseTree{Type: "", Data: []byte{}},
+			nil,
+			&ParseTree{Type: ":key (x)"},
+		}},
+	}, Trailing: []*ParseTree{
+		&ParseTree{Type: "", Data: []byte("\xff")},
+	}}
+	exp := `(sum
+  (number "1"
+    (:trivia
+      (_ " ")))
+  (sum*
+    (op "+\n")
+    ("" "")
+    ()
+    (":key (x)"))
+  (:trailing
+    ("" "\xff")))
+`
+	if got := tree.SExpr(); got != exp {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, exp)
+	}
+	got, err := ParseSExpr(strings.NewReader(exp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tree) {
+		t.Errorf("round trip changed the tree:\n%s", got.SExpr())
+	}
+
+	got, err = ParseSExpr(strings.NewReader(" (a (b \"c\")(d) ) "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SExpr() != "(a\n  (b \"c\")\n  (d))\n" {
+		t.Errorf("got %s", got.SExpr())
+	}
+	if got, err := ParseSExpr(strings.NewReader("()")); got != nil || err != nil {
+		t.Errorf("got %v, %v, expected nil tree", got, err)
+	}
+	if s := (*ParseTree)(nil).SExpr(); s != "()\n" {
+		t.Errorf("nil tree written as %q", s)
+	}
+}
+
+func TestSExprErrors(t *testing.T) {
+	for _, bad := range []string{"", "a", "(", "(a", "(a \"b)", "(a \"\\q\")", "(a) b", "(a \"b\" \"c\")", "(a b)", "((a))", "(:trivia)", "(a (:trivia x))"} {
+		if tree, err := ParseSExpr(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected error, got %v", bad, tree)
+		}
+	}
+}
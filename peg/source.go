@@ -2,13 +2,40 @@ package peg
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"regexp"
+	"unicode"
+	"unicode/utf8"
 )
 
+// A Source is the input of a parse together with the state of the
+// parse. Every parse has a Source of its own, which is what lets
+// a Language be used by several goroutines at once; a Source must
+// not be shared between parses.
 type Source struct {
 	buf []byte
+
+	rules      *ruleTable // the rules references are resolved in
+	skip       *Lexeme    // trivia consumed before each token, if any
+	keepTrivia bool       // whether skipped trivia is returned as trees
+	lossless   bool       // whether every consumed byte is returned in a tree
+	lexical    int        // nesting of lexical rules, inside which nothing is skipped
+	quiet      int        // nesting of attempts whose errors are dropped
+	tracer     Tracer     // receives rule events, if set
+
+	limits Limits
+	ctx    context.Context
+	done   <-chan struct{} // ctx.Done(), nil if ctx cannot be cancelled
+	abort  error           // set once the parse is given up
+	depth  int             // nesting of rules being tried
+	steps  int             // rules tried so far
+	nodes  int             // trees built so far
+
+	arena     []flatNode // the trees built, see FlatTree
+	ext       [][]byte   // data of trees adopted from lexemes outside the package
+	flatLimit int        // if positive, replaces maxFlatSize in tests
 }
 
 func NewSource(in io.Reader) (*Source, error) {
@@ -48,3 +75,37 @@ func (s *Source) ConsumeLiteral(valid []byte, pos int) []byte {
 	}
 	return nil
 }
+
+// ConsumeLiteralFold attempts to consume a literal string under
+// Unicode simple case folding. Returns the consumed text, which may
+// differ in length from valid, or nil if there was no match.
+func (s *Source) ConsumeLiteralFold(valid []byte, pos int) []byte {
+	end := pos
+	for len(valid) > 0 {
+		if end >= len(s.buf) {
+			return nil
+		}
+		want, wn := utf8.DecodeRune(valid)
+		got, gn := utf8.DecodeRune(s.buf[end:])
+		if !equalFoldRune(want, got) {
+			return nil
+		}
+		valid = valid[wn:]
+		end += gn
+	}
+	return s.buf[pos:end]
+}
+
+// equalFoldRune reports whether a and b are equal under
+// Unicode simple case folding.
+func equalFoldRune(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for r := unicode.SimpleFold(a); r != a; r = unicode.SimpleFold(r) {
+		if r == b {
+			return true
+		}
+	}
+	return false
+}
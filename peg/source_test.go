@@ -48,3 +48,25 @@ func TestSourceConsume(t *testing.T) {
 		}
 	}
 }
+
+var sourceConsumeFoldTests = []ConsumeTest{
+	ConsumeTest{"SELECT * FROM", "select", "SELECT"},
+	ConsumeTest{"SeLeCt", "select", "SeLeCt"},
+	ConsumeTest{"\u212Aelvin", "kelvin", "\u212Aelvin"},
+	ConsumeTest{"STRASSE", "straße", ""},
+	ConsumeTest{"ΣΊΣΥΦΟΣ", "σίσυφος", "ΣΊΣΥΦΟΣ"},
+	ConsumeTest{"sel", "select", ""},
+}
+
+func TestSourceConsumeLiteralFold(t *testing.T) {
+	for _, ct := range sourceConsumeFoldTests {
+		s, err := NewSource(strings.NewReader(ct.Body))
+		if err != nil {
+			t.Error(err)
+		}
+		match := s.ConsumeLiteralFold([]byte(ct.Regex), 0)
+		if string(match) != ct.Expected || (match == nil) != (ct.Expected == "") {
+			t.Errorf("Source failed to fold-consume input: %s lit: %s match: %q exp: %q", ct.Body, ct.Regex, match, ct.Expected)
+		}
+	}
+}
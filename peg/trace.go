@@ -0,0 +1,93 @@
+package peg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// A Tracer observes a parse rule by rule. Enter is called each time
+// a rule is tried at an offset, and Exit when the attempt ends, with
+// the number of bytes matched on success or the error on failure.
+// Depth counts the rules already being tried, so Enter and Exit calls
+// of one attempt report the same depth. A Tracer shared by parses
+// running at the same time must be safe for concurrent use.
+type Tracer interface {
+	Enter(rule string, pos, depth int)
+	Exit(rule string, pos, depth, n int, err error)
+}
+
+// WithTracer returns a copy of l that reports its parses to t. The
+// copy shares the compiled rules of l.
+func (l *Language) WithTracer(t Tracer) *Language {
+	c := *l
+	c.tracer = t
+	return &c
+}
+
+// NewTextTracer returns a Tracer writing one line per event to w,
+// indented by depth:
+//
+//	pair @0
+//	  key @0
+//	  key @0 matched 1 bytes
+//	  value @2
+//	    number @2
+//	    number @2 failed: expected regex match: "[0-9]+" at "b"
+//	  ...
+//
+// The tracer is safe for concurrent use, though the lines of parses
+// running at the same time are interleaved.
+func NewTextTracer(w io.Writer) Tracer {
+	return &textTracer{w: w}
+}
+
+type textTracer struct {
+	mu sync.Mutex // serializes writes to w
+	w  io.Writer
+}
+
+func (t *textTracer) Enter(rule string, pos, depth int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "%s%s @%d\n", strings.Repeat("  ", depth), rule, pos)
+}
+
+func (t *textTracer) Exit(rule string, pos, depth, n int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	indent := strings.Repeat("  ", depth)
+	if err != nil {
+		fmt.Fprintf(t.w, "%s%s @%d failed: %s\n", indent, rule, pos, err)
+		return
+	}
+	fmt.Fprintf(t.w, "%s%s @%d matched %d bytes\n", indent, rule, pos, n)
+}
+
+// TraceRules returns a Tracer passing on to t only the events of the
+// named rules. Depths are reported unchanged.
+func TraceRules(t Tracer, rules ...string) Tracer {
+	f := &ruleFilter{t: t, rules: make(map[string]bool)}
+	for _, rule := range rules {
+		f.rules[rule] = true
+	}
+	return f
+}
+
+type ruleFilter struct {
+	t     Tracer
+	rules map[string]bool
+}
+
+func (f *ruleFilter) Enter(rule string, pos, depth int) {
+	if f.rules[rule] {
+		f.t.Enter(rule, pos, depth)
+	}
+}
+
+func (f *ruleFilter) Exit(rule string, pos, depth, n int, err error) {
+	if f.rules[rule] {
+		f.t.Exit(rule, pos, depth, n, err)
+	}
+}
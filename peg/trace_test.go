@@ -0,0 +1,62 @@
+package peg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const traceGrammar = "pair <- key '=' value\nkey <- ~'[a-z]+'\nvalue <- number / key\nnumber <- ~'[0-9]+'"
+
+func TestTextTracer(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(traceGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := lang.WithTracer(NewTextTracer(&buf)).ParseString("a=b"); err != nil {
+		t.Fatal(err)
+	}
+	exp := `pair @0
+  key @0
+  key @0 matched 1 bytes
+  value @2
+    number @2
+    number @2 failed: expected regex match: "[0-9]+" at "b"
+    key @2
+    key @2 matched 1 bytes
+  value @2 matched 1 bytes
+pair @0 matched 3 bytes
+`
+	if buf.String() != exp {
+		t.Errorf("got:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+
+	buf.Reset()
+	if _, err := lang.ParseString("a=b"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("language without tracer traced:\n%s", buf.String())
+	}
+}
+
+func TestTraceRules(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(traceGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tracer := TraceRules(NewTextTracer(&buf), "number", "pair")
+	if _, err := lang.WithTracer(tracer).ParseString("a=1"); err != nil {
+		t.Fatal(err)
+	}
+	exp := `pair @0
+    number @2
+    number @2 matched 1 bytes
+pair @0 matched 3 bytes
+`
+	if buf.String() != exp {
+		t.Errorf("got:\n%s\nexp:\n%s", buf.String(), exp)
+	}
+}
@@ -0,0 +1,121 @@
+package peg
+
+// KeepTrivia makes the language attach the text matched by its %skip
+// rule to the parse tree, so that the input can be reproduced.
+// Without it trivia is consumed and dropped.
+func KeepTrivia() ParserOption {
+	return func(c *config) {
+		c.keepTrivia = true
+	}
+}
+
+// Lossless makes the language produce concrete syntax trees: every
+// byte of the input belongs to exactly one leaf, so that the root's
+// Bytes reproduce the input exactly. Text that would otherwise be
+// dropped, whether skipped by %skip, discarded with ^ or left over
+// after the start rule matched, is kept as trivia. Trivia consumed
+// after the last child of a node is attached to that child as
+// Trailing, and input left over after the parse becomes a trivia
+// leaf with an empty Type.
+func Lossless() ParserOption {
+	return func(c *config) {
+		c.keepTrivia = true
+		c.lossless = true
+	}
+}
+
+// NewLexicalLexer marks lex as lexical: trivia may be skipped before
+// it, but never between the tokens it is made of.
+func NewLexicalLexer(lex *Lexeme) *Lexeme {
+	return built(&Lexeme{
+		kind:         lexicalKind,
+		Name:         lex.Name,
+		Dependencies: []*Lexeme{lex},
+	}, func(s *Source, pos int) (int32, error, int) {
+		trivia, skipped := s.skipTrivia(pos)
+		s.lexical++
+		tree, err, off := s.match(lex, pos+skipped)
+		s.lexical--
+		if err != nil {
+			return 0, err, 0
+		}
+		if tree != 0 && trivia != 0 {
+			s.arena[tree].trivia = s.join(trivia, s.arena[tree].trivia)
+		}
+		return tree, nil, skipped + off
+	})
+}
+
+// skipTrivia consumes as much trivia as possible starting at pos,
+// returning the list of trees matched if they are to be kept and the
+// number of bytes consumed.
+func (s *Source) skipTrivia(pos int) (int32, int) {
+	if s.skip == nil || s.lexical > 0 {
+		return 0, 0
+	}
+	var first, last int32
+	offset := 0
+	s.lexical++
+	for {
+		mark := s.mark()
+		tree, err, n := s.try(s.skip, pos+offset)
+		if err != nil || n == 0 {
+			s.release(mark)
+			break
+		}
+		if s.keepTrivia && tree != 0 {
+			first, last = s.appendList(first, last, tree)
+		} else {
+			s.release(mark)
+		}
+		offset += n
+	}
+	s.lexical--
+	return first, offset
+}
+
+// appendList adds tree to the list running from first to last.
+func (s *Source) appendList(first, last, tree int32) (int32, int32) {
+	if first == 0 {
+		return tree, tree
+	}
+	s.arena[last].next = tree
+	return first, tree
+}
+
+// childList accumulates the children of a tree. In lossless mode,
+// text consumed without producing a tree, as by a discard, becomes a
+// trivia leaf attached to the following child.
+type childList struct {
+	first, last int32 // the children
+	count       int
+	pending     int32 // the first and last trivia leaves waiting for a child
+	pendingLast int32
+}
+
+func (c *childList) add(s *Source, tree int32, name string, pos, n int) {
+	if tree == 0 {
+		if s.lossless && n > 0 {
+			c.pending, c.pendingLast = s.appendList(c.pending, c.pendingLast, s.leaf(name, pos, pos+n, 0))
+		}
+		return
+	}
+	if c.pending != 0 {
+		s.arena[c.pendingLast].next = s.arena[tree].trivia
+		s.arena[tree].trivia = c.pending
+		c.pending, c.pendingLast = 0, 0
+	}
+	c.first, c.last = s.appendList(c.first, c.last, tree)
+	c.count++
+}
+
+// finish returns the first child and the number of children,
+// attaching trivia that no child followed to the last one. Trivia is
+// only returned when there were no children to attach it to.
+func (c *childList) finish(s *Source) (int32, int, int32) {
+	if c.pending != 0 && c.count > 0 {
+		s.arena[c.last].trailing = s.join(s.arena[c.last].trailing, c.pending)
+		c.pending, c.pendingLast = 0, 0
+	}
+	return c.first, c.count, c.pending
+}
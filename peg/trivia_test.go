@@ -0,0 +1,156 @@
+package peg
+
+import (
+	"strings"
+	"testing"
+)
+
+const triviaGrammar = `%skip _
+%lexical number
+sum <- number ('+' number)*
+number <- digit+
+digit <- ~'[0-9]'
+_ <- ~'\s+'
+`
+
+func TestSkipTrivia(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(triviaGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := lang.ParseString(" 12 +\t3+ 4 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ParseTree{Type: "sum", Children: []*ParseTree{
+		&ParseTree{Type: "digit+", Children: []*ParseTree{
+			&ParseTree{Type: "digit", Data: []byte("1")},
+			&ParseTree{Type: "digit", Data: []byte("2")},
+		}},
+		&ParseTree{Type: "sum*", Children: []*ParseTree{
+			&ParseTree{Type: "sum", Children: []*ParseTree{
+				&ParseTree{Type: "sum", Data: []byte("+")},
+				&ParseTree{Type: "digit+", Children: []*ParseTree{
+					&ParseTree{Type: "digit", Data: []byte("3")},
+				}},
+			}},
+			&ParseTree{Type: "sum", Children: []*ParseTree{
+				&ParseTree{Type: "sum", Data: []byte("+")},
+				&ParseTree{Type: "digit+", Children: []*ParseTree{
+					&ParseTree{Type: "digit", Data: []byte("4")},
+				}},
+			}},
+		}},
+	}}
+	if err := treeCompare(tree, exp); err != nil {
+		t.Error(err)
+	}
+	if tree.Trailing != nil {
+		t.Errorf("trivia kept without KeepTrivia: %v", tree.Trailing)
+	}
+
+	tree, err = lang.ParseRuleString("number", "1 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 1 {
+		t.Errorf("trivia skipped inside lexical rule: %v", tree)
+	}
+}
+
+func TestKeepTrivia(t *testing.T) {
+	lang, err := NewParser(strings.NewReader(triviaGrammar), KeepTrivia())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, input := range []string{"1+2", " 12 +\t3+ 4 \n", "\n\n7"} {
+		tree, err := lang.ParseString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(tree.Bytes()); got != input {
+			t.Errorf("trivia lost: got %q exp %q", got, input)
+		}
+	}
+}
+
+var triviaErrorTable = []string{
+	"%skip _\nprgm <- 'a'",
+	"%lexical word\nprgm <- 'a'",
+	"%skip a b\nprgm <- 'a'\na <- 'a'\nb <- 'b'",
+	"%skip a\n%skip a\nprgm <- 'a'\na <- 'a'",
+	"%bogus prgm\nprgm <- 'a'",
+}
+
+func TestTriviaErrors(t *testing.T) {
+	for _, grammar := range triviaErrorTable {
+		if _, err := NewParser(strings.NewReader(grammar)); err == nil {
+			t.Errorf("expected error for grammar:\n%s", grammar)
+		}
+	}
+}
+
+var losslessTestTable = []struct {
+	language string
+	inputs   []string
+}{
+	{
+		"prgm <- a*\na <- 'a' _?^\n_ <- ~'\\s+'",
+		[]string{"", "a", "aa \ta", "a a  xyz", "xyz"},
+	},
+	{
+		"%skip _\ncall <- name '('^ args? ')'^\nargs <- name (','^ name)*\nname <- ~'[a-z]+'\n_ <- ~'\\s+'",
+		[]string{"f()", " f ( a , b ) ", "f(a,b,c)\n\n", "f(a) g(b)"},
+	},
+	{
+		"prgm <- '-'^",
+		[]string{"-", "--"},
+	},
+}
+
+func TestLossless(t *testing.T) {
+	for _, tc := range losslessTestTable {
+		lang, err := NewParser(strings.NewReader(tc.language), Lossless())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, input := range tc.inputs {
+			tree, err := lang.ParseString(input)
+			if err != nil {
+				t.Error(tc.language)
+				t.Error(err)
+				continue
+			}
+			if got := string(tree.Bytes()); got != input {
+				t.Errorf("lossless round trip failed: got %q exp %q", got, input)
+			}
+		}
+	}
+}
+
+func TestLosslessTrivia(t *testing.T) {
+	lang, err := NewParser(strings.NewReader("prgm <- a '-'^ a\na <- 'a'"), Lossless())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := lang.ParseString("a-a!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ParseTree{Type: "prgm", Children: []*ParseTree{
+		&ParseTree{Type: "a", Data: []byte("a")},
+		&ParseTree{Type: "a", Data: []byte("a")},
+	}}
+	if err := treeCompare(tree, exp); err != nil {
+		t.Error(err)
+	}
+	second := tree.Children[1]
+	if len(second.Trivia) != 1 || string(second.Trivia[0].Data) != "-" {
+		t.Errorf("discarded text not attached as trivia: %v", second.Trivia)
+	}
+	if len(tree.Trailing) != 1 || tree.Trailing[0].Type != "" || string(tree.Trailing[0].Data) != "!" {
+		t.Errorf("unparsed input not kept as trailing trivia: %v", tree.Trailing)
+	}
+}